@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS upload_sessions
+(
+    id             UUID PRIMARY KEY                  DEFAULT gen_random_uuid(),
+    user_id        INTEGER                  NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    file_name      TEXT                     NOT NULL,
+    binary_type    TEXT                     NOT NULL,
+    upload_type    TEXT                     NOT NULL,
+    size           BIGINT                   NOT NULL,
+    received_bytes BIGINT                   NOT NULL DEFAULT 0,
+    upload_id      INTEGER REFERENCES uploads (id) ON DELETE SET NULL,
+    created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    completed_at   TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_upload_sessions_user_id ON upload_sessions (user_id);
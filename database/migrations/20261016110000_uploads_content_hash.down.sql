@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_uploads_content_hash;
+
+ALTER TABLE uploads
+    DROP COLUMN IF EXISTS ref_count,
+    DROP COLUMN IF EXISTS content_hash;
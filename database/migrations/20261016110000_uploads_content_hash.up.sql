@@ -0,0 +1,5 @@
+ALTER TABLE uploads
+    ADD COLUMN IF NOT EXISTS content_hash TEXT,
+    ADD COLUMN IF NOT EXISTS ref_count    INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS idx_uploads_content_hash ON uploads (content_hash, binary_type) WHERE content_hash IS NOT NULL;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_uploads_url_expiration_time ON uploads (url_expiration_time);
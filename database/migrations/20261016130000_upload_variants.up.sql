@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS upload_variants
+(
+    id         SERIAL PRIMARY KEY,
+    upload_id  INTEGER                  NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+    variant_id INTEGER                  NOT NULL REFERENCES uploads (id) ON DELETE CASCADE,
+    width      INTEGER                  NOT NULL,
+    height     INTEGER                  NOT NULL,
+    format     TEXT                     NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_upload_variants_upload_id ON upload_variants (upload_id);
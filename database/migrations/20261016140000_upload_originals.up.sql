@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS upload_originals
+(
+    upload_id  INTEGER PRIMARY KEY REFERENCES uploads (id) ON DELETE CASCADE,
+    bucket     TEXT                     NOT NULL,
+    path       TEXT                     NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_uploads_scan_status;
+
+ALTER TABLE uploads
+    DROP COLUMN IF EXISTS scanned_at,
+    DROP COLUMN IF EXISTS scan_started_at,
+    DROP COLUMN IF EXISTS scan_signature,
+    DROP COLUMN IF EXISTS scan_status;
@@ -0,0 +1,8 @@
+-- uploads registered before scanning existed are not scanned retroactively
+ALTER TABLE uploads
+    ADD COLUMN IF NOT EXISTS scan_status     TEXT NOT NULL DEFAULT 'not_scanned',
+    ADD COLUMN IF NOT EXISTS scan_signature  TEXT,
+    ADD COLUMN IF NOT EXISTS scan_started_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS scanned_at      TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_uploads_scan_status ON uploads (scan_status) WHERE scan_status IN ('pending', 'scanning', 'infected');
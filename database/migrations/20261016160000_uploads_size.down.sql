@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_uploads_uploaded_by_created_at;
+
+ALTER TABLE uploads
+    DROP COLUMN IF EXISTS size;
@@ -0,0 +1,4 @@
+ALTER TABLE uploads
+    ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_uploads_uploaded_by_created_at ON uploads (uploaded_by, created_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_upload_variants_variant_id;
+DROP INDEX IF EXISTS idx_svg_to_png_png_id;
+DROP INDEX IF EXISTS idx_thumbnail_thumbnail_id;
+DROP INDEX IF EXISTS idx_uploads_created_at;
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS idx_uploads_created_at ON uploads (created_at);
+CREATE INDEX IF NOT EXISTS idx_thumbnail_thumbnail_id ON thumbnail (thumbnail_id);
+CREATE INDEX IF NOT EXISTS idx_svg_to_png_png_id ON svg_to_png (png_id);
+CREATE INDEX IF NOT EXISTS idx_upload_variants_variant_id ON upload_variants (variant_id);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS upload_audio
+(
+    upload_id   INTEGER PRIMARY KEY REFERENCES uploads (id) ON DELETE CASCADE,
+    duration_ms BIGINT                   NOT NULL,
+    waveform    SMALLINT[]               NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS upload_documents
+(
+    upload_id  INTEGER PRIMARY KEY REFERENCES uploads (id) ON DELETE CASCADE,
+    page_count INTEGER                  NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS account_deletions
+(
+    id              SERIAL PRIMARY KEY,
+    user_id         INTEGER                  NOT NULL,
+    auth_id         TEXT                     NOT NULL,
+    requested_by    INTEGER                  NOT NULL,
+    status          TEXT                     NOT NULL,
+    completed_steps TEXT[]                   NOT NULL DEFAULT '{}',
+    attempts        INTEGER                  NOT NULL DEFAULT 0,
+    last_error      TEXT,
+    scheduled_for   TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    completed_at    TIMESTAMP WITH TIME ZONE
+);
+
+-- a user has at most one deletion in progress
+CREATE UNIQUE INDEX IF NOT EXISTS idx_account_deletions_active_user_id ON account_deletions (user_id)
+    WHERE status IN ('scheduled', 'running');
+
+CREATE INDEX IF NOT EXISTS idx_account_deletions_status_scheduled_for ON account_deletions (status, scheduled_for);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS data_exports
+(
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER                  NOT NULL,
+    status       TEXT                     NOT NULL,
+    path         TEXT,
+    attempts     INTEGER                  NOT NULL DEFAULT 0,
+    last_error   TEXT,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at   TIMESTAMP WITH TIME ZONE
+);
+
+-- a user has at most one export in progress
+CREATE UNIQUE INDEX IF NOT EXISTS idx_data_exports_active_user_id ON data_exports (user_id)
+    WHERE status IN ('pending', 'running');
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_status ON data_exports (status);
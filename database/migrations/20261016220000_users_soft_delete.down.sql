@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_users_soft_deleted_at;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS soft_deleted_by,
+    DROP COLUMN IF EXISTS soft_deleted_at;
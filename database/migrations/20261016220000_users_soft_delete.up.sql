@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS soft_deleted_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS soft_deleted_by INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_users_soft_deleted_at ON users (soft_deleted_at)
+    WHERE soft_deleted_at IS NOT NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS session_activity
+(
+    session_token    TEXT PRIMARY KEY,
+    user_id          INTEGER NOT NULL,
+    last_ping_at     TIMESTAMP WITH TIME ZONE,
+    last_location    JSONB,
+    last_location_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_activity_user_id ON session_activity (user_id);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS session_token_families
+(
+    id            SERIAL PRIMARY KEY,
+    user_id       INTEGER                  NOT NULL,
+    auth_id       TEXT                     NOT NULL,
+    session_token TEXT                     NOT NULL,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    revoked_at    TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_token_families_session_token ON session_token_families (session_token);
+
+CREATE TABLE IF NOT EXISTS session_refresh_tokens
+(
+    id         SERIAL PRIMARY KEY,
+    family_id  INTEGER                  NOT NULL REFERENCES session_token_families (id) ON DELETE CASCADE,
+    token_hash TEXT                     NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at    TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_refresh_tokens_family_id ON session_refresh_tokens (family_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS auth_api_usage
+(
+    endpoint     TEXT                     NOT NULL,
+    version      INTEGER                  NOT NULL,
+    route        TEXT                     NOT NULL,
+    legacy       BOOLEAN                  NOT NULL,
+    day          DATE                     NOT NULL,
+    requests     BIGINT                   NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (endpoint, version, route, day)
+);
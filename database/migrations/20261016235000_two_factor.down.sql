@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS two_factor_challenges;
+DROP TABLE IF EXISTS session_second_factors;
+DROP TABLE IF EXISTS user_recovery_codes;
+DROP TABLE IF EXISTS user_totp;
@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS user_totp
+(
+    user_id        INTEGER PRIMARY KEY,
+    secret         TEXT                     NOT NULL,
+    last_used_step BIGINT                   NOT NULL DEFAULT 0,
+    enabled_at     TIMESTAMP WITH TIME ZONE,
+    created_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes
+(
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER                  NOT NULL,
+    code_hash  TEXT                     NOT NULL,
+    used_at    TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_user_id ON user_recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS session_second_factors
+(
+    session_token TEXT PRIMARY KEY,
+    user_id       INTEGER                  NOT NULL,
+    verified_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_second_factors_user_id ON session_second_factors (user_id);
+
+CREATE TABLE IF NOT EXISTS two_factor_challenges
+(
+    id            SERIAL PRIMARY KEY,
+    user_id       INTEGER                  NOT NULL,
+    session_token TEXT                     NOT NULL,
+    token_hash    TEXT                     NOT NULL UNIQUE,
+    attempts      INTEGER                  NOT NULL DEFAULT 0,
+    expires_at    TIMESTAMP WITH TIME ZONE NOT NULL,
+    completed_at  TIMESTAMP WITH TIME ZONE,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
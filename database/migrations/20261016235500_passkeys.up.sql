@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS webauthn_user_handles
+(
+    user_id INTEGER PRIMARY KEY,
+    handle  BYTEA NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS user_passkeys
+(
+    id            SERIAL PRIMARY KEY,
+    user_id       INTEGER                  NOT NULL,
+    credential_id BYTEA                    NOT NULL UNIQUE,
+    public_key    BYTEA                    NOT NULL,
+    algorithm     INTEGER                  NOT NULL,
+    sign_count    BIGINT                   NOT NULL DEFAULT 0,
+    aaguid        BYTEA,
+    transports    TEXT[]                   NOT NULL DEFAULT '{}',
+    name          TEXT                     NOT NULL,
+    created_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_used_at  TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_passkeys_user_id ON user_passkeys (user_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_challenges
+(
+    id         SERIAL PRIMARY KEY,
+    challenge  TEXT                     NOT NULL UNIQUE,
+    purpose    TEXT                     NOT NULL,
+    user_id    INTEGER,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at    TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
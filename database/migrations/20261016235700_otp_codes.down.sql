@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS phone_verified_at;
+
+DROP TABLE IF EXISTS otp_codes;
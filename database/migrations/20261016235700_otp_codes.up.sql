@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS otp_codes
+(
+    id               SERIAL PRIMARY KEY,
+    reason           TEXT                     NOT NULL,
+    destination      TEXT                     NOT NULL,
+    channel          TEXT                     NOT NULL,
+    user_id          INTEGER,
+    code_hash        TEXT                     NOT NULL,
+    attempts         INTEGER                  NOT NULL DEFAULT 0,
+    expires_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+    consumed_at      TIMESTAMP WITH TIME ZONE,
+    locked_until     TIMESTAMP WITH TIME ZONE,
+    grant_hash       TEXT UNIQUE,
+    grant_expires_at TIMESTAMP WITH TIME ZONE,
+    grant_used_at    TIMESTAMP WITH TIME ZONE,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_otp_codes_reason_destination ON otp_codes (reason, destination, created_at DESC);
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS phone_verified_at TIMESTAMP WITH TIME ZONE;
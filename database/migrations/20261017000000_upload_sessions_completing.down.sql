@@ -0,0 +1,2 @@
+ALTER TABLE upload_sessions
+    DROP COLUMN IF EXISTS completing_at;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_uploads_content_hash;
+CREATE INDEX IF NOT EXISTS idx_uploads_content_hash ON uploads (content_hash, binary_type) WHERE content_hash IS NOT NULL;
+
+ALTER TABLE uploads
+    DROP COLUMN IF EXISTS reused_at;
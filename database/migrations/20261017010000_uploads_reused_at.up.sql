@@ -0,0 +1,5 @@
+ALTER TABLE uploads
+    ADD COLUMN IF NOT EXISTS reused_at TIMESTAMP WITH TIME ZONE;
+
+DROP INDEX IF EXISTS idx_uploads_content_hash;
+CREATE INDEX IF NOT EXISTS idx_uploads_content_hash ON uploads (uploaded_by, content_hash, binary_type) WHERE content_hash IS NOT NULL;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS admin_notifications
+(
+    id          SERIAL PRIMARY KEY,
+    type        TEXT                     NOT NULL,
+    upload_id   INTEGER REFERENCES uploads (id) ON DELETE CASCADE,
+    message     TEXT                     NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    read_at     TIMESTAMP WITH TIME ZONE,
+    resolved_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_notifications_unread ON admin_notifications (created_at) WHERE read_at IS NULL;
@@ -0,0 +1,18 @@
+DROP INDEX IF EXISTS idx_account_deletions_active_user_id_by_admin;
+
+-- the older of two active deletions of a user is dropped so the single deletion index applies again
+UPDATE account_deletions d
+SET status     = 'cancelled',
+    updated_at = now()
+WHERE status IN ('scheduled', 'running')
+  AND EXISTS (SELECT 1
+              FROM account_deletions other
+              WHERE other.user_id = d.user_id
+                AND other.id > d.id
+                AND other.status IN ('scheduled', 'running'));
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_account_deletions_active_user_id ON account_deletions (user_id)
+    WHERE status IN ('scheduled', 'running');
+
+ALTER TABLE account_deletions
+    DROP COLUMN IF EXISTS by_admin;
@@ -0,0 +1,13 @@
+-- admin deletions get their own row next to the one the user scheduled, so cancelling the latter
+-- never cancels the former
+ALTER TABLE account_deletions
+    ADD COLUMN IF NOT EXISTS by_admin BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE account_deletions
+SET by_admin = true
+WHERE requested_by <> user_id;
+
+DROP INDEX IF EXISTS idx_account_deletions_active_user_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_account_deletions_active_user_id_by_admin ON account_deletions (user_id, by_admin)
+    WHERE status IN ('scheduled', 'running');
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS sessions_reject_soft_deleted_users ON sessions;
+
+DROP FUNCTION IF EXISTS reject_soft_deleted_user_sessions();
@@ -0,0 +1,18 @@
+-- every sign in, by password, Firebase or passkey, starts a session, soft deleted users cannot
+CREATE OR REPLACE FUNCTION reject_soft_deleted_user_sessions() RETURNS TRIGGER AS
+$$
+BEGIN
+    IF EXISTS (SELECT 1 FROM users WHERE id = NEW.user_id AND soft_deleted_at IS NOT NULL) THEN
+        RAISE EXCEPTION 'user % is soft deleted', NEW.user_id USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS sessions_reject_soft_deleted_users ON sessions;
+
+CREATE TRIGGER sessions_reject_soft_deleted_users
+    BEFORE INSERT
+    ON sessions
+    FOR EACH ROW
+EXECUTE FUNCTION reject_soft_deleted_user_sessions();
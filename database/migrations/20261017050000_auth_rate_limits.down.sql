@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS auth_lockouts;
+DROP TABLE IF EXISTS auth_attempts;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS auth_attempts
+(
+    id         SERIAL PRIMARY KEY,
+    scope      TEXT                     NOT NULL,
+    subject    TEXT                     NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_attempts_scope_subject ON auth_attempts (scope, subject, created_at);
+
+CREATE TABLE IF NOT EXISTS auth_lockouts
+(
+    scope        TEXT                     NOT NULL,
+    subject      TEXT                     NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (scope, subject)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_webauthn_challenges_expires_at;
+DROP INDEX IF EXISTS idx_two_factor_challenges_expires_at;
@@ -0,0 +1,3 @@
+ALTER TABLE otp_codes
+    ADD COLUMN IF NOT EXISTS attempts     INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,3 @@
+ALTER TABLE otp_codes
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS locked_until;
@@ -0,0 +1,2 @@
+ALTER TABLE upload_sessions
+    ADD COLUMN IF NOT EXISTS appending_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,6 @@
+-- the users the rest of the app may show, recommendations, groups, chat and search select from it
+-- so soft deleted users disappear until they are restored or purged
+CREATE OR REPLACE VIEW active_users AS
+SELECT *
+FROM users
+WHERE soft_deleted_at IS NULL;
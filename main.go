@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -36,8 +37,13 @@ func main() {
 	// logrus.SetReportCaller(true)
 
 	srv := server.SrvInit()
+	srv.ConfigureLocalStorage()
+	srv.CheckAudioTranscoding()
 	go srv.Start()
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	srv.StartBackgroundJobs(jobsCtx)
+
 	if env.InKubeCluster() {
 		if env.IsDev() {
 			docs.SwaggerInfo.Schemes = []string{"https"}
@@ -52,5 +58,7 @@ func main() {
 	}
 	<-done
 	logrus.Info("Graceful shutdown")
+	stopJobs()
+	srv.FlushAuthUsage()
 	srv.Stop()
 }
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// accountDeletionGraceHoursConfig delays self-service deletions so users can cancel them.
+	// Zero deletes the account right away. Admin deletions use the soft delete retention instead.
+	accountDeletionGraceHoursConfig = "ACCOUNT_DELETION_GRACE_HOURS"
+
+	maxAccountDeletionAttempts = 10
+	accountDeletionBatchSize   = 20
+
+	// a deletion still running after accountDeletionStaleAfter was interrupted and is picked up again.
+	accountDeletionStaleAfter = 15 * time.Minute
+)
+
+type accountDeletionStatus string
+
+const (
+	accountDeletionStatusScheduled accountDeletionStatus = "scheduled"
+	accountDeletionStatusRunning   accountDeletionStatus = "running"
+	accountDeletionStatusCompleted accountDeletionStatus = "completed"
+	accountDeletionStatusCancelled accountDeletionStatus = "cancelled"
+	accountDeletionStatusFailed    accountDeletionStatus = "failed"
+)
+
+// accountDeletion is a persisted account deletion. Its steps run in order, each one is recorded once
+// it succeeds so a retried deletion resumes where the previous attempt stopped.
+type accountDeletion struct {
+	ID             int                   `json:"id" db:"id"`
+	UserID         int                   `json:"userId" db:"user_id"`
+	AuthID         string                `json:"-" db:"auth_id"`
+	RequestedBy    int                   `json:"requestedBy" db:"requested_by"`
+	ByAdmin        bool                  `json:"byAdmin" db:"by_admin"`
+	Status         accountDeletionStatus `json:"status" db:"status"`
+	CompletedSteps pq.StringArray        `json:"completedSteps" db:"completed_steps"`
+	Attempts       int                   `json:"attempts" db:"attempts"`
+	LastError      sql.NullString        `json:"-" db:"last_error"`
+	ScheduledFor   time.Time             `json:"scheduledFor" db:"scheduled_for"`
+	CreatedAt      time.Time             `json:"createdAt" db:"created_at"`
+	CompletedAt    *time.Time            `json:"completedAt" db:"completed_at"`
+}
+
+const accountDeletionColumns = `id, user_id, auth_id, requested_by, by_admin, status, completed_steps, attempts,
+			       last_error, scheduled_for, created_at, completed_at`
+
+type accountDeletionStep struct {
+	name string
+	run  func(ctx context.Context, deletion accountDeletion) error
+}
+
+// accountDeletionSteps must each be safe to run again, a step is retried when recording it failed.
+func (srv *Server) accountDeletionSteps() []accountDeletionStep {
+	return []accountDeletionStep{
+		{name: "delete_user", run: func(ctx context.Context, deletion accountDeletion) error {
+			return srv.DBHelper.DeleteUser(deletion.UserID)
+		}},
+		{name: "delete_auth_user", run: func(ctx context.Context, deletion accountDeletion) error {
+			err := srv.AuthProvider.DeleteAuthUser(ctx, deletion.AuthID)
+			if auth.IsUserNotFound(err) {
+				return nil
+			}
+			return err
+		}},
+		{name: "assign_chat_group_admins", run: func(ctx context.Context, deletion accountDeletion) error {
+			return srv.DBHelper.CreateNewChatGroupAdmin(deletion.UserID)
+		}},
+		{name: "delete_groups", run: func(ctx context.Context, deletion accountDeletion) error {
+			return srv.DBHelper.DeleteGroupsForUser(deletion.UserID)
+		}},
+		{name: "end_sessions", run: func(ctx context.Context, deletion accountDeletion) error {
+			return srv.DBHelper.EndSessionOfUserByAdmin(deletion.UserID, deletion.AuthID)
+		}},
+	}
+}
+
+func (srv *Server) accountDeletionGrace() time.Duration {
+	return time.Duration(srv.DynamicConfig.GetInt(accountDeletionGraceHoursConfig)) * time.Hour
+}
+
+// requestAccountDeletion persists a deletion of the user that starts after grace, and runs it
+// right away when there is no grace period.
+func (srv *Server) requestAccountDeletion(userID int, authID string, requestedBy int, grace time.Duration) (accountDeletion, error) {
+	deletion, err := scheduleAccountDeletion(srv.PSQL.DB(), userID, authID, requestedBy, grace)
+	if err != nil {
+		return deletion, err
+	}
+
+	if grace == 0 {
+		go func() {
+			if err := srv.processAccountDeletions(context.Background()); err != nil {
+				logrus.Errorf("requestAccountDeletion: unable to process deletion %d: %v", deletion.ID, err)
+			}
+		}()
+	}
+	return deletion, nil
+}
+
+// scheduleAccountDeletion inserts a deletion of the user that starts after grace. Deletions requested
+// by an admin are kept apart from the one the user requested, so the user can only cancel their own.
+// Requesting a deletion while one of the same kind is in progress returns that one instead.
+func scheduleAccountDeletion(db sqlGetter, userID int, authID string, requestedBy int, grace time.Duration) (accountDeletion, error) {
+	SQL := `INSERT INTO account_deletions (user_id, auth_id, requested_by, by_admin, status, scheduled_for)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (user_id, by_admin) WHERE status IN ('scheduled', 'running') DO UPDATE
+			    SET scheduled_for = least(account_deletions.scheduled_for, excluded.scheduled_for)
+			RETURNING ` + accountDeletionColumns
+
+	var deletion accountDeletion
+	err := db.Get(&deletion, SQL, userID, authID, requestedBy, requestedBy != userID, accountDeletionStatusScheduled, time.Now().Add(grace))
+	return deletion, err
+}
+
+func (srv *Server) getLatestAccountDeletion(userID int) (accountDeletion, error) {
+	SQL := `SELECT ` + accountDeletionColumns + `
+			FROM account_deletions
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT 1`
+
+	var deletion accountDeletion
+	err := srv.PSQL.DB().Get(&deletion, SQL, userID)
+	return deletion, err
+}
+
+// processAccountDeletions runs every due deletion. Rows are claimed with SKIP LOCKED so replicas
+// never run the same deletion twice, and a user with a deletion running gets no second one started.
+func (srv *Server) processAccountDeletions(ctx context.Context) error {
+	SQL := `UPDATE account_deletions
+			SET status     = $1,
+			    attempts   = attempts + 1,
+			    updated_at = now()
+			WHERE id IN (SELECT d.id
+			             FROM account_deletions d
+			             WHERE ((d.status = $2 AND d.scheduled_for <= now())
+			                 OR (d.status = $1 AND d.updated_at < $3))
+			               AND NOT EXISTS (SELECT 1
+			                               FROM account_deletions other
+			                               WHERE other.user_id = d.user_id
+			                                 AND other.id <> d.id
+			                                 AND other.status = $1
+			                                 AND other.updated_at >= $3)
+			             ORDER BY d.scheduled_for
+			             LIMIT $4
+			             FOR UPDATE SKIP LOCKED)
+			RETURNING ` + accountDeletionColumns
+
+	deletions := make([]accountDeletion, 0)
+	err := srv.PSQL.DB().Select(&deletions, SQL, accountDeletionStatusRunning, accountDeletionStatusScheduled,
+		time.Now().Add(-accountDeletionStaleAfter), accountDeletionBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, deletion := range deletions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		srv.runAccountDeletion(ctx, deletion)
+	}
+	return nil
+}
+
+func (srv *Server) runAccountDeletion(ctx context.Context, deletion accountDeletion) {
+	completed := make(map[string]bool, len(deletion.CompletedSteps))
+	for _, step := range deletion.CompletedSteps {
+		completed[step] = true
+	}
+
+	for _, step := range srv.accountDeletionSteps() {
+		if completed[step.name] {
+			continue
+		}
+
+		if err := step.run(ctx, deletion); err != nil {
+			srv.failAccountDeletion(deletion, fmt.Errorf("%s: %w", step.name, err))
+			return
+		}
+
+		SQL := `UPDATE account_deletions
+				SET completed_steps = array_append(completed_steps, $2),
+				    updated_at      = now()
+				WHERE id = $1`
+
+		if _, err := srv.PSQL.DB().Exec(SQL, deletion.ID, step.name); err != nil {
+			srv.failAccountDeletion(deletion, fmt.Errorf("%s: unable to record step: %w", step.name, err))
+			return
+		}
+	}
+
+	SQL := `UPDATE account_deletions
+			SET status       = $2,
+			    last_error   = NULL,
+			    completed_at = now(),
+			    updated_at   = now()
+			WHERE id = $1`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, deletion.ID, accountDeletionStatusCompleted); err != nil {
+		logrus.Errorf("runAccountDeletion: unable to complete deletion %d: %v", deletion.ID, err)
+		return
+	}
+
+	// the other deletion of the user, admin or self-service, has nothing left to delete
+	SQL = `UPDATE account_deletions
+		   SET status       = $3,
+		       completed_at = now(),
+		       updated_at   = now()
+		   WHERE user_id = $1
+		     AND id <> $2
+		     AND status = $4`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, deletion.UserID, deletion.ID, accountDeletionStatusCompleted, accountDeletionStatusScheduled); err != nil {
+		logrus.Errorf("runAccountDeletion: unable to complete the other deletions of user %d: %v", deletion.UserID, err)
+	}
+	logrus.Infof("runAccountDeletion: deleted user %d", deletion.UserID)
+}
+
+// failAccountDeletion schedules a retry with a backoff, or gives up after maxAccountDeletionAttempts.
+func (srv *Server) failAccountDeletion(deletion accountDeletion, cause error) {
+	logrus.Errorf("runAccountDeletion: deletion %d of user %d failed: %v", deletion.ID, deletion.UserID, cause)
+
+	status := accountDeletionStatusScheduled
+	if deletion.Attempts >= maxAccountDeletionAttempts {
+		status = accountDeletionStatusFailed
+	}
+
+	SQL := `UPDATE account_deletions
+			SET status        = $2,
+			    last_error    = $3,
+			    scheduled_for = $4,
+			    updated_at    = now()
+			WHERE id = $1`
+
+	retryAt := time.Now().Add(time.Duration(deletion.Attempts*deletion.Attempts) * time.Minute)
+	if _, err := srv.PSQL.DB().Exec(SQL, deletion.ID, status, cause.Error(), retryAt); err != nil {
+		logrus.Errorf("failAccountDeletion: unable to update deletion %d: %v", deletion.ID, err)
+	}
+}
+
+/*
+  - getAccountDeletion
+  - @Description This method is used to get the status of the
+    account deletion requested by the user.
+*/
+func (srv *Server) getAccountDeletion(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	deletion, err := srv.getLatestAccountDeletion(uc.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusNotFound, "no account deletion requested")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get account deletion")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, deletion)
+}
+
+/*
+  - cancelAccountDeletion
+  - @Description This method is used to cancel an account deletion
+    while it is still in its grace period. Deletions requested by an
+    admin can only be cancelled by restoring the account.
+*/
+func (srv *Server) cancelAccountDeletion(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	SQL := `UPDATE account_deletions
+			SET status     = $2,
+			    updated_at = now()
+			WHERE user_id = $1
+			  AND NOT by_admin
+			  AND status = $3
+			  AND completed_steps = '{}'
+			RETURNING ` + accountDeletionColumns
+
+	var deletion accountDeletion
+	err := srv.PSQL.DB().Get(&deletion, SQL, uc.ID, accountDeletionStatusCancelled, accountDeletionStatusScheduled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusConflict, "account deletion can no longer be cancelled")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to cancel account deletion")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, deletion)
+}
+
+/*
+  - getAccountDeletionByAdmin
+  - @Description This method is used by admins to get the status,
+    completed steps and last error of the deletion of a user.
+*/
+func (srv *Server) getAccountDeletionByAdmin(resp http.ResponseWriter, req *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(req, "userID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+
+	deletion, err := srv.getLatestAccountDeletion(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusNotFound, "no account deletion requested")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get account deletion")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"deletion":  deletion,
+		"lastError": deletion.LastError.String,
+	})
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// accountSoftDeleteRetentionDaysConfig is how long a user deleted by an admin can be restored
+	// before the account is purged.
+	accountSoftDeleteRetentionDaysConfig = "ACCOUNT_SOFT_DELETE_RETENTION_DAYS"
+
+	defaultAccountSoftDeleteRetention = 30 * 24 * time.Hour
+)
+
+func (srv *Server) accountSoftDeleteRetention() time.Duration {
+	if days := srv.DynamicConfig.GetInt(accountSoftDeleteRetentionDaysConfig); days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return defaultAccountSoftDeleteRetention
+}
+
+// authUserDisabler is implemented by auth providers that can stop a user from signing in without
+// deleting the account.
+type authUserDisabler interface {
+	SetAuthUserDisabled(ctx context.Context, authID string, disabled bool) error
+}
+
+// softDeleteUser marks the user deleted and schedules the purge of the account after the retention
+// window. Connections and group memberships are kept so restoring the account brings them back. The
+// sessions and refresh tokens of the user end in the same transaction and their cached user contexts
+// are dropped, so the user is signed out everywhere at once. The user cannot start a new session and
+// is refused by the auth provider when it supports disabling users.
+func (srv *Server) softDeleteUser(userID int, authID string, deletedBy int) (accountDeletion, error) {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return accountDeletion{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("softDeleteUser: unable to rollback %v", err)
+		}
+	}()
+
+	SQL := `UPDATE users
+			SET soft_deleted_at = coalesce(soft_deleted_at, now()),
+			    soft_deleted_by = $2
+			WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, userID, deletedBy); err != nil {
+		return accountDeletion{}, err
+	}
+
+	deletion, err := scheduleAccountDeletion(tx, userID, authID, deletedBy, srv.accountSoftDeleteRetention())
+	if err != nil {
+		return accountDeletion{}, err
+	}
+
+	// the sessions are not needed to restore the account
+	sessionTokens, err := endUserSessions(tx, userID)
+	if err != nil {
+		return accountDeletion{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return accountDeletion{}, err
+	}
+
+	for _, token := range sessionTokens {
+		srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, authID, token))
+	}
+
+	srv.setAuthUserDisabled(authID, true)
+	return deletion, nil
+}
+
+func (srv *Server) setAuthUserDisabled(authID string, disabled bool) {
+	disabler, ok := srv.AuthProvider.(authUserDisabler)
+	if !ok {
+		logrus.Warnf("setAuthUserDisabled: auth provider cannot disable users")
+		return
+	}
+
+	if err := disabler.SetAuthUserDisabled(context.Background(), authID, disabled); err != nil {
+		logrus.Errorf("setAuthUserDisabled: unable to set disabled=%t for auth user %s: %v", disabled, authID, err)
+	}
+}
+
+// endUserSessions ends every session of the user, revokes their refresh tokens and returns the
+// tokens of the sessions it ended.
+func endUserSessions(tx *sqlx.Tx, userID int) ([]string, error) {
+	SQL := `UPDATE sessions
+			SET end_time = now()
+			WHERE user_id = $1
+			  AND end_time IS NULL
+			RETURNING token`
+
+	tokens := make([]string, 0)
+	if err := tx.Select(&tokens, SQL, userID); err != nil {
+		return nil, err
+	}
+
+	for _, SQL := range []string{
+		`UPDATE session_refresh_tokens
+			SET revoked_at = now()
+			WHERE family_id IN (SELECT id FROM session_token_families WHERE user_id = $1)
+			  AND revoked_at IS NULL`,
+		`UPDATE session_token_families
+			SET revoked_at = now()
+			WHERE user_id = $1
+			  AND revoked_at IS NULL`,
+		`DELETE FROM session_activity WHERE user_id = $1`,
+	} {
+		if _, err := tx.Exec(SQL, userID); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+/*
+  - restoreUserByAdmin
+  - @Description This method is used by admins to restore a soft deleted
+    user before its retention window is over. Connections and group
+    memberships are left as they were.
+*/
+func (srv *Server) restoreUserByAdmin(resp http.ResponseWriter, req *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(req, "userID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to restore user")
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("restoreUserByAdmin: unable to rollback %v", err)
+		}
+	}()
+
+	// once the purge has started the account can no longer be restored, a deletion the user
+	// scheduled themselves is left as it is
+	SQL := `UPDATE account_deletions
+			SET status     = $2,
+			    updated_at = now()
+			WHERE user_id = $1
+			  AND by_admin
+			  AND status = $3
+			  AND completed_steps = '{}'
+			RETURNING ` + accountDeletionColumns
+
+	var deletion accountDeletion
+	err = tx.Get(&deletion, SQL, userID, accountDeletionStatusCancelled, accountDeletionStatusScheduled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusConflict, "user can no longer be restored")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to restore user")
+		return
+	}
+
+	SQL = `UPDATE users
+			SET soft_deleted_at = NULL,
+			    soft_deleted_by = NULL
+			WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, userID); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to restore user")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to restore user")
+		return
+	}
+
+	srv.setAuthUserDisabled(deletion.AuthID, false)
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message":  "success",
+		"deletion": deletion,
+	})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+)
+
+type adminNotificationType string
+
+const (
+	adminNotificationUploadQuarantined adminNotificationType = "upload_quarantined"
+)
+
+type adminNotification struct {
+	ID         int                   `json:"id" db:"id"`
+	Type       adminNotificationType `json:"type" db:"type"`
+	UploadID   *int                  `json:"uploadId" db:"upload_id"`
+	Message    string                `json:"message" db:"message"`
+	CreatedAt  time.Time             `json:"createdAt" db:"created_at"`
+	ReadAt     *time.Time            `json:"readAt" db:"read_at"`
+	ResolvedAt *time.Time            `json:"resolvedAt" db:"resolved_at"`
+}
+
+func insertAdminNotification(db sqlExecer, notificationType adminNotificationType, uploadID *int, message string) error {
+	SQL := `INSERT INTO admin_notifications (type, upload_id, message)
+			VALUES ($1, $2, $3)`
+
+	_, err := db.Exec(SQL, notificationType, uploadID, message)
+	return err
+}
+
+// resolveUploadNotifications marks the notifications about an upload as handled.
+func resolveUploadNotifications(db sqlExecer, uploadID int) error {
+	SQL := `UPDATE admin_notifications
+			SET resolved_at = now()
+			WHERE upload_id = $1
+			  AND resolved_at IS NULL`
+
+	_, err := db.Exec(SQL, uploadID)
+	return err
+}
+
+/*
+  - getAdminNotifications
+  - @Description This method is used by admins to list the dashboard
+    notifications, unread ones first, with the unread count.
+*/
+func (srv *Server) getAdminNotifications(resp http.ResponseWriter, req *http.Request) {
+	limit, page, err := utils.GetLimitPageFromRequest(req, 50)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to process request")
+		return
+	}
+
+	SQL := `SELECT id, type, upload_id, message, created_at, read_at, resolved_at,
+			       count(*) OVER ()                                  AS total_count,
+			       count(*) FILTER (WHERE read_at IS NULL) OVER () AS unread_count
+			FROM admin_notifications
+			ORDER BY read_at IS NULL DESC, created_at DESC
+			LIMIT $1 OFFSET $2`
+
+	rows := make([]struct {
+		adminNotification
+		TotalCount  int `db:"total_count"`
+		UnreadCount int `db:"unread_count"`
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&rows, SQL, limit, limit*page); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get notifications")
+		return
+	}
+
+	notifications := make([]adminNotification, 0, len(rows))
+	totalCount, unreadCount := 0, 0
+	for _, row := range rows {
+		notifications = append(notifications, row.adminNotification)
+		totalCount, unreadCount = row.TotalCount, row.UnreadCount
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"notifications": notifications,
+		"totalCount":    totalCount,
+		"unreadCount":   unreadCount,
+	})
+}
+
+/*
+  - readAdminNotification
+  - @Description This method is used by admins to mark a dashboard
+    notification as read.
+*/
+func (srv *Server) readAdminNotification(resp http.ResponseWriter, req *http.Request) {
+	notificationID, err := strconv.Atoi(chi.URLParam(req, "notificationID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing notificationId")
+		return
+	}
+
+	SQL := `UPDATE admin_notifications
+			SET read_at = coalesce(read_at, now())
+			WHERE id = $1`
+
+	result, err := srv.PSQL.DB().Exec(SQL, notificationID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to read notification")
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("notification not found"), http.StatusNotFound, "notification not found")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/RemoteState/connect-up/models"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// audioWaveformSamples is the number of bars in the waveform returned to clients.
+	audioWaveformSamples = 64
+
+	// audio is decoded at audioAnalysisRate for the waveform, one peak is kept per audioPeakWindow samples.
+	audioAnalysisRate = 8000
+	audioPeakWindow   = audioAnalysisRate / 10
+
+	transcodedAudioExtension = ".m4a"
+	transcodedAudioMIMEType  = "audio/mp4"
+
+	// audioTranscodingRequiredConfig rejects audio uploads when ffmpeg is missing instead of storing them as is.
+	audioTranscodingRequiredConfig = "AUDIO_TRANSCODING_REQUIRED"
+)
+
+// audioMetadata describes a transcoded audio upload. Waveform holds audioWaveformSamples peaks
+// between 0 and 100, relative to the loudest one.
+type audioMetadata struct {
+	DurationMs int64 `json:"durationMs"`
+	Waveform   []int `json:"waveform"`
+}
+
+// CheckAudioTranscoding reports at startup when ffmpeg is missing. Audio uploads are then stored
+// without transcoding or a waveform, unless AUDIO_TRANSCODING_REQUIRED is set, which stops the server.
+func (srv *Server) CheckAudioTranscoding() {
+	if _, err := exec.LookPath("ffmpeg"); err == nil {
+		return
+	}
+
+	if srv.DynamicConfig.GetBool(audioTranscodingRequiredConfig) {
+		logrus.Fatalf("CheckAudioTranscoding: ffmpeg is not installed and %s is set", audioTranscodingRequiredConfig)
+	}
+	logrus.Warn("CheckAudioTranscoding: ffmpeg is not installed, audio uploads are stored without transcoding or waveform")
+}
+
+// transcodeAudio converts every audio upload to mono AAC so voice notes recorded on iOS and Android
+// play everywhere, and measures its duration and waveform. When ffmpeg is not installed the upload is
+// stored as is, or rejected if AUDIO_TRANSCODING_REQUIRED is set.
+func transcodeAudio(uctx *uploadContext) error {
+	if uctx.binaryType != models.UploadBinaryTypeAudio {
+		return nil
+	}
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		if uctx.srv.DynamicConfig.GetBool(audioTranscodingRequiredConfig) {
+			logrus.Errorf("transcodeAudio: ffmpeg is not installed, rejecting %s", uctx.header.Filename)
+			return rejectUpload(http.StatusServiceUnavailable, "audio uploads are unavailable")
+		}
+		logrus.Warnf("transcodeAudio: ffmpeg is not installed, storing %s as is", uctx.header.Filename)
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "audio-*")
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("transcodeAudio: unable to remove temp dir %v", err)
+		}
+	})
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	input := filepath.Join(dir, "input"+filepath.Ext(uctx.header.Filename))
+	output := filepath.Join(dir, "output"+transcodedAudioExtension)
+
+	if err := writeTempFile(input, uctx.file); err != nil {
+		return err
+	}
+
+	ctx := uctx.req.Context()
+
+	// nolint:gosec // arguments are paths created above
+	cmd := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-y", "-i", input,
+		"-vn", "-ac", "1", "-ar", "44100", "-c:a", "aac", "-b:a", "64k", "-movflags", "+faststart", output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logrus.Errorf("transcodeAudio: ffmpeg: %v: %s", err, stderr.String())
+		return rejectUpload(http.StatusBadRequest, "unable to read audio")
+	}
+
+	metadata, err := analyzeAudio(ctx, ffmpeg, output)
+	if err != nil {
+		return err
+	}
+
+	transcoded, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := transcoded.Close(); err != nil {
+			logrus.Errorf("transcodeAudio: unable to close transcoded file %v", err)
+		}
+	})
+
+	uctx.file = transcoded
+	uctx.filePath = strings.TrimSuffix(uctx.filePath, filepath.Ext(uctx.filePath)) + transcodedAudioExtension
+	uctx.mimeType = transcodedAudioMIMEType
+	uctx.audio = &metadata
+	return nil
+}
+
+// analyzeAudio decodes the file to mono 16 bit PCM and reduces it to its duration and waveform.
+// Peaks are kept per window while decoding so long recordings are never held in memory.
+func analyzeAudio(ctx context.Context, ffmpeg, path string) (audioMetadata, error) {
+	// nolint:gosec // arguments are a path created by transcodeAudio
+	cmd := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-i", path,
+		"-ac", "1", "-ar", fmt.Sprint(audioAnalysisRate), "-f", "s16le", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return audioMetadata{}, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return audioMetadata{}, err
+	}
+
+	var (
+		samples int64
+		peak    int
+		peaks   []int
+	)
+
+	reader := bufio.NewReader(stdout)
+	buf := make([]byte, 2*audioPeakWindow)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		for i := 0; i+1 < n; i += 2 {
+			amplitude := int(int16(binary.LittleEndian.Uint16(buf[i:])))
+			if amplitude < 0 {
+				amplitude = -amplitude
+			}
+			if amplitude > peak {
+				peak = amplitude
+			}
+
+			samples++
+			if samples%audioPeakWindow == 0 {
+				peaks = append(peaks, peak)
+				peak = 0
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			if waitErr := cmd.Wait(); waitErr != nil {
+				logrus.Errorf("analyzeAudio: ffmpeg: %v", waitErr)
+			}
+			return audioMetadata{}, err
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return audioMetadata{}, fmt.Errorf("ffmpeg: %w: %s", err, stderr.String())
+	}
+
+	if samples%audioPeakWindow != 0 {
+		peaks = append(peaks, peak)
+	}
+
+	return audioMetadata{
+		DurationMs: samples * 1000 / audioAnalysisRate,
+		Waveform:   waveform(peaks, audioWaveformSamples),
+	}, nil
+}
+
+// waveform reduces peaks to size bars scaled from 0 to 100, relative to the loudest bar.
+func waveform(peaks []int, size int) []int {
+	bars := make([]int, size)
+	if len(peaks) == 0 {
+		return bars
+	}
+
+	var loudest int
+	for i := range bars {
+		start := i * len(peaks) / size
+		end := (i + 1) * len(peaks) / size
+		if end <= start {
+			end = start + 1
+		}
+
+		for _, peak := range peaks[start:end] {
+			if peak > bars[i] {
+				bars[i] = peak
+			}
+		}
+
+		if bars[i] > loudest {
+			loudest = bars[i]
+		}
+	}
+
+	if loudest == 0 {
+		return bars
+	}
+
+	for i := range bars {
+		bars[i] = bars[i] * 100 / loudest
+	}
+	return bars
+}
+
+// storeAudioMetadata saves the duration and waveform measured by transcodeAudio next to the upload.
+func storeAudioMetadata(uctx *uploadContext) error {
+	if uctx.audio == nil {
+		return nil
+	}
+
+	SQL := `INSERT INTO upload_audio (upload_id, duration_ms, waveform)
+			VALUES ($1, $2, $3)`
+
+	_, err := uctx.tx.Exec(SQL, uctx.upload.FileID, uctx.audio.DurationMs, pq.Array(uctx.audio.Waveform))
+	return err
+}
+
+// getAudioMetadata returns the duration and waveform of every given audio upload keyed by upload id.
+// Handlers returning chat message attachments should add them through this method.
+func (srv *Server) getAudioMetadata(uploadIDs ...int) (map[int]audioMetadata, error) {
+	metadata := make(map[int]audioMetadata, len(uploadIDs))
+	if len(uploadIDs) == 0 {
+		return metadata, nil
+	}
+
+	SQL := `SELECT upload_id, duration_ms, waveform
+			FROM upload_audio
+			WHERE upload_id = ANY($1)`
+
+	rows := make([]struct {
+		UploadID   int           `db:"upload_id"`
+		DurationMs int64         `db:"duration_ms"`
+		Waveform   pq.Int64Array `db:"waveform"`
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&rows, SQL, pq.Array(uploadIDs)); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		bars := make([]int, 0, len(row.Waveform))
+		for _, bar := range row.Waveform {
+			bars = append(bars, int(bar))
+		}
+		metadata[row.UploadID] = audioMetadata{DurationMs: row.DurationMs, Waveform: bars}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+)
+
+// authAttemptRetention is how long attempts are kept, longer than the window of every limit.
+const authAttemptRetention = 24 * time.Hour
+
+// authLimit caps the attempts of one subject, a user id, an ip or an otp destination, within
+// Window. The attempt reaching Max locks the subject out for Lockout and starts a new window.
+type authLimit struct {
+	Scope   string
+	Max     int
+	Window  time.Duration
+	Lockout time.Duration
+}
+
+var (
+	twoFactorChallengeLimit = authLimit{Scope: "2fa_challenge", Max: 10, Window: 15 * time.Minute, Lockout: 15 * time.Minute}
+	twoFactorFailureLimit   = authLimit{Scope: "2fa_failure", Max: 5, Window: 15 * time.Minute, Lockout: 30 * time.Minute}
+
+	passkeyLoginOptionsLimit = authLimit{Scope: "passkey_login_options", Max: 30, Window: time.Minute, Lockout: 5 * time.Minute}
+)
+
+// retryError refuses a request until RetryAt, while its subject is locked out.
+type retryError struct {
+	Message string
+	RetryAt time.Time
+}
+
+func (e retryError) Error() string {
+	return e.Message
+}
+
+type sqlGetExecer interface {
+	sqlGetter
+	sqlExecer
+}
+
+// check refuses the subject while it is locked out.
+func (limit authLimit) check(db sqlGetter, subject string) error {
+	SQL := `SELECT max(locked_until) FROM auth_lockouts WHERE scope = $1 AND subject = $2`
+
+	var lockedUntil sql.NullTime
+	if err := db.Get(&lockedUntil, SQL, limit.Scope, subject); err != nil {
+		return err
+	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return retryError{Message: "too many attempts, try again later", RetryAt: lockedUntil.Time}
+	}
+	return nil
+}
+
+// hit records an attempt of the subject and locks it out once Max attempts fall in the window.
+func (limit authLimit) hit(db sqlGetExecer, subject string) error {
+	SQL := `INSERT INTO auth_attempts (scope, subject) VALUES ($1, $2)`
+	if _, err := db.Exec(SQL, limit.Scope, subject); err != nil {
+		return err
+	}
+
+	SQL = `SELECT count(*)
+		   FROM auth_attempts
+		   WHERE scope = $1
+		     AND subject = $2
+		     AND created_at > $3`
+
+	var attempts int
+	if err := db.Get(&attempts, SQL, limit.Scope, subject, time.Now().Add(-limit.Window)); err != nil {
+		return err
+	}
+	if attempts < limit.Max {
+		return nil
+	}
+
+	SQL = `INSERT INTO auth_lockouts (scope, subject, locked_until)
+		   VALUES ($1, $2, $3)
+		   ON CONFLICT (scope, subject) DO UPDATE SET locked_until = excluded.locked_until`
+
+	if _, err := db.Exec(SQL, limit.Scope, subject, time.Now().Add(limit.Lockout)); err != nil {
+		return err
+	}
+
+	SQL = `DELETE FROM auth_attempts WHERE scope = $1 AND subject = $2`
+	_, err := db.Exec(SQL, limit.Scope, subject)
+	return err
+}
+
+// take counts a request of the subject, refusing it while the subject is locked out.
+func (limit authLimit) take(db sqlGetExecer, subject string) error {
+	if err := limit.check(db, subject); err != nil {
+		return err
+	}
+	return limit.hit(db, subject)
+}
+
+// clientIP is the address of the client. Behind the load balancer it is the last address of
+// X-Forwarded-For, the one the load balancer added, earlier ones are set by the client.
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func respondRetryErr(resp http.ResponseWriter, req *http.Request, err retryError) {
+	resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(err.RetryAt).Seconds()))))
+	connectuperror.RespondClientErr(resp, req, err, http.StatusTooManyRequests, err.Error())
+}
+
+// purgeAuthAttempts deletes attempts older than every window and lockouts that are over.
+func (srv *Server) purgeAuthAttempts(_ context.Context) error {
+	SQL := `DELETE FROM auth_attempts WHERE created_at < $1`
+	if _, err := srv.PSQL.DB().Exec(SQL, time.Now().Add(-authAttemptRetention)); err != nil {
+		return err
+	}
+
+	SQL = `DELETE FROM auth_lockouts WHERE locked_until < now()`
+	_, err := srv.PSQL.DB().Exec(SQL)
+	return err
+}
+
+// purgeAuthChallenges deletes the two factor and passkey challenges that expired, used ones
+// included. Attempts are counted in auth_attempts, not on the challenges.
+func (srv *Server) purgeAuthChallenges(_ context.Context) error {
+	for _, SQL := range []string{
+		`DELETE FROM two_factor_challenges WHERE expires_at < now()`,
+		`DELETE FROM webauthn_challenges WHERE expires_at < now()`,
+	} {
+		if _, err := srv.PSQL.DB().Exec(SQL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// apiVersionHeader selects the version of the /api/auth and otp endpoints, the version served is
+// echoed back in the same header.
+const apiVersionHeader = "X-API-Version"
+
+type authEndpoint string
+
+const (
+	authEndpointLogin    authEndpoint = "login"
+	authEndpointRegister authEndpoint = "register"
+
+	authEndpointSendOTP                authEndpoint = "send_otp"
+	authEndpointVerifyOTP              authEndpoint = "verify_otp"
+	authEndpointChangePasswordUsingOTP authEndpoint = "change_password_using_otp"
+	authEndpointVerifyPhoneOTP         authEndpoint = "verify_phone_otp"
+	authEndpointVerifyEmailOTP         authEndpoint = "verify_email_otp"
+)
+
+// authVersions lists the handler of every supported version of each /api/auth and otp endpoint.
+// Versions keep the numbers of the routes they replace, register was never released as v2. Version
+// 2 of the otp endpoints is served by the otp service, version 1 keeps the previous handlers and
+// their request and response bodies.
+func (srv *Server) authVersions() map[authEndpoint]map[int]http.HandlerFunc {
+	return map[authEndpoint]map[int]http.HandlerFunc{
+		authEndpointLogin: {
+			1: srv.login,
+			2: srv.loginV2,
+			3: srv.loginV3,
+		},
+		authEndpointRegister: {
+			1: srv.withPasswordPolicy(srv.createNewUser),
+			3: srv.withPasswordPolicy(srv.createNewUserV3),
+		},
+		authEndpointSendOTP: {
+			1: srv.sendOTPRequest,
+			2: srv.sendOTPCode,
+		},
+		authEndpointVerifyOTP: {
+			1: srv.verifyOTPForResetPassword(models.OTPReasonTypeResetPassword),
+			2: srv.verifyOTPCodeFor(models.OTPReasonTypeResetPassword),
+		},
+		authEndpointChangePasswordUsingOTP: {
+			1: srv.withPasswordPolicy(srv.changePasswordUsingOTP),
+			2: srv.withPasswordPolicy(srv.resetPasswordUsingOTP),
+		},
+		authEndpointVerifyPhoneOTP: {
+			1: srv.verifyOTP(models.OTPReasonTypeVerifyPhone),
+			2: srv.verifyOTPCodeFor(models.OTPReasonTypeVerifyPhone),
+		},
+		authEndpointVerifyEmailOTP: {
+			1: srv.verifyOTP(models.OTPReasonTypeVerifyEmail),
+			2: srv.verifyOTPCodeFor(models.OTPReasonTypeVerifyEmail),
+		},
+	}
+}
+
+func supportedVersions(versions map[int]http.HandlerFunc) []int {
+	supported := make([]int, 0, len(versions))
+	for version := range versions {
+		supported = append(supported, version)
+	}
+	sort.Ints(supported)
+	return supported
+}
+
+/*
+  - negotiateAuthVersion
+  - @Description This method is used to serve an /api/auth endpoint
+    with the version requested in the X-API-Version header. Requests
+    without a supported version are rejected with the versions the
+    endpoint supports.
+*/
+func (srv *Server) negotiateAuthVersion(endpoint authEndpoint) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		versions := srv.authVersions()[endpoint]
+
+		version, err := strconv.Atoi(req.Header.Get(apiVersionHeader))
+		if err != nil || versions[version] == nil {
+			if err == nil {
+				err = errors.New("unsupported api version")
+			}
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest,
+				"unsupported api version, supported versions are "+formatVersions(supportedVersions(versions)))
+			return
+		}
+
+		srv.serveAuthVersion(resp, req, endpoint, version, false)
+	}
+}
+
+// legacyAuthRoute serves one of the routes that predate /api/auth through the same handlers, so
+// their usage is counted and they can be retired once it drops to zero.
+func (srv *Server) legacyAuthRoute(endpoint authEndpoint, version int) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Deprecation", "true")
+		resp.Header().Set("Link", `</api/auth/`+string(endpoint)+`>; rel="successor-version"`)
+		srv.serveAuthVersion(resp, req, endpoint, version, true)
+	}
+}
+
+// versionedRoute serves the version of the endpoint requested in X-API-Version. Clients that send
+// none get the latest version, older versions are only served when asked for and are answered with
+// a Deprecation header.
+func (srv *Server) versionedRoute(endpoint authEndpoint) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		versions := srv.authVersions()[endpoint]
+		supported := supportedVersions(versions)
+		latest := supported[len(supported)-1]
+
+		if req.Header.Get(apiVersionHeader) == "" {
+			srv.serveAuthVersion(resp, req, endpoint, latest, false)
+			return
+		}
+
+		if version, err := strconv.Atoi(req.Header.Get(apiVersionHeader)); err == nil && versions[version] != nil && version < latest {
+			resp.Header().Set("Deprecation", "true")
+		}
+		srv.negotiateAuthVersion(endpoint)(resp, req)
+	}
+}
+
+func (srv *Server) serveAuthVersion(resp http.ResponseWriter, req *http.Request, endpoint authEndpoint, version int, legacy bool) {
+	authUsage.record(authUsageKey{endpoint: endpoint, version: version, route: req.URL.Path, legacy: legacy}, time.Now())
+
+	resp.Header().Set(apiVersionHeader, strconv.Itoa(version))
+	srv.authVersions()[endpoint][version](resp, req)
+}
+
+func formatVersions(versions []int) string {
+	formatted := make([]string, 0, len(versions))
+	for _, version := range versions {
+		formatted = append(formatted, strconv.Itoa(version))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+type authUsageKey struct {
+	endpoint authEndpoint
+	version  int
+	route    string
+	legacy   bool
+	day      string
+}
+
+type authUsageCount struct {
+	requests   int64
+	lastUsedAt time.Time
+}
+
+// authUsageCounter counts the requests served by each auth route in memory, so logins never wait
+// on a write to a row every other login of the day updates too. flushAuthUsage adds the counts to
+// auth_api_usage every minute and FlushAuthUsage once more when the server shuts down.
+type authUsageCounter struct {
+	mu     sync.Mutex
+	counts map[authUsageKey]authUsageCount
+}
+
+var authUsage = &authUsageCounter{counts: make(map[authUsageKey]authUsageCount)}
+
+func (c *authUsageCounter) record(key authUsageKey, at time.Time) {
+	key.day = at.UTC().Format("2006-01-02")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.counts[key]
+	count.requests++
+	if at.After(count.lastUsedAt) {
+		count.lastUsedAt = at
+	}
+	c.counts[key] = count
+}
+
+// take returns the counts recorded so far and starts over.
+func (c *authUsageCounter) take() map[authUsageKey]authUsageCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := c.counts
+	c.counts = make(map[authUsageKey]authUsageCount)
+	return counts
+}
+
+// restore adds back counts that could not be flushed.
+func (c *authUsageCounter) restore(key authUsageKey, count authUsageCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.counts[key]
+	current.requests += count.requests
+	if count.lastUsedAt.After(current.lastUsedAt) {
+		current.lastUsedAt = count.lastUsedAt
+	}
+	c.counts[key] = current
+}
+
+// flushAuthUsage adds the usage counted since the last flush to the daily usage of each route and
+// version. Counts that cannot be written are kept for the next flush.
+func (srv *Server) flushAuthUsage(ctx context.Context) error {
+	SQL := `INSERT INTO auth_api_usage (endpoint, version, route, legacy, day, requests, last_used_at)
+			VALUES ($1, $2, $3, $4, $5::DATE, $6, $7)
+			ON CONFLICT (endpoint, version, route, day) DO UPDATE
+			    SET requests     = auth_api_usage.requests + excluded.requests,
+			        last_used_at = greatest(auth_api_usage.last_used_at, excluded.last_used_at)`
+
+	var flushErr error
+	for key, count := range authUsage.take() {
+		if flushErr == nil && ctx.Err() != nil {
+			flushErr = ctx.Err()
+		}
+		if flushErr == nil {
+			_, flushErr = srv.PSQL.DB().Exec(SQL, key.endpoint, key.version, key.route, key.legacy, key.day, count.requests, count.lastUsedAt)
+			if flushErr == nil {
+				continue
+			}
+		}
+		authUsage.restore(key, count)
+	}
+	return flushErr
+}
+
+// authUsageFlushTimeout bounds the flush of the auth usage at shutdown.
+const authUsageFlushTimeout = 10 * time.Second
+
+// FlushAuthUsage writes the auth usage counted since the last flush, it is called once during the
+// graceful shutdown so the counts of the last minute are not lost.
+func (srv *Server) FlushAuthUsage() {
+	ctx, cancel := context.WithTimeout(context.Background(), authUsageFlushTimeout)
+	defer cancel()
+
+	if err := srv.flushAuthUsage(ctx); err != nil {
+		logrus.Errorf("FlushAuthUsage: unable to flush auth usage %v", err)
+	}
+}
+
+/*
+  - getAuthAPIUsage
+  - @Description This method is used by admins to get the requests
+    served by each version and route of the login and register
+    endpoints over the last days, 30 by default.
+*/
+func (srv *Server) getAuthAPIUsage(resp http.ResponseWriter, req *http.Request) {
+	days := 30
+	if req.URL.Query().Get("days") != "" {
+		var err error
+		days, err = strconv.Atoi(req.URL.Query().Get("days"))
+		if err != nil || days <= 0 {
+			connectuperror.RespondClientErr(resp, req, errors.New("invalid days"), http.StatusBadRequest, "invalid days")
+			return
+		}
+	}
+
+	SQL := `SELECT endpoint, version, route, legacy, sum(requests) AS requests, max(last_used_at) AS last_used_at
+			FROM auth_api_usage
+			WHERE day > current_date - $1::INTEGER
+			GROUP BY endpoint, version, route, legacy
+			ORDER BY endpoint, version, route`
+
+	usage := make([]struct {
+		Endpoint   authEndpoint `json:"endpoint" db:"endpoint"`
+		Version    int          `json:"version" db:"version"`
+		Route      string       `json:"route" db:"route"`
+		Legacy     bool         `json:"legacy" db:"legacy"`
+		Requests   int64        `json:"requests" db:"requests"`
+		LastUsedAt time.Time    `json:"lastUsedAt" db:"last_used_at"`
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&usage, SQL, days); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get auth api usage")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, usage)
+}
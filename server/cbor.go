@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// cbor.go decodes and encodes the subset of CBOR (RFC 8949) used by WebAuthn attestation objects
+// and COSE keys: integers, byte and text strings, arrays, maps and simple values. Indefinite
+// lengths, tags and floats are refused, authenticators do not use them there.
+
+const maxCBORDepth = 16
+
+var errCBORMalformed = errors.New("malformed cbor")
+
+// decodeCBOR decodes one item and returns the bytes following it. Maps are decoded to
+// map[interface{}]interface{} with int64 or string keys, unsigned and negative integers to int64.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deep", errCBORMalformed)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", errCBORMalformed)
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("%w: unsupported simple value %d", errCBORMalformed, info)
+	}
+
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBORMalformed)
+		}
+		buf := make([]byte, 8)
+		copy(buf[8-size:], data[:size])
+		argument = binary.BigEndian.Uint64(buf)
+		data = data[size:]
+	default:
+		return nil, nil, fmt.Errorf("%w: indefinite lengths are not supported", errCBORMalformed)
+	}
+
+	switch major {
+	case 0, 1:
+		if argument > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBORMalformed)
+		}
+		if major == 1 {
+			return -1 - int64(argument), data, nil
+		}
+		return int64(argument), data, nil
+	case 2, 3:
+		if uint64(len(data)) < argument {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBORMalformed)
+		}
+		value := data[:argument]
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return append([]byte(nil), value...), data[argument:], nil
+	case 4:
+		if uint64(len(data)) < argument {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBORMalformed)
+		}
+		items := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var item interface{}
+			var err error
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if uint64(len(data)) < argument*2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBORMalformed)
+		}
+		items := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key, value interface{}
+			var err error
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errCBORMalformed, key)
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBORMalformed, major)
+}
+
+// encodeCBOR encodes the values decodeCBOR returns, using the canonical key order of CTAP2 so the
+// software authenticator produces the same bytes as hardware ones.
+func encodeCBOR(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeCBORItem(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeCBORHead(buf *bytes.Buffer, major byte, argument uint64) {
+	switch {
+	case argument < 24:
+		buf.WriteByte(major<<5 | byte(argument))
+	case argument <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(argument))
+	case argument <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		_ = binary.Write(buf, binary.BigEndian, uint16(argument))
+	case argument <= 0xffffffff:
+		buf.WriteByte(major<<5 | 26)
+		_ = binary.Write(buf, binary.BigEndian, uint32(argument))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		_ = binary.Write(buf, binary.BigEndian, argument)
+	}
+}
+
+func encodeCBORItem(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int:
+		return encodeCBORItem(buf, int64(v))
+	case int64:
+		if v < 0 {
+			encodeCBORHead(buf, 1, uint64(-1-v))
+		} else {
+			encodeCBORHead(buf, 0, uint64(v))
+		}
+	case []byte:
+		encodeCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		encodeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		encodeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeCBORItem(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		encoded := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			encodedKey, err := encodeCBOR(key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, encodedKey)
+			encoded[string(encodedKey)] = item
+		}
+
+		// shorter keys first, then bytewise
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+
+		encodeCBORHead(buf, 5, uint64(len(v)))
+		for _, key := range keys {
+			buf.Write(key)
+			if err := encodeCBORItem(buf, encoded[string(key)]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", value)
+	}
+	return nil
+}
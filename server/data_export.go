@@ -0,0 +1,570 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dataExportExcludedTablesConfig lists tables referencing users that are left out of exports.
+	dataExportExcludedTablesConfig = "DATA_EXPORT_EXCLUDED_TABLES"
+	// dataExportOwnerColumnsConfig lists "table.column" pairs naming who owns the rows of a table. A
+	// listed table is only exported through its listed columns, the others through ownerExportColumns.
+	dataExportOwnerColumnsConfig = "DATA_EXPORT_OWNER_COLUMNS"
+
+	// dataExportRetention is how long a finished export can be downloaded before it is deleted.
+	dataExportRetention = 7 * 24 * time.Hour
+
+	maxDataExportAttempts = 3
+	dataExportBatchSize   = 5
+	dataExportStaleAfter  = time.Hour
+
+	emailTypeDataExportReady models.EmailType = "data_export_ready"
+)
+
+// ownerExportColumns name the user who authored or owns a row. Other columns referencing users, such as
+// the blocked, reported or rated user, only make the user the target of the row, which is not exported.
+var ownerExportColumns = map[string]bool{
+	"user_id":     true,
+	"created_by":  true,
+	"author_id":   true,
+	"owner_id":    true,
+	"sender_id":   true,
+	"uploaded_by": true,
+	"reported_by": true,
+	"rated_by":    true,
+	"blocked_by":  true,
+}
+
+// sensitiveExportColumns are dropped from every exported row, they hold credentials rather than personal data.
+var sensitiveExportColumns = []string{"password", "token", "secret", "otp", "hash"}
+
+type dataExportStatus string
+
+const (
+	dataExportStatusPending dataExportStatus = "pending"
+	dataExportStatusRunning dataExportStatus = "running"
+	dataExportStatusReady   dataExportStatus = "ready"
+	dataExportStatusFailed  dataExportStatus = "failed"
+	dataExportStatusExpired dataExportStatus = "expired"
+)
+
+type dataExport struct {
+	ID          int              `json:"id" db:"id"`
+	UserID      int              `json:"-" db:"user_id"`
+	Status      dataExportStatus `json:"status" db:"status"`
+	Path        sql.NullString   `json:"-" db:"path"`
+	Attempts    int              `json:"-" db:"attempts"`
+	CreatedAt   time.Time        `json:"createdAt" db:"created_at"`
+	CompletedAt *time.Time       `json:"completedAt" db:"completed_at"`
+	ExpiresAt   *time.Time       `json:"expiresAt" db:"expires_at"`
+	URL         string           `json:"url,omitempty" db:"-"`
+}
+
+const dataExportColumns = `id, user_id, status, path, attempts, created_at, completed_at, expires_at`
+
+// dataExportPushNotifier is implemented by notification providers that can tell a user their export is ready.
+type dataExportPushNotifier interface {
+	SendPushNotificationForDataExport(userID int, downloadURL string) error
+}
+
+/*
+  - requestDataExport
+  - @Description This method is used to request an archive of all the data
+    of the user. The archive is built in the background and the user is
+    notified by email and push notification once it can be downloaded.
+*/
+func (srv *Server) requestDataExport(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	// a user with an export in progress gets that one back
+	SQL := `INSERT INTO data_exports (user_id, status)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id) WHERE status IN ('pending', 'running') DO UPDATE
+			    SET updated_at = data_exports.updated_at
+			RETURNING ` + dataExportColumns
+
+	var export dataExport
+	if err := srv.PSQL.DB().Get(&export, SQL, uc.ID, dataExportStatusPending); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to request data export")
+		return
+	}
+
+	go func() {
+		if err := srv.processDataExports(context.Background()); err != nil {
+			logrus.Errorf("requestDataExport: unable to process export %d: %v", export.ID, err)
+		}
+	}()
+
+	utils.EncodeJSON200Body(resp, export)
+}
+
+/*
+  - getDataExport
+  - @Description This method is used to get the status of the latest data
+    export of the user, with its download url once it is ready.
+*/
+func (srv *Server) getDataExport(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	SQL := `SELECT ` + dataExportColumns + `
+			FROM data_exports
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT 1`
+
+	var export dataExport
+	if err := srv.PSQL.DB().Get(&export, SQL, uc.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusNotFound, "no data export requested")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get data export")
+		return
+	}
+
+	if export.Status == dataExportStatusReady {
+		url, err := srv.dataExportURL(export)
+		if err != nil {
+			connectuperror.RespondGenericServerErr(resp, req, err, "unable to get data export url")
+			return
+		}
+		export.URL = url
+	}
+
+	utils.EncodeJSON200Body(resp, export)
+}
+
+func (srv *Server) dataExportURL(export dataExport) (string, error) {
+	if export.ExpiresAt == nil || !export.Path.Valid {
+		return "", errors.New("data export has no archive")
+	}
+	return srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), export.Path.String, time.Until(*export.ExpiresAt))
+}
+
+// processDataExports deletes expired archives and builds every pending export. Rows are claimed
+// with SKIP LOCKED so replicas never build the same export twice.
+func (srv *Server) processDataExports(ctx context.Context) error {
+	if err := srv.expireDataExports(ctx); err != nil {
+		logrus.Errorf("processDataExports: unable to expire exports %v", err)
+	}
+
+	SQL := `UPDATE data_exports
+			SET status     = $1,
+			    attempts   = attempts + 1,
+			    updated_at = now()
+			WHERE id IN (SELECT id
+			             FROM data_exports
+			             WHERE status = $2
+			                OR (status = $1 AND updated_at < $3)
+			             ORDER BY created_at
+			             LIMIT $4
+			             FOR UPDATE SKIP LOCKED)
+			RETURNING ` + dataExportColumns
+
+	exports := make([]dataExport, 0)
+	err := srv.PSQL.DB().Select(&exports, SQL, dataExportStatusRunning, dataExportStatusPending,
+		time.Now().Add(-dataExportStaleAfter), dataExportBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := srv.buildDataExport(ctx, export); err != nil {
+			srv.failDataExport(export, err)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) failDataExport(export dataExport, cause error) {
+	logrus.Errorf("buildDataExport: export %d of user %d failed: %v", export.ID, export.UserID, cause)
+
+	status := dataExportStatusPending
+	if export.Attempts >= maxDataExportAttempts {
+		status = dataExportStatusFailed
+	}
+
+	SQL := `UPDATE data_exports
+			SET status     = $2,
+			    last_error = $3,
+			    updated_at = now()
+			WHERE id = $1`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, export.ID, status, cause.Error()); err != nil {
+		logrus.Errorf("failDataExport: unable to update export %d: %v", export.ID, err)
+	}
+}
+
+func (srv *Server) expireDataExports(ctx context.Context) error {
+	SQL := `UPDATE data_exports
+			SET status     = $1,
+			    updated_at = now()
+			WHERE status = $2
+			  AND expires_at < now()
+			RETURNING ` + dataExportColumns
+
+	exports := make([]dataExport, 0)
+	if err := srv.PSQL.DB().Select(&exports, SQL, dataExportStatusExpired, dataExportStatusReady); err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if err := srv.StorageProvider.Delete(ctx, utils.GetUploadsBucketName(), export.Path.String); err != nil {
+			logrus.Errorf("expireDataExports: unable to delete archive of export %d: %v", export.ID, err)
+		}
+	}
+	return nil
+}
+
+// buildDataExport writes the archive of the user to a temp file, stores it and notifies the user.
+func (srv *Server) buildDataExport(ctx context.Context, export dataExport) error {
+	archive, err := os.CreateTemp("", "data-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			logrus.Errorf("buildDataExport: unable to close archive %v", err)
+		}
+		if err := os.Remove(archive.Name()); err != nil {
+			logrus.Errorf("buildDataExport: unable to remove archive %v", err)
+		}
+	}()
+
+	zw := zip.NewWriter(archive)
+	if err := srv.writeDataExport(ctx, zw, export.UserID); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	filePath := fmt.Sprintf("exports/%d/%d-%d.zip", export.UserID, export.ID, time.Now().Unix())
+	if err := srv.StorageProvider.Upload(ctx, utils.GetUploadsBucketName(), archive, filePath, "application/zip", false); err != nil {
+		return err
+	}
+
+	SQL := `UPDATE data_exports
+			SET status       = $2,
+			    path         = $3,
+			    expires_at   = $4,
+			    last_error   = NULL,
+			    completed_at = now(),
+			    updated_at   = now()
+			WHERE id = $1
+			RETURNING ` + dataExportColumns
+
+	err = srv.PSQL.DB().Get(&export, SQL, export.ID, dataExportStatusReady, filePath, time.Now().Add(dataExportRetention))
+	if err != nil {
+		if deleteErr := srv.StorageProvider.Delete(ctx, utils.GetUploadsBucketName(), filePath); deleteErr != nil {
+			logrus.Errorf("buildDataExport: unable to delete archive %s: %v", filePath, deleteErr)
+		}
+		return err
+	}
+
+	srv.notifyDataExportReady(export)
+	return nil
+}
+
+func (srv *Server) writeDataExport(ctx context.Context, zw *zip.Writer, userID int) error {
+	userInfo, err := srv.DBHelper.GetUserInfo(userID)
+	if err != nil {
+		return err
+	}
+
+	settings, err := srv.DBHelper.GetUserSettings(userID)
+	if err != nil {
+		return err
+	}
+
+	connections, err := srv.DBHelper.GetTotalConnectionsCount(userID)
+	if err != nil {
+		return err
+	}
+
+	blockedContacts, err := srv.DBHelper.GetAllUserBlockedContacts(userID)
+	if err != nil {
+		return err
+	}
+
+	sections := map[string]interface{}{
+		"profile.json":          userInfo,
+		"settings.json":         settings,
+		"connections.json":      connections,
+		"blocked_contacts.json": blockedContacts,
+	}
+	for name, data := range sections {
+		if err := writeExportJSON(zw, name, data); err != nil {
+			return err
+		}
+	}
+
+	references, err := srv.userDataReferences()
+	if err != nil {
+		return err
+	}
+
+	for _, reference := range references {
+		if err := srv.writeExportRows(zw, reference, userID); err != nil {
+			return fmt.Errorf("%s.%s: %w", reference.Table, reference.Column, err)
+		}
+	}
+
+	return srv.writeExportFiles(ctx, zw, userID)
+}
+
+func writeExportJSON(zw *zip.Writer, name string, data interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+type userDataReference struct {
+	Table  string `db:"table_name"`
+	Column string `db:"column_name"`
+}
+
+// userDataReferences returns the columns through which a user owns rows, from the foreign keys to
+// users. Activity such as messages, posts, comments, showcase profiles and job applications is
+// exported through them without this file knowing each table.
+func (srv *Server) userDataReferences() ([]userDataReference, error) {
+	SQL := `SELECT c.conrelid::regclass::TEXT AS table_name,
+			       a.attname                   AS column_name
+			FROM pg_constraint c
+			    JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+			WHERE c.contype = 'f'
+			  AND c.confrelid = 'users'::regclass
+			  AND c.conrelid <> 'users'::regclass
+			ORDER BY 1, 2`
+
+	foreignKeys := make([]userDataReference, 0)
+	if err := srv.PSQL.DB().Select(&foreignKeys, SQL); err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[string]bool)
+	for _, table := range strings.Split(srv.DynamicConfig.GetString(dataExportExcludedTablesConfig), ",") {
+		excluded[strings.TrimSpace(table)] = true
+	}
+
+	owners := make(map[string]map[string]bool)
+	for _, owner := range strings.Split(srv.DynamicConfig.GetString(dataExportOwnerColumnsConfig), ",") {
+		table, column, found := strings.Cut(strings.TrimSpace(owner), ".")
+		if !found {
+			continue
+		}
+		if owners[table] == nil {
+			owners[table] = make(map[string]bool)
+		}
+		owners[table][column] = true
+	}
+
+	references := make([]userDataReference, 0, len(foreignKeys))
+	for _, reference := range foreignKeys {
+		if excluded[reference.Table] {
+			continue
+		}
+
+		if columns, ok := owners[reference.Table]; ok {
+			if !columns[reference.Column] {
+				continue
+			}
+		} else if !ownerExportColumns[reference.Column] {
+			continue
+		}
+		references = append(references, reference)
+	}
+	return references, nil
+}
+
+// writeExportRows streams the rows of the table the user owns through the column as a JSON array.
+func (srv *Server) writeExportRows(zw *zip.Writer, reference userDataReference, userID int) error {
+	SQL := fmt.Sprintf(`SELECT to_jsonb(t) FROM %s t WHERE t.%s = $1`, reference.Table, pq.QuoteIdentifier(reference.Column))
+
+	rows, err := srv.PSQL.DB().Queryx(SQL, userID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logrus.Errorf("writeExportRows: unable to close rows %v", err)
+		}
+	}()
+
+	w, err := zw.Create(fmt.Sprintf("data/%s.%s.json", strings.Trim(reference.Table, `"`), reference.Column))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+
+	for first := true; rows.Next(); first = false {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+
+		row := make(map[string]interface{})
+		if err := json.Unmarshal(data, &row); err != nil {
+			return err
+		}
+
+		for column := range row {
+			if isSensitiveExportColumn(column) {
+				delete(row, column)
+			}
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, ",\n"); err != nil {
+				return err
+			}
+		}
+
+		if err := json.NewEncoder(w).Encode(row); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+func isSensitiveExportColumn(column string) bool {
+	column = strings.ToLower(column)
+	for _, sensitive := range sensitiveExportColumns {
+		if strings.Contains(column, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeExportFiles adds every file the user uploaded under files/. Derived files such as thumbnails
+// and quarantined uploads are left out.
+func (srv *Server) writeExportFiles(ctx context.Context, zw *zip.Writer, userID int) error {
+	SQL := `SELECT id, name
+			FROM uploads
+			WHERE uploaded_by = $1
+			  AND content_hash IS NOT NULL
+			  AND scan_status <> $2
+			ORDER BY id`
+
+	uploads := make([]struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&uploads, SQL, userID, uploadScanStatusInfected); err != nil {
+		return err
+	}
+
+	for _, upload := range uploads {
+		url, err := srv.freshUploadURL(upload.ID)
+		if err != nil {
+			return err
+		}
+
+		w, err := zw.Create(fmt.Sprintf("files/%d-%s", upload.ID, path.Base(upload.Name)))
+		if err != nil {
+			return err
+		}
+
+		if err := downloadTo(ctx, url, w); err != nil {
+			return fmt.Errorf("upload %d: %w", upload.ID, err)
+		}
+	}
+	return nil
+}
+
+func downloadTo(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logrus.Errorf("downloadTo: unable to close response %v", err)
+		}
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("download responded with status %d", response.StatusCode)
+	}
+
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// notifyDataExportReady sends the download link by email and push notification. Failures are only
+// logged, the export can still be fetched through GET /api/user/export.
+func (srv *Server) notifyDataExportReady(export dataExport) {
+	url, err := srv.dataExportURL(export)
+	if err != nil {
+		logrus.Errorf("notifyDataExportReady: unable to sign url of export %d: %v", export.ID, err)
+		return
+	}
+
+	emailTemplate, err := srv.EmailProvider.GetEmailTemplate(emailTypeDataExportReady, []int{export.UserID})
+	if err != nil {
+		logrus.Errorf("notifyDataExportReady: error in getting email template %v", err)
+	} else {
+		emailTemplate.DynamicData["downloadLink"] = url
+		emailTemplate.DynamicData["expiresAt"] = export.ExpiresAt.Format(time.RFC1123)
+		if err := srv.EmailProvider.Send(emailTemplate); err != nil {
+			logrus.Errorf("notifyDataExportReady: error in sending email %v", err)
+		}
+	}
+
+	notifier, ok := srv.NotificationProvider.(dataExportPushNotifier)
+	if !ok {
+		logrus.Warnf("notifyDataExportReady: notification provider cannot send data export notifications")
+		return
+	}
+
+	if err := notifier.SendPushNotificationForDataExport(export.UserID, url); err != nil {
+		logrus.Errorf("notifyDataExportReady: error in sending push notification %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/models"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// documentPreviewWidth is the width in pixels of the first page rendering used as preview.
+	documentPreviewWidth = 1024
+
+	// officeConversionTimeout bounds the LibreOffice conversion of a single document.
+	officeConversionTimeout = time.Minute
+)
+
+// officeDocumentExtensions are converted to PDF with LibreOffice before their preview is rendered.
+var officeDocumentExtensions = map[string]bool{
+	".doc":  true,
+	".docx": true,
+	".ppt":  true,
+	".pptx": true,
+	".xls":  true,
+	".xlsx": true,
+	".odt":  true,
+	".odp":  true,
+	".ods":  true,
+	".rtf":  true,
+}
+
+type documentMetadata struct {
+	PageCount int `json:"pageCount"`
+}
+
+// renderedDocument is a document preview rendered ahead of the transaction that stores it.
+type renderedDocument struct {
+	preview   *os.File
+	size      int64
+	pageCount int
+}
+
+// renderDocumentPreview renders the first page of a PDF upload and counts its pages. Office documents
+// are converted to PDF first when LibreOffice is installed. Documents that cannot be rendered, password
+// protected ones for instance, are stored without a preview. Rendering can take up to a minute, so it
+// runs before the upload transaction and storeDocumentPreview stores the result in it.
+func renderDocumentPreview(uctx *uploadContext) error {
+	if uctx.binaryType != models.UploadBinaryTypeDocument {
+		return nil
+	}
+
+	extension := strings.ToLower(filepath.Ext(uctx.header.Filename))
+	isPDF := uctx.mimeType == "application/pdf"
+	if !isPDF && !officeDocumentExtensions[extension] {
+		return nil
+	}
+
+	pdftoppm, err := exec.LookPath("pdftoppm")
+	if err == nil {
+		_, err = exec.LookPath("pdfinfo")
+	}
+	if err != nil {
+		logrus.Warnf("renderDocumentPreview: poppler is not installed, storing %s without preview", uctx.header.Filename)
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "document-*")
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("renderDocumentPreview: unable to remove temp dir %v", err)
+		}
+	})
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	input := filepath.Join(dir, "input"+extension)
+	if err := writeTempFile(input, uctx.file); err != nil {
+		return err
+	}
+
+	ctx := uctx.req.Context()
+
+	pdf := input
+	if !isPDF {
+		soffice, err := exec.LookPath("soffice")
+		if err != nil {
+			logrus.Warnf("renderDocumentPreview: LibreOffice is not installed, storing %s without preview", uctx.header.Filename)
+			return nil
+		}
+
+		pdf, err = convertToPDF(ctx, soffice, dir, input)
+		if err != nil {
+			logrus.Errorf("renderDocumentPreview: unable to convert %s: %v", uctx.header.Filename, err)
+			return nil
+		}
+	}
+
+	pageCount, err := pdfPageCount(ctx, pdf)
+	if err != nil {
+		logrus.Errorf("renderDocumentPreview: unable to count pages of %s: %v", uctx.header.Filename, err)
+		return nil
+	}
+
+	preview, err := renderFirstPage(ctx, pdftoppm, dir, pdf)
+	if err != nil {
+		logrus.Errorf("renderDocumentPreview: unable to render %s: %v", uctx.header.Filename, err)
+		return nil
+	}
+	uctx.onCleanup(func() {
+		if err := preview.Close(); err != nil {
+			logrus.Errorf("renderDocumentPreview: unable to close preview %v", err)
+		}
+	})
+
+	info, err := preview.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > maxThumbnailSize {
+		logrus.Warnf("renderDocumentPreview: preview of %s is %d bytes, storing it without preview", uctx.header.Filename, info.Size())
+		return nil
+	}
+
+	uctx.renderedDocument = &renderedDocument{preview: preview, size: info.Size(), pageCount: pageCount}
+	return nil
+}
+
+// storeDocumentPreview stores the preview rendered by renderDocumentPreview as the thumbnail of the
+// upload, and its page count.
+func storeDocumentPreview(uctx *uploadContext) error {
+	rendered := uctx.renderedDocument
+	if rendered == nil {
+		return nil
+	}
+
+	if _, err := rendered.preview.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	thumbURL, err := uctx.srv.storeThumbnail(uctx, rendered.preview, rendered.size)
+	if err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO upload_documents (upload_id, page_count)
+			VALUES ($1, $2)`
+
+	if _, err := uctx.tx.Exec(SQL, uctx.upload.FileID, rendered.pageCount); err != nil {
+		return err
+	}
+
+	uctx.thumbnailURL = thumbURL
+	uctx.document = &documentMetadata{PageCount: rendered.pageCount}
+	return nil
+}
+
+// convertToPDF converts an office document with LibreOffice and returns the path of the PDF.
+// Each conversion gets its own LibreOffice profile so concurrent uploads do not block each other.
+func convertToPDF(ctx context.Context, soffice, dir, input string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, officeConversionTimeout)
+	defer cancel()
+
+	profile := "-env:UserInstallation=file://" + filepath.ToSlash(filepath.Join(dir, "profile"))
+
+	// nolint:gosec // arguments are paths created by renderDocumentPreview
+	cmd := exec.CommandContext(ctx, soffice, profile, "--headless", "--norestore", "--convert-to", "pdf", "--outdir", dir, input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("soffice: %w: %s", err, stderr.String())
+	}
+
+	pdf := strings.TrimSuffix(input, filepath.Ext(input)) + ".pdf"
+	if _, err := os.Stat(pdf); err != nil {
+		return "", fmt.Errorf("soffice did not write a pdf: %s", stderr.String())
+	}
+	return pdf, nil
+}
+
+func pdfPageCount(ctx context.Context, pdf string) (int, error) {
+	// nolint:gosec // arguments are paths created by renderDocumentPreview
+	cmd := exec.CommandContext(ctx, "pdfinfo", pdf)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("pdfinfo: %w: %s", err, stderr.String())
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "Pages:")
+		if found {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	return 0, fmt.Errorf("pdfinfo did not report a page count")
+}
+
+// renderFirstPage renders the first page of the PDF as a PNG documentPreviewWidth pixels wide.
+func renderFirstPage(ctx context.Context, pdftoppm, dir, pdf string) (*os.File, error) {
+	output := filepath.Join(dir, "preview")
+
+	// nolint:gosec // arguments are paths created by renderDocumentPreview
+	cmd := exec.CommandContext(ctx, pdftoppm, "-png", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to-x", strconv.Itoa(documentPreviewWidth), "-scale-to-y", "-1", pdf, output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pdftoppm: %w: %s", err, stderr.String())
+	}
+	return os.Open(output + ".png")
+}
+
+// getDocumentMetadata returns the page count of every given document upload keyed by upload id.
+// Their previews are linked in the thumbnail table like the thumbnails of videos.
+func (srv *Server) getDocumentMetadata(uploadIDs ...int) (map[int]documentMetadata, error) {
+	metadata := make(map[int]documentMetadata, len(uploadIDs))
+	if len(uploadIDs) == 0 {
+		return metadata, nil
+	}
+
+	SQL := `SELECT upload_id, page_count
+			FROM upload_documents
+			WHERE upload_id = ANY($1)`
+
+	rows := make([]struct {
+		UploadID  int `db:"upload_id"`
+		PageCount int `db:"page_count"`
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&rows, SQL, pq.Array(uploadIDs)); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		metadata[row.UploadID] = documentMetadata{PageCount: row.PageCount}
+	}
+	return metadata, nil
+}
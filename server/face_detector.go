@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/sirupsen/logrus"
+	visionpb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+const (
+	// faceDetectorBackendConfig selects the FaceDetector, either "vision" (default) or "local".
+	faceDetectorBackendConfig = "FACE_DETECTOR_BACKEND"
+	// faceDetectorFixturesConfig points the local detector to a JSON file mapping image SHA-256 to faces.
+	faceDetectorFixturesConfig = "FACE_DETECTOR_FIXTURES"
+
+	faceMinDetectionConfidenceConfig = "FACE_MIN_DETECTION_CONFIDENCE"
+	faceMaxBlurLikelihoodConfig      = "FACE_MAX_BLUR_LIKELIHOOD"
+
+	faceDetectorBackendLocal = "local"
+
+	defaultMinDetectionConfidence = 0.5
+	maxDetectedFaces              = 10
+)
+
+// faceLikelihood follows the scale of the Vision API, from faceLikelihoodUnknown to faceLikelihoodVeryLikely.
+type faceLikelihood int
+
+const (
+	faceLikelihoodUnknown faceLikelihood = iota
+	faceLikelihoodVeryUnlikely
+	faceLikelihoodUnlikely
+	faceLikelihoodPossible
+	faceLikelihoodLikely
+	faceLikelihoodVeryLikely
+)
+
+type detectedFace struct {
+	DetectionConfidence float64        `json:"detectionConfidence"`
+	BlurredLikelihood   faceLikelihood `json:"blurredLikelihood"`
+}
+
+// FaceDetector finds the faces in the image stored at imagePath.
+type FaceDetector interface {
+	DetectFaces(ctx context.Context, imagePath string) ([]detectedFace, error)
+}
+
+// faceRejectionCode is sent as the error of a rejected profile image so clients can tell the reasons apart.
+type faceRejectionCode string
+
+const (
+	faceRejectionNoFace        faceRejectionCode = "face_not_found"
+	faceRejectionMultipleFaces faceRejectionCode = "multiple_faces"
+	faceRejectionLowConfidence faceRejectionCode = "low_detection_confidence"
+	faceRejectionBlurred       faceRejectionCode = "face_blurred"
+)
+
+// faceCheckThresholds decide which detected faces are good enough for a profile image.
+type faceCheckThresholds struct {
+	MinDetectionConfidence float64
+	MaxBlurredLikelihood   faceLikelihood
+}
+
+func (srv *Server) faceDetector() FaceDetector {
+	if srv.DynamicConfig.GetString(faceDetectorBackendConfig) == faceDetectorBackendLocal {
+		return newLocalFaceDetector(srv.DynamicConfig.GetString(faceDetectorFixturesConfig))
+	}
+	return visionFaceDetector{}
+}
+
+func (srv *Server) faceCheckThresholds() faceCheckThresholds {
+	thresholds := faceCheckThresholds{
+		MinDetectionConfidence: defaultMinDetectionConfidence,
+		MaxBlurredLikelihood:   faceLikelihoodLikely,
+	}
+
+	if value := srv.DynamicConfig.GetString(faceMinDetectionConfidenceConfig); value != "" {
+		confidence, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			logrus.Errorf("faceCheckThresholds: invalid %s %q", faceMinDetectionConfidenceConfig, value)
+		} else {
+			thresholds.MinDetectionConfidence = confidence
+		}
+	}
+
+	if likelihood := srv.DynamicConfig.GetInt(faceMaxBlurLikelihoodConfig); likelihood > 0 {
+		thresholds.MaxBlurredLikelihood = faceLikelihood(likelihood)
+	}
+	return thresholds
+}
+
+// check returns the reason the faces are rejected, or an empty code when they are accepted.
+func (thresholds faceCheckThresholds) check(faces []detectedFace) (faceRejectionCode, string) {
+	switch {
+	case len(faces) == 0:
+		return faceRejectionNoFace, "Add a image that has your face"
+	case len(faces) > 1:
+		return faceRejectionMultipleFaces, "Image should contain only 1 face"
+	case faces[0].DetectionConfidence <= thresholds.MinDetectionConfidence:
+		return faceRejectionLowConfidence, "Upload a proper image"
+	case faces[0].BlurredLikelihood > thresholds.MaxBlurredLikelihood:
+		return faceRejectionBlurred, "Add a image that has a clear face"
+	}
+	return "", ""
+}
+
+// visionFaceDetector uses the Google Vision API.
+type visionFaceDetector struct{}
+
+func (visionFaceDetector) DetectFaces(ctx context.Context, imagePath string) ([]detectedFace, error) {
+	client, err := vision.NewImageAnnotatorClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			logrus.Errorf("visionFaceDetector: unable to close client %v", err)
+		}
+	}()
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("visionFaceDetector: unable to close image %v", err)
+		}
+	}()
+
+	img, err := vision.NewImageFromReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations, err := client.DetectFaces(ctx, img, nil, maxDetectedFaces)
+	if err != nil {
+		return nil, err
+	}
+
+	faces := make([]detectedFace, 0, len(annotations))
+	for _, annotation := range annotations {
+		faces = append(faces, detectedFace{
+			DetectionConfidence: float64(annotation.DetectionConfidence),
+			BlurredLikelihood:   visionLikelihood(annotation.BlurredLikelihood),
+		})
+	}
+	return faces, nil
+}
+
+func visionLikelihood(likelihood visionpb.Likelihood) faceLikelihood {
+	switch likelihood {
+	case visionpb.Likelihood_VERY_UNLIKELY:
+		return faceLikelihoodVeryUnlikely
+	case visionpb.Likelihood_UNLIKELY:
+		return faceLikelihoodUnlikely
+	case visionpb.Likelihood_POSSIBLE:
+		return faceLikelihoodPossible
+	case visionpb.Likelihood_LIKELY:
+		return faceLikelihoodLikely
+	case visionpb.Likelihood_VERY_LIKELY:
+		return faceLikelihoodVeryLikely
+	}
+	return faceLikelihoodUnknown
+}
+
+// localFaceDetector is an offline FaceDetector for local development and tests. Images listed in
+// the fixtures report the faces recorded for their SHA-256, any other decodable image reports one
+// clear face.
+type localFaceDetector struct {
+	fixtures map[string][]detectedFace
+}
+
+func newLocalFaceDetector(fixturesPath string) localFaceDetector {
+	detector := localFaceDetector{fixtures: make(map[string][]detectedFace)}
+	if fixturesPath == "" {
+		return detector
+	}
+
+	data, err := os.ReadFile(fixturesPath)
+	if err != nil {
+		logrus.Errorf("newLocalFaceDetector: unable to read fixtures %v", err)
+		return detector
+	}
+
+	if err := json.Unmarshal(data, &detector.fixtures); err != nil {
+		logrus.Errorf("newLocalFaceDetector: unable to parse fixtures %v", err)
+	}
+	return detector
+}
+
+func (detector localFaceDetector) DetectFaces(_ context.Context, imagePath string) ([]detectedFace, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("localFaceDetector: unable to close image %v", err)
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+
+	if faces, ok := detector.fixtures[hex.EncodeToString(hash.Sum(nil))]; ok {
+		return faces, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := image.DecodeConfig(file); err != nil {
+		return []detectedFace{}, nil
+	}
+	return []detectedFace{{DetectionConfidence: 1, BlurredLikelihood: faceLikelihoodVeryUnlikely}}, nil
+}
+
+func checkSingleFace(uctx *uploadContext) error {
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	localFilePath, err := utils.CreateImageFile(uctx.file, uctx.header.Filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(localFilePath); err != nil {
+			logrus.Errorf("checkSingleFace: error in removing file: %v", err)
+		}
+	}()
+
+	faces, err := uctx.srv.faceDetector().DetectFaces(uctx.req.Context(), localFilePath)
+	if err != nil {
+		return err
+	}
+
+	if code, message := uctx.srv.faceCheckThresholds().check(faces); code != "" {
+		return rejectUploadWithCode(http.StatusBadRequest, string(code), message)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFaceCheckThresholds(t *testing.T) {
+	defaults := faceCheckThresholds{
+		MinDetectionConfidence: defaultMinDetectionConfidence,
+		MaxBlurredLikelihood:   faceLikelihoodLikely,
+	}
+	clearFace := detectedFace{DetectionConfidence: 0.9, BlurredLikelihood: faceLikelihoodVeryUnlikely}
+
+	tests := []struct {
+		name       string
+		thresholds faceCheckThresholds
+		faces      []detectedFace
+		want       faceRejectionCode
+	}{
+		{name: "single clear face", thresholds: defaults, faces: []detectedFace{clearFace}},
+		{name: "no face", thresholds: defaults, faces: nil, want: faceRejectionNoFace},
+		{name: "two faces", thresholds: defaults, faces: []detectedFace{clearFace, clearFace}, want: faceRejectionMultipleFaces},
+		{
+			name:       "confidence at the minimum",
+			thresholds: defaults,
+			faces:      []detectedFace{{DetectionConfidence: defaultMinDetectionConfidence}},
+			want:       faceRejectionLowConfidence,
+		},
+		{
+			name:       "confidence above a raised minimum",
+			thresholds: faceCheckThresholds{MinDetectionConfidence: 0.8, MaxBlurredLikelihood: faceLikelihoodLikely},
+			faces:      []detectedFace{{DetectionConfidence: 0.85}},
+		},
+		{
+			name:       "confidence below a raised minimum",
+			thresholds: faceCheckThresholds{MinDetectionConfidence: 0.95, MaxBlurredLikelihood: faceLikelihoodLikely},
+			faces:      []detectedFace{clearFace},
+			want:       faceRejectionLowConfidence,
+		},
+		{
+			name:       "blur at the maximum",
+			thresholds: defaults,
+			faces:      []detectedFace{{DetectionConfidence: 0.9, BlurredLikelihood: faceLikelihoodLikely}},
+		},
+		{
+			name:       "blur above the maximum",
+			thresholds: defaults,
+			faces:      []detectedFace{{DetectionConfidence: 0.9, BlurredLikelihood: faceLikelihoodVeryLikely}},
+			want:       faceRejectionBlurred,
+		},
+		{
+			name:       "blur above a lowered maximum",
+			thresholds: faceCheckThresholds{MinDetectionConfidence: 0.5, MaxBlurredLikelihood: faceLikelihoodUnlikely},
+			faces:      []detectedFace{{DetectionConfidence: 0.9, BlurredLikelihood: faceLikelihoodPossible}},
+			want:       faceRejectionBlurred,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, message := tt.thresholds.check(tt.faces)
+			if code != tt.want {
+				t.Errorf("check() code = %q, want %q", code, tt.want)
+			}
+			if (code == "") != (message == "") {
+				t.Errorf("check() message = %q for code %q, want a message exactly when rejected", message, code)
+			}
+		})
+	}
+}
+
+func TestFaceRejectionIsMachineReadable(t *testing.T) {
+	code, message := faceCheckThresholds{MinDetectionConfidence: 0.5}.check(nil)
+
+	err := rejectUploadWithCode(http.StatusBadRequest, string(code), message)
+
+	var uploadErr *uploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("rejectUploadWithCode() = %T, want *uploadError", err)
+	}
+	if uploadErr.statusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", uploadErr.statusCode, http.StatusBadRequest)
+	}
+	if uploadErr.Error() != string(faceRejectionNoFace) {
+		t.Errorf("error = %q, want the rejection code %q", uploadErr.Error(), faceRejectionNoFace)
+	}
+	if uploadErr.message != message {
+		t.Errorf("message = %q, want %q", uploadErr.message, message)
+	}
+}
+
+func TestLocalFaceDetector(t *testing.T) {
+	dir := t.TempDir()
+
+	portrait := writeTestPNG(t, filepath.Join(dir, "portrait.png"), 8)
+	group := writeTestPNG(t, filepath.Join(dir, "group.png"), 16)
+
+	notAnImage := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(notAnImage, []byte("not an image"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	groupFaces := []detectedFace{
+		{DetectionConfidence: 0.9, BlurredLikelihood: faceLikelihoodVeryUnlikely},
+		{DetectionConfidence: 0.7, BlurredLikelihood: faceLikelihoodPossible},
+	}
+	fixtures, err := json.Marshal(map[string][]detectedFace{sha256File(t, group): groupFaces})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixturesPath := filepath.Join(dir, "fixtures.json")
+	if err := os.WriteFile(fixturesPath, fixtures, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	detector := newLocalFaceDetector(fixturesPath)
+	thresholds := faceCheckThresholds{MinDetectionConfidence: defaultMinDetectionConfidence, MaxBlurredLikelihood: faceLikelihoodLikely}
+
+	tests := []struct {
+		name  string
+		path  string
+		faces int
+		want  faceRejectionCode
+	}{
+		{name: "unlisted image has one clear face", path: portrait, faces: 1},
+		{name: "fixture faces are reported", path: group, faces: 2, want: faceRejectionMultipleFaces},
+		{name: "undecodable file has no face", path: notAnImage, faces: 0, want: faceRejectionNoFace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faces, err := detector.DetectFaces(context.Background(), tt.path)
+			if err != nil {
+				t.Fatalf("DetectFaces() error = %v", err)
+			}
+			if len(faces) != tt.faces {
+				t.Errorf("DetectFaces() found %d faces, want %d", len(faces), tt.faces)
+			}
+			if code, _ := thresholds.check(faces); code != tt.want {
+				t.Errorf("check() code = %q, want %q", code, tt.want)
+			}
+		})
+	}
+
+	if _, err := detector.DetectFaces(context.Background(), filepath.Join(dir, "missing.png")); err == nil {
+		t.Error("DetectFaces() error = nil for a missing file")
+	}
+}
+
+func TestLocalFaceDetectorWithoutFixtures(t *testing.T) {
+	detector := newLocalFaceDetector(filepath.Join(t.TempDir(), "missing.json"))
+
+	faces, err := detector.DetectFaces(context.Background(), writeTestPNG(t, filepath.Join(t.TempDir(), "face.png"), 4))
+	if err != nil {
+		t.Fatalf("DetectFaces() error = %v", err)
+	}
+	if len(faces) != 1 {
+		t.Errorf("DetectFaces() found %d faces, want 1", len(faces))
+	}
+}
+
+func writeTestPNG(t *testing.T, path string, size int) string {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, image.NewGray(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sha256File(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
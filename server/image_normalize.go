@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+const (
+	// keepOriginalImagesConfig keeps the untouched bytes of every normalized image in a private
+	// path so moderators can still inspect the metadata of a reported upload.
+	keepOriginalImagesConfig = "KEEP_ORIGINAL_IMAGES_FOR_MODERATION"
+
+	exifOrientationTag = 0x0112
+)
+
+// imageNormalizer writes the image in data to w rebuilt from its decoded pixels, which drops EXIF, XMP
+// and every other metadata block, GPS coordinates included.
+type imageNormalizer func(w io.Writer, data []byte) error
+
+// imageNormalizers lists every image format accepted for upload. Images in any other format are
+// rejected, their metadata could not be stripped. WebP needs cwebp to be installed.
+var imageNormalizers = map[string]imageNormalizer{
+	"image/jpeg": normalizeJPEG,
+	"image/png":  reencodeImage(png.Encode),
+	"image/gif":  normalizeGIF,
+	"image/bmp":  reencodeImage(bmp.Encode),
+	"image/webp": reencodeImage(encodeWebP),
+	"image/tiff": normalizeTIFF,
+}
+
+// normalizeImage re-encodes image uploads so no metadata reaches the bucket, and bakes the EXIF
+// orientation into the pixels. SVGs carry no camera metadata and are only rasterized later on.
+func normalizeImage(uctx *uploadContext) error {
+	if uctx.binaryType != models.UploadBinaryTypeImage || strings.HasSuffix(uctx.mimeType, "svg+xml") {
+		return nil
+	}
+
+	normalize, ok := imageNormalizers[uctx.mimeType]
+	if !ok {
+		return rejectUpload(http.StatusUnsupportedMediaType, "image format not supported")
+	}
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	original, err := io.ReadAll(uctx.file)
+	if err != nil {
+		return err
+	}
+
+	normalized, err := os.CreateTemp("", "normalized-*"+filepath.Ext(uctx.header.Filename))
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := normalized.Close(); err != nil {
+			logrus.Errorf("normalizeImage: unable to close temp file %v", err)
+		}
+		if err := os.Remove(normalized.Name()); err != nil {
+			logrus.Errorf("normalizeImage: unable to remove temp file %v", err)
+		}
+	})
+
+	if err := normalize(normalized, original); err != nil {
+		return err
+	}
+
+	if uctx.srv.DynamicConfig.GetBool(keepOriginalImagesConfig) {
+		uctx.original = original
+	}
+
+	uctx.file = normalized
+	_, err = normalized.Seek(0, io.SeekStart)
+	return err
+}
+
+// decodeUploadedImage decodes an uploaded image within maxImagePixels, rejecting the upload otherwise.
+func decodeUploadedImage(data []byte) (image.Image, error) {
+	img, _, err := decodeImage(bytes.NewReader(data))
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		return nil, rejectUpload(http.StatusRequestEntityTooLarge, "image dimensions are too large")
+	case err != nil:
+		return nil, rejectUpload(http.StatusBadRequest, "unable to read image")
+	}
+	return img, nil
+}
+
+func reencodeImage(encode imageEncoder) imageNormalizer {
+	return func(w io.Writer, data []byte) error {
+		img, err := decodeUploadedImage(data)
+		if err != nil {
+			return err
+		}
+		return encode(w, img)
+	}
+}
+
+func normalizeJPEG(w io.Writer, data []byte) error {
+	img, err := decodeUploadedImage(data)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, applyEXIFOrientation(img, jpegOrientation(data)), &jpeg.Options{Quality: 92})
+}
+
+// normalizeTIFF keeps a single page, TIFF stores its orientation in the same IFD as EXIF does.
+func normalizeTIFF(w io.Writer, data []byte) error {
+	img, err := decodeUploadedImage(data)
+	if err != nil {
+		return err
+	}
+	return tiff.Encode(w, applyEXIFOrientation(img, tiffOrientation(data)), &tiff.Options{Compression: tiff.Deflate})
+}
+
+// normalizeGIF re-encodes every frame of the GIF, which drops its comment and application extensions
+// except the loop count.
+func normalizeGIF(w io.Writer, data []byte) error {
+	gifConfig, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil || gifConfig.Width <= 0 || gifConfig.Height <= 0 {
+		return rejectUpload(http.StatusBadRequest, "unable to read image")
+	}
+
+	// every frame is decoded into its own buffer, so the frames count against the pixel limit
+	if int64(gifConfig.Width)*int64(gifConfig.Height)*int64(gifFrameCount(data)) > maxImagePixels {
+		return rejectUpload(http.StatusRequestEntityTooLarge, "image dimensions are too large")
+	}
+
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return rejectUpload(http.StatusBadRequest, "unable to read image")
+	}
+	return gif.EncodeAll(w, animation)
+}
+
+// gifFrameCount walks the blocks of a GIF and counts its image descriptors. A truncated or malformed
+// GIF counts the frames found before the damage plus one, the decoder stops at the same point.
+func gifFrameCount(data []byte) int {
+	const headerLength = 13
+	if len(data) < headerLength {
+		return 1
+	}
+
+	offset := headerLength
+	if flags := data[10]; flags&0x80 != 0 {
+		offset += 3 << ((flags & 0x07) + 1)
+	}
+
+	// skipSubBlocks returns the offset after the sub-block chain starting at offset, -1 when it is cut short.
+	skipSubBlocks := func(offset int) int {
+		for offset < len(data) {
+			size := int(data[offset])
+			offset++
+			if size == 0 {
+				return offset
+			}
+			offset += size
+		}
+		return -1
+	}
+
+	frames := 0
+	for offset < len(data) {
+		switch data[offset] {
+		case 0x21: // extension introducer, label, sub-blocks
+			offset = skipSubBlocks(offset + 2)
+		case 0x2C: // image descriptor, optional local color table, LZW code size, sub-blocks
+			if offset+10 > len(data) {
+				return frames + 1
+			}
+			frames++
+			flags := data[offset+9]
+			offset += 10
+			if flags&0x80 != 0 {
+				offset += 3 << ((flags & 0x07) + 1)
+			}
+			offset = skipSubBlocks(offset + 1)
+		default: // trailer or garbage, the decoder stops here
+			return frames
+		}
+
+		if offset < 0 {
+			return frames + 1
+		}
+	}
+	return frames + 1
+}
+
+// storeModerationOriginal uploads the bytes of the image as they were sent, without ever signing a url for them.
+func storeModerationOriginal(uctx *uploadContext) error {
+	if uctx.original == nil {
+		return nil
+	}
+
+	filePath := "moderation/originals/" + uctx.filePath
+	if err := uctx.storeObject(bytes.NewReader(uctx.original), filePath, false); err != nil {
+		return err
+	}
+
+	SQL := `INSERT INTO upload_originals (upload_id, bucket, path)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (upload_id) DO NOTHING`
+
+	_, err := uctx.tx.Exec(SQL, uctx.upload.FileID, utils.GetUploadsBucketName(), filePath)
+	return err
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 when it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if marker == 0xDA || length < 2 || offset+2+length > len(data) {
+			// start of scan, metadata segments are over
+			return 1
+		}
+
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyEXIFOrientation returns the image as it should be displayed for the given EXIF orientation.
+func applyEXIFOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// orientations 5 to 8 swap width and height
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			dst.SetRGBA(dx, dy, rgba.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backgroundJob is a periodic task that runs next to the http server on every replica.
+// Jobs must be safe to run concurrently from several replicas.
+type backgroundJob struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+func (srv *Server) backgroundJobs() []backgroundJob {
+	return []backgroundJob{
+		{name: "refreshExpiringUploadURLs", interval: time.Hour, run: srv.refreshExpiringUploadURLs},
+		{name: "scanPendingUploads", interval: time.Minute, run: srv.scanPendingUploads},
+		{name: "collectOrphanedUploads", interval: 6 * time.Hour, run: srv.collectOrphanedUploads},
+		{name: "processAccountDeletions", interval: time.Minute, run: srv.processAccountDeletions},
+		{name: "processDataExports", interval: time.Minute, run: srv.processDataExports},
+		{name: "purgeOTPCodes", interval: time.Hour, run: srv.purgeOTPCodes},
+		{name: "flushAuthUsage", interval: time.Minute, run: srv.flushAuthUsage},
+		{name: "purgeAuthAttempts", interval: time.Hour, run: srv.purgeAuthAttempts},
+		{name: "purgeAuthChallenges", interval: 10 * time.Minute, run: srv.purgeAuthChallenges},
+	}
+}
+
+// StartBackgroundJobs starts every background job. They stop once ctx is cancelled.
+func (srv *Server) StartBackgroundJobs(ctx context.Context) {
+	for _, job := range srv.backgroundJobs() {
+		go srv.runBackgroundJob(ctx, job)
+	}
+}
+
+func (srv *Server) runBackgroundJob(ctx context.Context, job backgroundJob) {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	for {
+		startTime := time.Now()
+		if err := job.run(ctx); err != nil {
+			logrus.Errorf("%s: job failed: %v", job.name, err)
+		} else {
+			logrus.Infof("%s: job finished in %d ms", job.name, time.Since(startTime).Milliseconds())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,723 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+// otp.go sends and verifies the one time codes of every reason. A reason is a policy: where its
+// codes may be sent, how long they live, how many wrong guesses lock the destination out and
+// what happens once a code is verified. Codes are stored as an HMAC, a newer code replaces the
+// older ones of the same destination.
+
+const (
+	// otpHashSecretConfig keys the HMAC of stored codes, so a leaked table cannot be brute forced
+	// back to the codes without it.
+	otpHashSecretConfig = "OTP_HASH_SECRET"
+
+	// otpRetention is how long used and expired codes are kept once their password reset grant is
+	// over. The cooldown reads the latest code of a destination, it is much shorter.
+	otpRetention = 24 * time.Hour
+
+	passwordResetTokenTTL = 15 * time.Minute
+)
+
+type otpDestinationKind string
+
+const (
+	otpDestinationPhone otpDestinationKind = "phone"
+	otpDestinationEmail otpDestinationKind = "email"
+)
+
+var (
+	errOTPInvalid           = errors.New("otp is invalid or expired")
+	errOTPUnsupportedReason = errors.New("unsupported otp reason")
+	errOTPDestination       = errors.New("invalid destination")
+	errPasswordResetInvalid = errors.New("reset token is invalid or expired")
+	errOTPSignInRequired    = errors.New("sign in to request this code")
+	errOTPPhoneTaken        = errors.New("phone number is already verified on another account")
+	errOTPUndelivered       = errors.New("unable to deliver the code, try again")
+	errOTPNotConfigured     = errors.New("otp hash secret is not configured")
+
+	// phoneNumberPattern matches E.164 numbers once phoneNumberSeparators are removed.
+	phoneNumberPattern    = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	phoneNumberSeparators = " -()."
+)
+
+// otpSendLimit caps the codes requested from one client ip, whatever their destinations.
+var otpSendLimit = authLimit{Scope: "otp_send", Max: 10, Window: 15 * time.Minute, Lockout: 15 * time.Minute}
+
+type otpPolicy struct {
+	Reason       models.OTPReasonType
+	Destinations []otpDestinationKind
+	// Channels the codes can be sent through, the first one reaching the destination is used
+	// unless the request asks for another.
+	Channels   []otpChannelName
+	CodeLength int
+	TTL        time.Duration
+	// MaxAttempts wrong codes for a destination within AttemptWindow lock it out for Lockout,
+	// whichever codes they were meant for.
+	MaxAttempts    int
+	AttemptWindow  time.Duration
+	Lockout        time.Duration
+	ResendCooldown time.Duration
+	// RequireAccount only sends codes to destinations of an account. Requests for other
+	// destinations are answered as if the code was sent, so accounts cannot be discovered.
+	RequireAccount bool
+	// SignedIn codes are requested by the signed in user through /api/user/send_otp and belong to
+	// them, whoever the destination belongs to.
+	SignedIn bool
+	// Message is the text of the code, formatted with the code and its lifetime in minutes.
+	Message string
+	// OnVerified runs in the transaction using the code, its result is added to the response.
+	OnVerified func(tx *sqlx.Tx, req *http.Request, code otpCode) (map[string]interface{}, error)
+}
+
+// otpPolicies lists the policy of every reason codes are sent for.
+func (srv *Server) otpPolicies() map[models.OTPReasonType]otpPolicy {
+	return map[models.OTPReasonType]otpPolicy{
+		models.OTPReasonTypeResetPassword: {
+			Reason:         models.OTPReasonTypeResetPassword,
+			Destinations:   []otpDestinationKind{otpDestinationPhone, otpDestinationEmail},
+			Channels:       []otpChannelName{otpChannelSMS, otpChannelEmail, otpChannelWhatsApp},
+			CodeLength:     6,
+			TTL:            10 * time.Minute,
+			MaxAttempts:    5,
+			AttemptWindow:  time.Hour,
+			Lockout:        30 * time.Minute,
+			ResendCooldown: time.Minute,
+			RequireAccount: true,
+			Message:        "%s is your ConnectUp code to reset your password. It expires in %d minutes.",
+			OnVerified:     srv.grantPasswordReset,
+		},
+		models.OTPReasonTypeVerifyPhone: {
+			Reason:         models.OTPReasonTypeVerifyPhone,
+			Destinations:   []otpDestinationKind{otpDestinationPhone},
+			Channels:       []otpChannelName{otpChannelSMS, otpChannelWhatsApp},
+			CodeLength:     6,
+			TTL:            10 * time.Minute,
+			MaxAttempts:    5,
+			AttemptWindow:  time.Hour,
+			Lockout:        15 * time.Minute,
+			ResendCooldown: time.Minute,
+			SignedIn:       true,
+			Message:        "%s is your ConnectUp code to verify your phone number. It expires in %d minutes.",
+			OnVerified:     srv.markPhoneVerified,
+		},
+		models.OTPReasonTypeVerifyEmail: {
+			Reason:         models.OTPReasonTypeVerifyEmail,
+			Destinations:   []otpDestinationKind{otpDestinationEmail},
+			Channels:       []otpChannelName{otpChannelEmail},
+			CodeLength:     6,
+			TTL:            30 * time.Minute,
+			MaxAttempts:    5,
+			AttemptWindow:  time.Hour,
+			Lockout:        15 * time.Minute,
+			ResendCooldown: time.Minute,
+			RequireAccount: true,
+			Message:        "%s is your ConnectUp code to verify your email. It expires in %d minutes.",
+			OnVerified:     srv.markEmailVerified,
+		},
+	}
+}
+
+func (policy otpPolicy) accepts(kind otpDestinationKind) bool {
+	for _, accepted := range policy.Destinations {
+		if accepted == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// failureLimit counts the wrong codes entered for a destination.
+func (policy otpPolicy) failureLimit() authLimit {
+	return authLimit{
+		Scope:   "otp_failure:" + string(policy.Reason),
+		Max:     policy.MaxAttempts,
+		Window:  policy.AttemptWindow,
+		Lockout: policy.Lockout,
+	}
+}
+
+// channel picks the channel for the destination, the requested one when it is set.
+func (policy otpPolicy) channel(requested otpChannelName, kind otpDestinationKind) (otpChannelName, error) {
+	for _, channel := range policy.Channels {
+		reaches := (channel == otpChannelEmail) == (kind == otpDestinationEmail)
+		if reaches && (requested == "" || requested == channel) {
+			return channel, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s codes cannot be sent through %s", errOTPChannelUnavailable, policy.Reason, requested)
+}
+
+type otpCode struct {
+	ID          int           `db:"id"`
+	UserID      sql.NullInt64 `db:"user_id"`
+	Destination string        `db:"destination"`
+	CodeHash    string        `db:"code_hash"`
+}
+
+// otpDestination is the first of the fields a request can name its destination with.
+func otpDestination(fields ...string) string {
+	for _, field := range fields {
+		if field != "" {
+			return field
+		}
+	}
+	return ""
+}
+
+// normalizeOTPDestination lowercases emails and strips separators from E.164 phone numbers, so
+// each destination has a single spelling.
+func normalizeOTPDestination(destination string) (string, otpDestinationKind, error) {
+	destination = strings.TrimSpace(destination)
+
+	if strings.Contains(destination, "@") {
+		address, err := mail.ParseAddress(destination)
+		if err != nil || address.Address != destination {
+			return "", "", fmt.Errorf("%w: malformed email", errOTPDestination)
+		}
+		return strings.ToLower(destination), otpDestinationEmail, nil
+	}
+
+	phone := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(phoneNumberSeparators, r) {
+			return -1
+		}
+		return r
+	}, destination)
+	if !phoneNumberPattern.MatchString(phone) {
+		return "", "", fmt.Errorf("%w: phone numbers must be in international format", errOTPDestination)
+	}
+	return phone, otpDestinationPhone, nil
+}
+
+func newOTPCode(length int) (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n.Int64()), nil
+}
+
+// hashOTP refuses to hash without OTP_HASH_SECRET, codes are neither issued nor verified then.
+func (srv *Server) hashOTP(reason models.OTPReasonType, destination, code string) (string, error) {
+	secret := srv.DynamicConfig.GetString(otpHashSecretConfig)
+	if secret == "" {
+		return "", errOTPNotConfigured
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(string(reason) + "\x00" + destination + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// lockOTPDestination serialises sends and checks of one destination until the transaction ends,
+// so concurrent requests cannot skip the cooldown or count attempts twice.
+func lockOTPDestination(tx *sqlx.Tx, reason models.OTPReasonType, destination string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "otp:"+string(reason)+":"+destination)
+	return err
+}
+
+// checkOTPRetry refuses locked out destinations and, with cooldown, destinations sent a code
+// too recently.
+func checkOTPRetry(tx *sqlx.Tx, policy otpPolicy, destination string, cooldown bool) error {
+	if err := policy.failureLimit().check(tx, destination); err != nil {
+		return err
+	}
+	if !cooldown {
+		return nil
+	}
+
+	SQL := `SELECT max(created_at) FROM otp_codes WHERE reason = $1 AND destination = $2`
+
+	var lastSentAt sql.NullTime
+	if err := tx.Get(&lastSentAt, SQL, policy.Reason, destination); err != nil {
+		return err
+	}
+	if lastSentAt.Valid {
+		if retryAt := lastSentAt.Time.Add(policy.ResendCooldown); time.Now().Before(retryAt) {
+			return retryError{Message: "please wait before requesting another code", RetryAt: retryAt}
+		}
+	}
+	return nil
+}
+
+// findOTPAccount returns the user the destination belongs to, nil when there is none.
+func (srv *Server) findOTPAccount(destination string, kind otpDestinationKind) (*int, error) {
+	SQL := `SELECT id FROM users WHERE phone = $1 AND soft_deleted_at IS NULL`
+	if kind == otpDestinationEmail {
+		SQL = `SELECT id FROM users WHERE lower(email) = $1 AND soft_deleted_at IS NULL`
+	}
+
+	var userID int
+	err := srv.PSQL.DB().Get(&userID, SQL, destination)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &userID, nil
+}
+
+// issueOTP replaces the active codes of the destination with a new one. With deliver, the code is
+// sent once the transaction storing it commits, otherwise it is only stored so the destination gets
+// the same cooldown.
+func (srv *Server) issueOTP(policy otpPolicy, destination string, channelName otpChannelName, userID *int, deliver bool) (time.Time, error) {
+	channel, err := srv.otpChannelFor(channelName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	code, err := newOTPCode(policy.CodeLength)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	codeHash, err := srv.hashOTP(policy.Reason, destination, code)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiresAt := time.Now().Add(policy.TTL)
+
+	var codeID int
+	err = srv.inTx(func(tx *sqlx.Tx) error {
+		if err := lockOTPDestination(tx, policy.Reason, destination); err != nil {
+			return err
+		}
+		if err := checkOTPRetry(tx, policy, destination, true); err != nil {
+			return err
+		}
+
+		SQL := `UPDATE otp_codes
+				SET expires_at = now()
+				WHERE reason = $1
+				  AND destination = $2
+				  AND consumed_at IS NULL
+				  AND expires_at > now()`
+
+		if _, err := tx.Exec(SQL, policy.Reason, destination); err != nil {
+			return err
+		}
+
+		SQL = `INSERT INTO otp_codes (reason, destination, channel, user_id, code_hash, expires_at)
+			   VALUES ($1, $2, $3, $4, $5, $6)
+			   RETURNING id`
+
+		return tx.Get(&codeID, SQL, policy.Reason, destination, channelName, userID, codeHash, expiresAt)
+	})
+	if err != nil || !deliver {
+		return expiresAt, err
+	}
+
+	err = srv.deliverOTP(channel, codeID, otpMessage{
+		Reason:      policy.Reason,
+		Destination: destination,
+		UserID:      userID,
+		Code:        code,
+		Text:        fmt.Sprintf(policy.Message, code, int(policy.TTL.Minutes())),
+		ExpiresAt:   expiresAt,
+	})
+	return expiresAt, err
+}
+
+// deliverOTP sends a stored code once its transaction committed, so a slow provider holds no lock.
+// A code that cannot be delivered is deleted, it does not start the cooldown, and the request fails
+// with errOTPUndelivered.
+func (srv *Server) deliverOTP(channel otpChannel, codeID int, message otpMessage) error {
+	err := channel.Send(context.Background(), message)
+	if err == nil {
+		return nil
+	}
+	logrus.Errorf("deliverOTP: unable to send %s code %d: %v", message.Reason, codeID, err)
+
+	if _, err := srv.PSQL.DB().Exec(`DELETE FROM otp_codes WHERE id = $1`, codeID); err != nil {
+		logrus.Errorf("deliverOTP: unable to delete undelivered code %d: %v", codeID, err)
+	}
+	return fmt.Errorf("%w: %v", errOTPUndelivered, err)
+}
+
+// verifyOTPCode uses the latest code of the destination when it matches and runs the OnVerified
+// step of the policy. Wrong codes count towards the lockout.
+func (srv *Server) verifyOTPCode(req *http.Request, policy otpPolicy, destination, code string) (map[string]interface{}, error) {
+	codeHash, err := srv.hashOTP(policy.Reason, destination, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]interface{}
+	var failure error
+
+	err = srv.inTx(func(tx *sqlx.Tx) error {
+		if err := lockOTPDestination(tx, policy.Reason, destination); err != nil {
+			return err
+		}
+		if err := checkOTPRetry(tx, policy, destination, false); err != nil {
+			return err
+		}
+
+		SQL := `SELECT id, user_id, destination, code_hash
+				FROM otp_codes
+				WHERE reason = $1
+				  AND destination = $2
+				  AND consumed_at IS NULL
+				  AND expires_at > now()
+				ORDER BY created_at DESC
+				LIMIT 1`
+
+		var stored otpCode
+		if err := tx.Get(&stored, SQL, policy.Reason, destination); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errOTPInvalid
+			}
+			return err
+		}
+
+		if !hmac.Equal([]byte(codeHash), []byte(stored.CodeHash)) {
+			// the attempt is kept even though the code is wrong, and counts for the destination so
+			// requesting a new code does not reset it
+			limit := policy.failureLimit()
+			if err := limit.hit(tx, destination); err != nil {
+				return err
+			}
+			failure = errOTPInvalid
+			if err := limit.check(tx, destination); err != nil {
+				var retry retryError
+				if !errors.As(err, &retry) {
+					return err
+				}
+				failure = retry
+			}
+			return nil
+		}
+
+		if _, err := tx.Exec(`UPDATE otp_codes SET consumed_at = now() WHERE id = $1`, stored.ID); err != nil {
+			return err
+		}
+
+		var err error
+		result, err = policy.OnVerified(tx, req, stored)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, failure
+}
+
+func respondOTPErr(resp http.ResponseWriter, req *http.Request, err error, message string) {
+	var retry retryError
+	switch {
+	case errors.As(err, &retry):
+		respondRetryErr(resp, req, retry)
+	case errors.Is(err, errOTPSignInRequired):
+		connectuperror.RespondClientErr(resp, req, err, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, errOTPPhoneTaken):
+		connectuperror.RespondClientErr(resp, req, err, http.StatusConflict, err.Error())
+	case errors.Is(err, errOTPUndelivered):
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadGateway, errOTPUndelivered.Error())
+	case errors.Is(err, errOTPInvalid), errors.Is(err, errOTPDestination), errors.Is(err, errOTPUnsupportedReason),
+		errors.Is(err, errOTPChannelUnavailable), errors.Is(err, errPasswordResetInvalid):
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, err.Error())
+	default:
+		connectuperror.RespondGenericServerErr(resp, req, err, message)
+	}
+}
+
+/*
+  - sendOTPCode
+  - @Description This method is used to send a one time code for a
+    reason to a phone number or email, through the channel requested
+    or the default channel of the reason. Codes for the signed in user
+    are requested through /api/user/send_otp.
+*/
+func (srv *Server) sendOTPCode(resp http.ResponseWriter, req *http.Request) {
+	var otpRequest struct {
+		Reason      models.OTPReasonType `json:"reason"`
+		Destination string               `json:"destination"`
+		Phone       string               `json:"phone"`
+		Email       string               `json:"email"`
+		Channel     otpChannelName       `json:"channel"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&otpRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	policy, ok := srv.otpPolicies()[otpRequest.Reason]
+	if !ok {
+		respondOTPErr(resp, req, errOTPUnsupportedReason, "unable to send otp")
+		return
+	}
+
+	uc := srv.getUserContext(req)
+	if policy.SignedIn && uc == nil {
+		respondOTPErr(resp, req, errOTPSignInRequired, "unable to send otp")
+		return
+	}
+
+	destination, kind, err := normalizeOTPDestination(otpDestination(otpRequest.Destination, otpRequest.Phone, otpRequest.Email))
+	if err == nil && !policy.accepts(kind) {
+		err = fmt.Errorf("%w: %s codes cannot be sent to a %s", errOTPDestination, policy.Reason, kind)
+	}
+	if err != nil {
+		respondOTPErr(resp, req, err, "unable to send otp")
+		return
+	}
+
+	channel, err := policy.channel(otpRequest.Channel, kind)
+	if err != nil {
+		respondOTPErr(resp, req, err, "unable to send otp")
+		return
+	}
+
+	var userID *int
+	if policy.SignedIn {
+		userID = &uc.ID
+	} else if userID, err = srv.findOTPAccount(destination, kind); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to send otp")
+		return
+	}
+
+	// destinations without an account go through the same checks and cooldown, nothing is sent
+	deliver := userID != nil || !policy.RequireAccount
+	if !deliver {
+		logrus.Infof("sendOTPCode: no account for %s code, nothing sent", policy.Reason)
+	}
+
+	sentAt := time.Now()
+	expiresAt, err := srv.issueOTP(policy, destination, channel, userID, deliver)
+	if err != nil {
+		respondOTPErr(resp, req, err, "unable to send otp")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message":           "success",
+		"channel":           channel,
+		"expiresAt":         expiresAt,
+		"resendAvailableAt": sentAt.Add(policy.ResendCooldown),
+	})
+}
+
+// limitOTPSends refuses clients that request too many codes, whatever the version of the route.
+func (srv *Server) limitOTPSends(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if err := otpSendLimit.take(srv.PSQL.DB(), clientIP(req)); err != nil {
+			respondOTPErr(resp, req, err, "unable to send otp")
+			return
+		}
+		next(resp, req)
+	}
+}
+
+/*
+  - verifyOTPCodeFor
+  - @Description This method is used to verify a one time code sent
+    for the reason, the response carries what the reason grants once
+    verified.
+*/
+func (srv *Server) verifyOTPCodeFor(reason models.OTPReasonType) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var verifyRequest struct {
+			Destination string `json:"destination"`
+			Phone       string `json:"phone"`
+			Email       string `json:"email"`
+			OTP         string `json:"otp"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&verifyRequest); err != nil {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+			return
+		}
+
+		policy := srv.otpPolicies()[reason]
+
+		destination, kind, err := normalizeOTPDestination(otpDestination(verifyRequest.Destination, verifyRequest.Phone, verifyRequest.Email))
+		if err == nil && !policy.accepts(kind) {
+			err = fmt.Errorf("%w: %s codes are not sent to a %s", errOTPDestination, policy.Reason, kind)
+		}
+		if err != nil {
+			respondOTPErr(resp, req, err, "unable to verify otp")
+			return
+		}
+
+		result, err := srv.verifyOTPCode(req, policy, destination, strings.TrimSpace(verifyRequest.OTP))
+		if err != nil {
+			respondOTPErr(resp, req, err, "unable to verify otp")
+			return
+		}
+
+		response := map[string]interface{}{
+			"message": "success",
+		}
+		for key, value := range result {
+			response[key] = value
+		}
+		utils.EncodeJSON200Body(resp, response)
+	}
+}
+
+// grantPasswordReset returns a reset token for the account of a verified reset_password code, it
+// is exchanged for a new password at /change_password_using_otp.
+func (srv *Server) grantPasswordReset(tx *sqlx.Tx, _ *http.Request, code otpCode) (map[string]interface{}, error) {
+	if !code.UserID.Valid {
+		return nil, errOTPInvalid
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(passwordResetTokenTTL)
+
+	SQL := `UPDATE otp_codes SET grant_hash = $2, grant_expires_at = $3 WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, code.ID, hashSecret(token), expiresAt); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"resetToken":          token,
+		"resetTokenExpiresAt": expiresAt,
+	}, nil
+}
+
+// markPhoneVerified sets the verified number as the phone of the signed in user. The code must have
+// been requested by the user, and numbers verified on another account are refused.
+func (srv *Server) markPhoneVerified(tx *sqlx.Tx, req *http.Request, code otpCode) (map[string]interface{}, error) {
+	uc := srv.getUserContext(req)
+
+	if !code.UserID.Valid || int(code.UserID.Int64) != uc.ID {
+		return nil, fmt.Errorf("%w: code was requested by another account", errOTPInvalid)
+	}
+
+	SQL := `SELECT EXISTS (SELECT 1
+			               FROM users
+			               WHERE phone = $1
+			                 AND id <> $2
+			                 AND phone_verified_at IS NOT NULL
+			                 AND soft_deleted_at IS NULL)`
+
+	var taken bool
+	if err := tx.Get(&taken, SQL, code.Destination, uc.ID); err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, errOTPPhoneTaken
+	}
+
+	SQL = `UPDATE users SET phone = $2, phone_verified_at = now() WHERE id = $1`
+
+	_, err := tx.Exec(SQL, uc.ID, code.Destination)
+	return nil, err
+}
+
+// markEmailVerified verifies the email of the signed in user, codes sent to other addresses are
+// refused.
+func (srv *Server) markEmailVerified(tx *sqlx.Tx, req *http.Request, code otpCode) (map[string]interface{}, error) {
+	uc := srv.getUserContext(req)
+
+	SQL := `UPDATE users SET email_verified_at = now() WHERE id = $1 AND lower(email) = $2`
+
+	result, err := tx.Exec(SQL, uc.ID, code.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return nil, fmt.Errorf("%w: email does not belong to the account", errOTPInvalid)
+	}
+	return nil, nil
+}
+
+/*
+  - resetPasswordUsingOTP
+  - @Description This method is used to set a new password with the
+    reset token returned when a reset_password code is verified. The
+    user is signed out of every session.
+*/
+func (srv *Server) resetPasswordUsingOTP(resp http.ResponseWriter, req *http.Request) {
+	var resetRequest struct {
+		ResetToken  string `json:"resetToken"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&resetRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	if resetRequest.NewPassword == "" {
+		connectuperror.RespondClientErr(resp, req, errors.New("new password is required"), http.StatusBadRequest, "new password is required")
+		return
+	}
+
+	var account struct {
+		ID     int    `db:"id"`
+		AuthID string `db:"auth_id"`
+	}
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		SQL := `UPDATE otp_codes o
+				SET grant_used_at = now()
+				FROM users u
+				WHERE o.grant_hash = $1
+				  AND o.reason = $2
+				  AND o.grant_used_at IS NULL
+				  AND o.grant_expires_at > now()
+				  AND u.id = o.user_id
+				  AND u.soft_deleted_at IS NULL
+				RETURNING u.id, u.auth_id`
+
+		if err := tx.Get(&account, SQL, hashSecret(resetRequest.ResetToken), models.OTPReasonTypeResetPassword); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errPasswordResetInvalid
+			}
+			return err
+		}
+
+		// changed before the token use is committed, a failure leaves the token usable
+		return srv.DBHelper.ChangeUserPassword(&models.UserContext{ID: account.ID, AuthID: account.AuthID},
+			models.ChangePassword{NewPassword: resetRequest.NewPassword})
+	})
+	if err != nil {
+		respondOTPErr(resp, req, err, "unable to update password")
+		return
+	}
+
+	if err := srv.DBHelper.EndSessionOfUserByAdmin(account.ID, account.AuthID); err != nil {
+		logrus.Errorf("resetPasswordUsingOTP: unable to end sessions of user %d: %v", account.ID, err)
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
+
+// purgeOTPCodes deletes old codes that no longer grant a password reset.
+func (srv *Server) purgeOTPCodes(_ context.Context) error {
+	SQL := `DELETE
+			FROM otp_codes
+			WHERE created_at < $1
+			  AND (grant_expires_at IS NULL OR grant_expires_at < now())`
+
+	_, err := srv.PSQL.DB().Exec(SQL, time.Now().Add(-otpRetention))
+	return err
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/env"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// otpDeliveryConfig set to "log" only logs codes instead of sending them. Outside the cluster
+	// codes are always logged.
+	otpDeliveryConfig = "OTP_DELIVERY"
+	otpDeliveryLog    = "log"
+
+	twilioAccountSIDConfig = "TWILIO_ACCOUNT_SID"
+	twilioAuthTokenConfig  = "TWILIO_AUTH_TOKEN"
+	// otpSMSFromConfig and otpWhatsAppFromConfig are the sender numbers of the codes, in E.164.
+	otpSMSFromConfig      = "OTP_SMS_FROM"
+	otpWhatsAppFromConfig = "OTP_WHATSAPP_FROM"
+
+	twilioMessagesURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+
+	otpDeliveryTimeout = 10 * time.Second
+
+	emailTypeOTP models.EmailType = "otp"
+)
+
+type otpChannelName string
+
+const (
+	otpChannelSMS      otpChannelName = "sms"
+	otpChannelWhatsApp otpChannelName = "whatsapp"
+	otpChannelEmail    otpChannelName = "email"
+)
+
+var errOTPChannelUnavailable = errors.New("otp channel is not available")
+
+// otpMessage is a code to deliver. UserID is only set when the destination belongs to an account.
+type otpMessage struct {
+	Reason      models.OTPReasonType
+	Destination string
+	UserID      *int
+	Code        string
+	Text        string
+	ExpiresAt   time.Time
+}
+
+// otpChannel delivers codes to a destination.
+type otpChannel interface {
+	Send(ctx context.Context, message otpMessage) error
+}
+
+// otpChannelFor returns the channel delivering codes through name.
+func (srv *Server) otpChannelFor(name otpChannelName) (otpChannel, error) {
+	if !env.InKubeCluster() || srv.DynamicConfig.GetString(otpDeliveryConfig) == otpDeliveryLog {
+		return logOTPChannel{channel: name}, nil
+	}
+
+	switch name {
+	case otpChannelSMS:
+		return srv.twilioOTPChannel(srv.DynamicConfig.GetString(otpSMSFromConfig), "")
+	case otpChannelWhatsApp:
+		return srv.twilioOTPChannel(srv.DynamicConfig.GetString(otpWhatsAppFromConfig), "whatsapp:")
+	case otpChannelEmail:
+		return emailOTPChannel{srv: srv}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errOTPChannelUnavailable, name)
+}
+
+func (srv *Server) twilioOTPChannel(from, addressPrefix string) (otpChannel, error) {
+	channel := twilioOTPChannel{
+		accountSID:    srv.DynamicConfig.GetString(twilioAccountSIDConfig),
+		authToken:     srv.DynamicConfig.GetString(twilioAuthTokenConfig),
+		from:          from,
+		addressPrefix: addressPrefix,
+	}
+	if channel.accountSID == "" || channel.authToken == "" || channel.from == "" {
+		return nil, errors.New("twilio is not configured")
+	}
+	return channel, nil
+}
+
+// twilioOTPChannel sends codes through the Twilio messages API, as SMS or, with the whatsapp:
+// address prefix, as WhatsApp messages.
+type twilioOTPChannel struct {
+	accountSID    string
+	authToken     string
+	from          string
+	addressPrefix string
+}
+
+func (c twilioOTPChannel) Send(ctx context.Context, message otpMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, otpDeliveryTimeout)
+	defer cancel()
+
+	form := url.Values{
+		"To":   {c.addressPrefix + message.Destination},
+		"From": {c.addressPrefix + c.from},
+		"Body": {message.Text},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(twilioMessagesURL, c.accountSID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.accountSID, c.authToken)
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logrus.Errorf("twilioOTPChannel: unable to close response %v", err)
+		}
+	}()
+
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("twilio responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// emailOTPChannel sends codes with the otp email template, which is addressed by user, so only
+// destinations belonging to an account can be reached.
+type emailOTPChannel struct {
+	srv *Server
+}
+
+func (c emailOTPChannel) Send(_ context.Context, message otpMessage) error {
+	if message.UserID == nil {
+		return fmt.Errorf("%w: email codes are only sent to registered addresses", errOTPChannelUnavailable)
+	}
+
+	emailTemplate, err := c.srv.EmailProvider.GetEmailTemplate(emailTypeOTP, []int{*message.UserID})
+	if err != nil {
+		return err
+	}
+	emailTemplate.DynamicData["otp"] = message.Code
+	emailTemplate.DynamicData["reason"] = string(message.Reason)
+	emailTemplate.DynamicData["expiresAt"] = message.ExpiresAt.Format(time.RFC1123)
+	return c.srv.EmailProvider.Send(emailTemplate)
+}
+
+// logOTPChannel only logs codes, for local development.
+type logOTPChannel struct {
+	channel otpChannelName
+}
+
+func (c logOTPChannel) Send(_ context.Context, message otpMessage) error {
+	logrus.Infof("otp: %s code %s for %s through %s", message.Reason, message.Code, message.Destination, c.channel)
+	return nil
+}
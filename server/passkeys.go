@@ -0,0 +1,526 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const webauthnTimeout = int(webauthnChallengeTTL / time.Millisecond)
+
+type publicKeyCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type publicKeyCredentialDescriptor struct {
+	Type       string         `json:"type"`
+	ID         base64URLBytes `json:"id"`
+	Transports []string       `json:"transports,omitempty"`
+}
+
+// passkeyCreationOptions is passed as is to navigator.credentials.create and the platform APIs.
+type passkeyCreationOptions struct {
+	Challenge base64URLBytes `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          base64URLBytes `json:"id"`
+		Name        string         `json:"name"`
+		DisplayName string         `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []publicKeyCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int                             `json:"timeout"`
+	ExcludeCredentials     []publicKeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// passkeyRequestOptions is passed as is to navigator.credentials.get. Passkeys are discoverable so
+// no credentials are listed, the authenticator offers the ones it holds for the relying party.
+type passkeyRequestOptions struct {
+	Challenge        base64URLBytes                  `json:"challenge"`
+	RPID             string                          `json:"rpId"`
+	Timeout          int                             `json:"timeout"`
+	UserVerification string                          `json:"userVerification"`
+	AllowCredentials []publicKeyCredentialDescriptor `json:"allowCredentials"`
+}
+
+// registrationCredential and assertionCredential are the JSON of the PublicKeyCredential returned
+// by the browser or platform API.
+type registrationCredential struct {
+	ID       string         `json:"id"`
+	RawID    base64URLBytes `json:"rawId"`
+	Type     string         `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URLBytes `json:"clientDataJSON"`
+		AttestationObject base64URLBytes `json:"attestationObject"`
+		Transports        []string       `json:"transports"`
+	} `json:"response"`
+}
+
+type assertionCredential struct {
+	ID       string         `json:"id"`
+	RawID    base64URLBytes `json:"rawId"`
+	Type     string         `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URLBytes `json:"clientDataJSON"`
+		AuthenticatorData base64URLBytes `json:"authenticatorData"`
+		Signature         base64URLBytes `json:"signature"`
+		UserHandle        base64URLBytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+type passkey struct {
+	ID         int            `json:"id" db:"id"`
+	Name       string         `json:"name" db:"name"`
+	Transports pq.StringArray `json:"transports" db:"transports"`
+	CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+	LastUsedAt *time.Time     `json:"lastUsedAt" db:"last_used_at"`
+}
+
+// webauthnUserHandle returns the random handle identifying the user to authenticators, it is the
+// same for every passkey of the user and reveals nothing about them.
+func (srv *Server) webauthnUserHandle(userID int) ([]byte, error) {
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+
+	SQL := `WITH inserted AS (
+			    INSERT INTO webauthn_user_handles (user_id, handle)
+			    VALUES ($1, $2)
+			    ON CONFLICT (user_id) DO NOTHING
+			    RETURNING handle)
+			SELECT handle FROM inserted
+			UNION ALL
+			SELECT handle FROM webauthn_user_handles WHERE user_id = $1`
+
+	var stored []byte
+	err := srv.PSQL.DB().Get(&stored, SQL, userID, handle)
+	return stored, err
+}
+
+/*
+  - getPasskeys
+  - @Description This method is used to list the passkeys of the
+    user with the date they were last used.
+*/
+func (srv *Server) getPasskeys(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	SQL := `SELECT id, name, transports, created_at, last_used_at
+			FROM user_passkeys
+			WHERE user_id = $1
+			ORDER BY created_at`
+
+	passkeys := make([]passkey, 0)
+	if err := srv.PSQL.DB().Select(&passkeys, SQL, uc.ID); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get passkeys")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, passkeys)
+}
+
+/*
+  - passkeyRegistrationOptions
+  - @Description This method is used to start registering a passkey.
+    It returns the options to create the credential with, the passkeys
+    the user already has are excluded.
+*/
+func (srv *Server) passkeyRegistrationOptions(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	userInfo, err := srv.DBHelper.GetUserInfo(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "error in getting user info")
+		return
+	}
+
+	handle, err := srv.webauthnUserHandle(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create passkey options")
+		return
+	}
+
+	SQL := `SELECT credential_id, transports FROM user_passkeys WHERE user_id = $1`
+
+	existing := make([]struct {
+		CredentialID []byte         `db:"credential_id"`
+		Transports   pq.StringArray `db:"transports"`
+	}, 0)
+	if err := srv.PSQL.DB().Select(&existing, SQL, uc.ID); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create passkey options")
+		return
+	}
+
+	challenge, err := srv.newWebauthnChallenge(webauthnChallengeRegistration, &uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create passkey options")
+		return
+	}
+
+	rp := srv.webauthnRelyingParty()
+
+	var options passkeyCreationOptions
+	options.Challenge = challenge
+	options.RP.ID = rp.ID
+	options.RP.Name = rp.Name
+	options.User.ID = handle
+	options.User.Name = userInfo.Email.String
+	if options.User.Name == "" {
+		options.User.Name = userInfo.Name
+	}
+	options.User.DisplayName = userInfo.Name
+	for _, alg := range []int{coseAlgES256, coseAlgRS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, publicKeyCredentialParameters{Type: "public-key", Alg: alg})
+	}
+	options.Timeout = webauthnTimeout
+	options.ExcludeCredentials = make([]publicKeyCredentialDescriptor, 0, len(existing))
+	for _, credential := range existing {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, publicKeyCredentialDescriptor{
+			Type:       "public-key",
+			ID:         credential.CredentialID,
+			Transports: credential.Transports,
+		})
+	}
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.UserVerification = "required"
+	options.Attestation = "none"
+
+	utils.EncodeJSON200Body(resp, options)
+}
+
+/*
+  - registerPasskey
+  - @Description This method is used to finish registering a passkey
+    with the credential created from the registration options.
+*/
+func (srv *Server) registerPasskey(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var registerRequest struct {
+		Name       string                 `json:"name"`
+		Credential registrationCredential `json:"credential"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&registerRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	if registerRequest.Name == "" {
+		registerRequest.Name = "Passkey"
+	}
+
+	var registered passkey
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		var err error
+		registered, err = srv.verifyPasskeyRegistration(tx, uc.ID, registerRequest.Name, registerRequest.Credential)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errWebauthnInvalid) {
+			logrus.Warnf("registerPasskey: user %d: %v", uc.ID, err)
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, errWebauthnInvalid.Error())
+			return
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusConflict, "passkey already registered")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to register passkey")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, registered)
+}
+
+// verifyPasskeyRegistration verifies the created credential and stores its public key.
+func (srv *Server) verifyPasskeyRegistration(tx *sqlx.Tx, userID int, name string, credential registrationCredential) (passkey, error) {
+	clientData, authData, alg, err := srv.webauthnRelyingParty().verifyRegistration(credential)
+	if err != nil {
+		return passkey{}, err
+	}
+
+	challengeUserID, err := consumeWebauthnChallenge(tx, clientData.Challenge, webauthnChallengeRegistration)
+	if err != nil {
+		return passkey{}, err
+	}
+	if int(challengeUserID.Int64) != userID {
+		return passkey{}, fmt.Errorf("%w: challenge of another user", errWebauthnInvalid)
+	}
+
+	SQL := `INSERT INTO user_passkeys (user_id, credential_id, public_key, algorithm, sign_count, aaguid, transports, name)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id, name, transports, created_at, last_used_at`
+
+	var registered passkey
+	err = tx.Get(&registered, SQL, userID, authData.CredentialID, authData.PublicKey, alg, authData.SignCount,
+		authData.AAGUID, pq.StringArray(credential.Response.Transports), name)
+	return registered, err
+}
+
+// verifyRegistration checks the created credential was made for the relying party and returns its
+// client data, authenticator data and key algorithm. The attestation statement is not checked,
+// attestation "none" is requested.
+func (rp webauthnRelyingParty) verifyRegistration(credential registrationCredential) (collectedClientData, authenticatorData, int64, error) {
+	clientData, err := rp.verifyClientData(credential.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return clientData, authenticatorData{}, 0, err
+	}
+
+	decoded, _, err := decodeCBOR(credential.Response.AttestationObject)
+	if err != nil {
+		return clientData, authenticatorData{}, 0, fmt.Errorf("%w: attestation object: %v", errWebauthnInvalid, err)
+	}
+	attestation, _ := decoded.(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return clientData, authenticatorData{}, 0, err
+	}
+	if err := rp.verifyRelyingParty(authData); err != nil {
+		return clientData, authenticatorData{}, 0, err
+	}
+	if authData.CredentialID == nil || !bytes.Equal(authData.CredentialID, credential.RawID) {
+		return clientData, authenticatorData{}, 0, fmt.Errorf("%w: credential id mismatch", errWebauthnInvalid)
+	}
+
+	alg, _, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return clientData, authenticatorData{}, 0, err
+	}
+	return clientData, authData, alg, nil
+}
+
+/*
+  - deletePasskey
+  - @Description This method is used to remove one of the passkeys of
+    the user.
+*/
+func (srv *Server) deletePasskey(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	passkeyID, err := strconv.Atoi(chi.URLParam(req, "passkeyID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing passkeyId")
+		return
+	}
+
+	SQL := `DELETE FROM user_passkeys WHERE id = $1 AND user_id = $2`
+
+	result, err := srv.PSQL.DB().Exec(SQL, passkeyID, uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to delete passkey")
+		return
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("passkey not found"), http.StatusNotFound, "passkey not found")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
+
+/*
+  - passkeyLoginOptions
+  - @Description This method is used to start signing in with a
+    passkey. It returns the options to get the assertion with, each
+    client ip gets a limited number of them.
+*/
+func (srv *Server) passkeyLoginOptions(resp http.ResponseWriter, req *http.Request) {
+	if err := passkeyLoginOptionsLimit.take(srv.PSQL.DB(), clientIP(req)); err != nil {
+		var retry retryError
+		if errors.As(err, &retry) {
+			respondRetryErr(resp, req, retry)
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create passkey options")
+		return
+	}
+
+	challenge, err := srv.newWebauthnChallenge(webauthnChallengeLogin, nil)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create passkey options")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, passkeyRequestOptions{
+		Challenge:        challenge,
+		RPID:             srv.webauthnRelyingParty().ID,
+		Timeout:          webauthnTimeout,
+		UserVerification: "required",
+		AllowCredentials: make([]publicKeyCredentialDescriptor, 0),
+	})
+}
+
+/*
+  - loginWithPasskey
+  - @Description This method is used to sign in with a passkey. The
+    assertion is verified and a session is started like createUserSession
+    does for password logins.
+*/
+func (srv *Server) loginWithPasskey(resp http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+
+	var loginRequest struct {
+		Credential assertionCredential         `json:"credential"`
+		Session    models.CreateSessionRequest `json:"session"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&loginRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	var userID int
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		var err error
+		userID, err = srv.verifyPasskeyAssertion(tx, loginRequest.Credential)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errWebauthnInvalid) {
+			logrus.Warnf("loginWithPasskey: %v", err)
+			connectuperror.RespondClientErr(resp, req, err, http.StatusUnauthorized, errWebauthnInvalid.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to sign in with passkey")
+		return
+	}
+
+	createSessionRequest := loginRequest.Session
+	if createSessionRequest.Platform == "android" || createSessionRequest.Platform == "ios" {
+		isValid, err := srv.DBHelper.CheckIfSessionAlreadyRunning(&createSessionRequest)
+		if err != nil {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "failed to check session is valid")
+			return
+		}
+
+		if !isValid {
+			connectuperror.RespondClientErr(resp, req, errors.New("not valid"), http.StatusBadRequest, "Another session is running on this device")
+			return
+		}
+	}
+
+	authID, err := srv.DBHelper.GetAuthTokenByID(userID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get auth token by id")
+		return
+	}
+
+	createSessionRequest.AuthID = authID
+	newSessionToken, err := srv.DBHelper.StartNewSession(userID, &createSessionRequest)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "failed to create new session")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, newSessionToken)
+	logrus.Infof("loginWithPasskey: request time for passkey login: %d", time.Since(startTime).Milliseconds())
+}
+
+// verifyPasskeyAssertion verifies the assertion against the stored passkey and returns its user.
+func (srv *Server) verifyPasskeyAssertion(tx *sqlx.Tx, credential assertionCredential) (int, error) {
+	rp := srv.webauthnRelyingParty()
+
+	clientData, err := rp.verifyClientData(credential.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := consumeWebauthnChallenge(tx, clientData.Challenge, webauthnChallengeLogin); err != nil {
+		return 0, err
+	}
+
+	// soft deleted users cannot sign in
+	SQL := `SELECT p.id, p.user_id, p.public_key, p.sign_count, h.handle
+			FROM user_passkeys p
+			         JOIN users u ON u.id = p.user_id
+			         JOIN webauthn_user_handles h ON h.user_id = p.user_id
+			WHERE p.credential_id = $1
+			  AND u.soft_deleted_at IS NULL
+			FOR UPDATE OF p`
+
+	var stored struct {
+		ID        int    `db:"id"`
+		UserID    int    `db:"user_id"`
+		PublicKey []byte `db:"public_key"`
+		SignCount int64  `db:"sign_count"`
+		Handle    []byte `db:"handle"`
+	}
+	if err := tx.Get(&stored, SQL, []byte(credential.RawID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%w: unknown credential %s", errWebauthnInvalid, base64.RawURLEncoding.EncodeToString(credential.RawID))
+		}
+		return 0, err
+	}
+
+	if len(credential.Response.UserHandle) > 0 && !bytes.Equal(credential.Response.UserHandle, stored.Handle) {
+		return 0, fmt.Errorf("%w: user handle mismatch", errWebauthnInvalid)
+	}
+
+	authData, err := rp.verifyAssertion(credential, stored.PublicKey, stored.SignCount)
+	if err != nil {
+		return 0, err
+	}
+
+	SQL = `UPDATE user_passkeys
+			SET sign_count   = $2,
+			    last_used_at = now()
+			WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, stored.ID, int64(authData.SignCount)); err != nil {
+		return 0, err
+	}
+	return stored.UserID, nil
+}
+
+// verifyAssertion checks the assertion was signed for the relying party by the stored public key
+// and returns its authenticator data. A signature counter that does not increase means the passkey
+// was cloned, it is refused.
+func (rp webauthnRelyingParty) verifyAssertion(credential assertionCredential, publicKey []byte, signCount int64) (authenticatorData, error) {
+	authData, err := parseAuthenticatorData(credential.Response.AuthenticatorData)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	if err := rp.verifyRelyingParty(authData); err != nil {
+		return authenticatorData{}, err
+	}
+
+	err = verifyAssertionSignature(publicKey, credential.Response.AuthenticatorData,
+		credential.Response.ClientDataJSON, credential.Response.Signature)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	// authenticators that do not count signatures always report zero
+	if (authData.SignCount != 0 || signCount != 0) && int64(authData.SignCount) <= signCount {
+		return authenticatorData{}, fmt.Errorf("%w: signature counter did not increase, the passkey may be cloned", errWebauthnInvalid)
+	}
+	return authData, nil
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	passwordMinLengthConfig = "PASSWORD_MIN_LENGTH"
+	passwordMaxLengthConfig = "PASSWORD_MAX_LENGTH"
+	// passwordMinScoreConfig is the lowest strength score from 0 to 4 accepted for a new password.
+	passwordMinScoreConfig = "PASSWORD_MIN_SCORE"
+
+	// breachedPasswordsDirConfig is a directory of the Have I Been Pwned range files, one
+	// <first 5 hex of the SHA-1>.txt file per prefix holding SUFFIX:COUNT lines, as written by the
+	// haveibeenpwned-downloader. Only the prefix of a password picks the file read, so the list
+	// can also be mounted from a shared volume. Breached checks are skipped when it is not set.
+	breachedPasswordsDirConfig = "BREACHED_PASSWORDS_DIR"
+
+	defaultPasswordMinLength = 8
+	// bcrypt ignores everything after 72 bytes
+	defaultPasswordMaxLength = 72
+	defaultPasswordMinScore  = 2
+
+	maxPasswordRequestSize = 1 << 20
+)
+
+const (
+	passwordViolationTooShort  = "too_short"
+	passwordViolationTooLong   = "too_long"
+	passwordViolationTooWeak   = "too_weak"
+	passwordViolationBreached  = "breached"
+	passwordViolationSameAsOld = "same_as_old"
+)
+
+// passwordFields are the request fields holding the new password, passwordUserInputFields the
+// ones a password should not be guessable from.
+var (
+	passwordFields          = []string{"password", "newPassword"}
+	passwordUserInputFields = []string{"email", "name", "phone", "userName"}
+)
+
+type passwordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type passwordPolicy struct {
+	MinLength   int
+	MaxLength   int
+	MinScore    int
+	BreachedDir string
+}
+
+func (srv *Server) passwordPolicy() passwordPolicy {
+	policy := passwordPolicy{
+		MinLength:   srv.DynamicConfig.GetInt(passwordMinLengthConfig),
+		MaxLength:   srv.DynamicConfig.GetInt(passwordMaxLengthConfig),
+		MinScore:    defaultPasswordMinScore,
+		BreachedDir: srv.DynamicConfig.GetString(breachedPasswordsDirConfig),
+	}
+	if policy.MinLength <= 0 {
+		policy.MinLength = defaultPasswordMinLength
+	}
+	if policy.MaxLength <= 0 {
+		policy.MaxLength = defaultPasswordMaxLength
+	}
+	// 0 accepts any strength, only an unset or invalid score falls back to the default
+	minScore, err := strconv.Atoi(strings.TrimSpace(srv.DynamicConfig.GetString(passwordMinScoreConfig)))
+	if err == nil && minScore >= 0 && minScore <= 4 {
+		policy.MinScore = minScore
+	}
+	return policy
+}
+
+// check returns every rule the password breaks and its estimated strength.
+func (policy passwordPolicy) check(password string, userInputs []string) ([]passwordViolation, passwordStrength) {
+	violations := make([]passwordViolation, 0)
+
+	if length := utf8.RuneCountInString(password); length < policy.MinLength {
+		violations = append(violations, passwordViolation{
+			Code:    passwordViolationTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters long", policy.MinLength),
+		})
+	} else if len(password) > policy.MaxLength {
+		violations = append(violations, passwordViolation{
+			Code:    passwordViolationTooLong,
+			Message: fmt.Sprintf("password must be at most %d bytes long", policy.MaxLength),
+		})
+	}
+
+	strength := estimatePasswordStrength(password, userInputs)
+	if strength.Score < policy.MinScore {
+		violations = append(violations, passwordViolation{
+			Code:    passwordViolationTooWeak,
+			Message: "password is too easy to guess" + describePasswordPatterns(strength.Patterns),
+		})
+	}
+
+	if policy.BreachedDir != "" {
+		breached, err := isBreachedPassword(policy.BreachedDir, password)
+		if err != nil {
+			// a missing or broken list must not stop users from setting passwords
+			logrus.Errorf("passwordPolicy: error checking breached passwords %v", err)
+		} else if breached {
+			violations = append(violations, passwordViolation{
+				Code:    passwordViolationBreached,
+				Message: "password has appeared in a data breach, choose another one",
+			})
+		}
+	}
+	return violations, strength
+}
+
+func describePasswordPatterns(patterns []passwordPattern) string {
+	descriptions := map[passwordPattern]string{
+		passwordPatternDictionary: "a common password",
+		passwordPatternUserInput:  "your personal information",
+		passwordPatternKeyboard:   "a keyboard pattern",
+		passwordPatternSequence:   "a sequence",
+		passwordPatternRepeat:     "repeated characters",
+		passwordPatternYear:       "a year",
+	}
+
+	found := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if description, ok := descriptions[pattern]; ok {
+			found = append(found, description)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	return ", avoid " + strings.Join(found, ", ")
+}
+
+// isBreachedPassword looks the SHA-1 of the password up in the range file of its prefix.
+func isBreachedPassword(dir, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineSuffix, count, _ := strings.Cut(line, ":")
+		// padding entries of the range API have a count of 0
+		if strings.EqualFold(lineSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// respondPasswordRejected answers 400 with every reason the password was refused for, so clients
+// can show them all at once.
+func respondPasswordRejected(resp http.ResponseWriter, req *http.Request, violations []passwordViolation, strength passwordStrength) {
+	logrus.Infof("%s %s: password rejected %v", req.Method, req.URL.Path, violations)
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(resp).Encode(map[string]interface{}{
+		"message":  violations[0].Message,
+		"reasons":  violations,
+		"strength": strength,
+	}); err != nil {
+		logrus.Errorf("respondPasswordRejected: error encoding response %v", err)
+	}
+}
+
+/*
+  - withPasswordPolicy
+  - @Description This method is used to check the password of requests
+    to handlers that set a new password, before they are served.
+    Requests without a password are passed on for the handler to reject.
+*/
+func (srv *Server) withPasswordPolicy(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxPasswordRequestSize))
+		if err != nil {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error reading request")
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			next(resp, req)
+			return
+		}
+
+		password := ""
+		for _, field := range passwordFields {
+			if value, _ := fields[field].(string); value != "" {
+				password = value
+				break
+			}
+		}
+		if password == "" {
+			next(resp, req)
+			return
+		}
+
+		userInputs := make([]string, 0, len(passwordUserInputFields))
+		for _, field := range passwordUserInputFields {
+			if value, _ := fields[field].(string); value != "" {
+				userInputs = append(userInputs, value)
+			}
+		}
+
+		if violations, strength := srv.passwordPolicy().check(password, userInputs); len(violations) > 0 {
+			respondPasswordRejected(resp, req, violations, strength)
+			return
+		}
+		next(resp, req)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// password_strength.go estimates how many guesses an attacker needs for a password in the way of
+// zxcvbn: the password is split into the cheapest sequence of known patterns (common passwords,
+// the user's own details, keyboard walks, sequences, repeats and years) and brute forced characters,
+// and the guesses of every part are multiplied. The score follows the zxcvbn thresholds.
+
+type passwordPattern string
+
+const (
+	passwordPatternDictionary passwordPattern = "common_password"
+	passwordPatternUserInput  passwordPattern = "personal_information"
+	passwordPatternKeyboard   passwordPattern = "keyboard_pattern"
+	passwordPatternSequence   passwordPattern = "sequence"
+	passwordPatternRepeat     passwordPattern = "repeat"
+	passwordPatternYear       passwordPattern = "year"
+	passwordPatternBruteForce passwordPattern = "bruteforce"
+
+	// bruteForceGuessesPerChar is the cost zxcvbn gives to a character that matches no pattern.
+	bruteForceGuessesPerChar = 10
+
+	minPatternLength = 3
+)
+
+// commonPasswords are ranked by frequency, a match costs its rank in guesses.
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111", "1234567",
+	"dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein", "696969", "shadow",
+	"master", "666666", "qwertyuiop", "123321", "mustang", "1234567890", "michael", "654321", "superman",
+	"1qaz2wsx", "7777777", "121212", "000000", "qazwsx", "123qwe", "killer", "trustno1", "jordan",
+	"jennifer", "zxcvbnm", "asdfgh", "hunter", "buster", "soccer", "harley", "batman", "andrew",
+	"tigger", "sunshine", "iloveyou", "2000", "charlie", "robert", "thomas", "hockey", "ranger",
+	"daniel", "starwars", "klaster", "112233", "george", "computer", "michelle", "jessica", "pepper",
+	"1111", "zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie", "159753",
+	"aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer", "love", "ashley", "nicole",
+	"chelsea", "biteme", "matthew", "access", "yankees", "987654321", "dallas", "austin", "thunder",
+	"taylor", "matrix", "welcome", "admin", "login", "passw0rd", "secret", "connectup", "changeme",
+}
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p", "!@#$%^&*()_+",
+}
+
+var leetSubstitutions = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+type passwordMatch struct {
+	start, end int
+	pattern    passwordPattern
+	guesses    float64
+}
+
+type passwordStrength struct {
+	Score    int               `json:"score"`
+	Guesses  float64           `json:"guesses"`
+	Patterns []passwordPattern `json:"patterns"`
+}
+
+// estimatePasswordStrength scores the password from 0 to 4. userInputs are the user's own details,
+// email and name for instance, that an attacker would try first.
+func estimatePasswordStrength(password string, userInputs []string) passwordStrength {
+	runes := []rune(password)
+	matches := findPasswordMatches(runes, userInputs)
+
+	// minimum guesses to reach every position, like the zxcvbn dynamic programming without the
+	// factorial term for the number of patterns
+	best := make([]float64, len(runes)+1)
+	via := make([]*passwordMatch, len(runes)+1)
+	best[0] = 1
+	for i := 1; i <= len(runes); i++ {
+		best[i] = best[i-1] * bruteForceGuessesPerChar
+
+		for m := range matches {
+			match := &matches[m]
+			if match.end != i {
+				continue
+			}
+			if guesses := match.guesses * best[match.start]; guesses < best[i] {
+				best[i] = guesses
+				via[i] = match
+			}
+		}
+	}
+
+	strength := passwordStrength{Guesses: best[len(runes)], Patterns: make([]passwordPattern, 0)}
+
+	seen := make(map[passwordPattern]bool)
+	for i := len(runes); i > 0; {
+		match := via[i]
+		if match == nil {
+			match = &passwordMatch{start: i - 1, end: i, pattern: passwordPatternBruteForce}
+		}
+		if !seen[match.pattern] {
+			seen[match.pattern] = true
+			strength.Patterns = append(strength.Patterns, match.pattern)
+		}
+		i = match.start
+	}
+	// found from the end, listed in the order they appear
+	for i, j := 0, len(strength.Patterns)-1; i < j; i, j = i+1, j-1 {
+		strength.Patterns[i], strength.Patterns[j] = strength.Patterns[j], strength.Patterns[i]
+	}
+
+	switch exponent := math.Log10(strength.Guesses); {
+	case exponent < 3:
+		strength.Score = 0
+	case exponent < 6:
+		strength.Score = 1
+	case exponent < 8:
+		strength.Score = 2
+	case exponent < 10:
+		strength.Score = 3
+	default:
+		strength.Score = 4
+	}
+	return strength
+}
+
+func findPasswordMatches(runes []rune, userInputs []string) []passwordMatch {
+	lower := []rune(strings.ToLower(string(runes)))
+	unleeted := []rune(leetSubstitutions.Replace(string(lower)))
+
+	matches := make([]passwordMatch, 0)
+
+	dictionary := make(map[string]float64, len(commonPasswords))
+	for rank, word := range commonPasswords {
+		dictionary[word] = float64(rank + 1)
+	}
+
+	personal := make(map[string]bool)
+	for _, input := range userInputs {
+		for _, part := range strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len([]rune(part)) >= minPatternLength {
+				personal[part] = true
+			}
+		}
+	}
+
+	for start := 0; start < len(runes); start++ {
+		for end := start + minPatternLength; end <= len(runes); end++ {
+			for i, word := range []string{string(lower[start:end]), string(unleeted[start:end])} {
+				variations := caseVariations(runes[start:end])
+				if i == 1 {
+					if word == string(lower[start:end]) {
+						continue
+					}
+					// substitutions like 4 for a are tried by every cracker
+					variations *= 2
+				}
+
+				if rank, ok := dictionary[word]; ok {
+					matches = append(matches, passwordMatch{start, end, passwordPatternDictionary, rank * variations})
+				}
+				if personal[word] {
+					matches = append(matches, passwordMatch{start, end, passwordPatternUserInput, variations})
+				}
+			}
+
+			segment := lower[start:end]
+			if isKeyboardWalk(segment) {
+				matches = append(matches, passwordMatch{start, end, passwordPatternKeyboard, 50 * float64(len(segment))})
+			}
+			if isSequence(segment) {
+				matches = append(matches, passwordMatch{start, end, passwordPatternSequence, 20 * float64(len(segment))})
+			}
+			if isRepeat(segment) {
+				matches = append(matches, passwordMatch{start, end, passwordPatternRepeat, bruteForceGuessesPerChar * float64(len(segment))})
+			}
+		}
+
+		if start+4 <= len(runes) && isYear(string(runes[start:start+4])) {
+			matches = append(matches, passwordMatch{start, start + 4, passwordPatternYear, 120})
+		}
+	}
+	return matches
+}
+
+// caseVariations counts the capitalisations an attacker tries for a word, lowercase, capitalised
+// and uppercase words are cheap.
+func caseVariations(word []rune) float64 {
+	var upper int
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(word) || (upper == 1 && unicode.IsUpper(word[0])):
+		return 2
+	}
+	return math.Pow(2, float64(upper))
+}
+
+func isKeyboardWalk(segment []rune) bool {
+	if len(segment) < 4 {
+		return false
+	}
+	word := string(segment)
+	for _, row := range keyboardRows {
+		if strings.Contains(row, word) || strings.Contains(reverseString(row), word) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSequence(segment []rune) bool {
+	step := segment[1] - segment[0]
+	if step != 1 && step != -1 {
+		return false
+	}
+	for i := 2; i < len(segment); i++ {
+		if segment[i]-segment[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+func isRepeat(segment []rune) bool {
+	for _, r := range segment[1:] {
+		if r != segment[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func isYear(value string) bool {
+	return (strings.HasPrefix(value, "19") || strings.HasPrefix(value, "20")) &&
+		strings.IndexFunc(value, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+}
+
+func reverseString(value string) string {
+	runes := []rune(value)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -12,6 +12,7 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 		docs.Get("/*", httpSwagger.Handler())
 	})
 	r.Get(`/health`, srv.HealthCheck)
+	r.Get("/files/*", srv.serveLocalFile)
 
 	r.Route("/api", func(api chi.Router) {
 		api.Use(srv.Middlewares.APITimeMiddleware()...)
@@ -20,20 +21,26 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 		// api.Use(srv.Middlewares.RequestResponseLoggerMiddleware()...)
 		api.Get(`/health`, srv.HealthCheck)
 		api.Route("/", func(public chi.Router) {
-			public.Post("/register", srv.createNewUser)
-			public.Post("/register_v3", srv.createNewUserV3)
-			public.Post("/login", srv.login)
-			public.Post("/login_v2", srv.loginV2)
-			public.Post("/login_v3", srv.loginV3)
+			public.Route("/auth", func(auth chi.Router) {
+				auth.Post("/register", srv.negotiateAuthVersion(authEndpointRegister))
+				auth.Post("/login", srv.negotiateAuthVersion(authEndpointLogin))
+			})
+			public.Post("/register", srv.legacyAuthRoute(authEndpointRegister, 1))
+			public.Post("/register_v3", srv.legacyAuthRoute(authEndpointRegister, 3))
+			public.Post("/login", srv.legacyAuthRoute(authEndpointLogin, 1))
+			public.Post("/login_v2", srv.legacyAuthRoute(authEndpointLogin, 2))
+			public.Post("/login_v3", srv.legacyAuthRoute(authEndpointLogin, 3))
 			// public.Post("/reset_password_email", srv.resetPassword)
-			public.Post("/send_otp", srv.sendOTPRequest)
+			public.Post("/refresh_token", srv.refreshSessionTokens)
+			public.Post("/send_otp", srv.limitOTPSends(srv.versionedRoute(authEndpointSendOTP)))
 			public.Post("/feedback", srv.sendFeedback)
 			public.Post("/verify_email_link", srv.verifyEmail)
-			public.Post("/verify_otp", srv.verifyOTPForResetPassword(models.OTPReasonTypeResetPassword))
-			public.Post("/change_password_using_otp", srv.changePasswordUsingOTP)
+			public.Post("/verify_otp", srv.versionedRoute(authEndpointVerifyOTP))
+			public.Post("/change_password_using_otp", srv.versionedRoute(authEndpointChangePasswordUsingOTP))
 			public.Post("/pn", srv.SendPushNotification)
 			public.Post("/psn", srv.SendPushNotificationV2)
-			public.Get("/attachment/{attachmentID}", srv.getAttachment)
+			public.With(srv.withFreshUploadURL("attachmentID"), srv.withUploadDetails("attachmentID")).
+				Get("/attachment/{attachmentID}", srv.getAttachment)
 			public.Post("/ios-pn", srv.sendTestPushNotification)
 			public.Get("/faqs", srv.frequentlyAskedQuestions)
 
@@ -47,15 +54,35 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 				testCase.Post("/create", srv.createAdmin)
 				testCase.Route("/delete", func(testAction chi.Router) {
 					testAction.Use(srv.Middlewares.AUTH()...)
+					testAction.Use(srv.rejectExpiredAccessTokens)
+					testAction.Use(srv.requireSecondFactor(false))
 					// testAction.Use(srv.Middlewares.UserAdminCheck(models.RoleAdmin)...)
 					testAction.Delete("/", srv.deleteUser)
 				})
 			})
 
+			public.Route("/login_passkey", func(loginPasskey chi.Router) {
+				loginPasskey.Post("/", srv.loginWithPasskey)
+				loginPasskey.Post("/options", srv.passkeyLoginOptions)
+			})
+
+			public.Route("/2fa", func(twoFactor chi.Router) {
+				twoFactor.Use(srv.Middlewares.AUTH()...)
+				twoFactor.Use(srv.rejectExpiredAccessTokens)
+				twoFactor.Post("/challenge", srv.createTwoFactorChallenge)
+				twoFactor.Post("/verify", srv.verifyTwoFactorChallenge)
+			})
+
 			public.Route("/user", func(user chi.Router) {
 				user.Use(srv.Middlewares.AUTH()...)
+				user.Use(srv.rejectExpiredAccessTokens)
+				user.Use(srv.requireSecondFactor(false))
 				// user.Use(srv.Middlewares.APITimeMiddleware()...)
 				user.Delete("/", srv.deleteUser)
+				user.Get("/deletion", srv.getAccountDeletion)
+				user.Post("/deletion/cancel", srv.cancelAccountDeletion)
+				user.Post("/export", srv.requestDataExport)
+				user.Get("/export", srv.getDataExport)
 				user.Get("/info", srv.userInfo)
 				user.Post("/send_verification_email", srv.emailVerification)
 
@@ -73,14 +100,24 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 				user.Post("/upload_image_v3", srv.uploadImageV3)
 				user.Get("/png", srv.getPng)
 				user.Post("/upload_image_v2", srv.uploadV2)
+				user.Delete("/upload/{uploadID}", srv.discardUpload)
+				user.Route("/uploads", func(uploads chi.Router) {
+					uploads.Post("/", srv.createUploadSession)
+					uploads.Route("/{uploadSessionID}", func(session chi.Router) {
+						session.Get("/", srv.getUploadSession)
+						session.Patch("/", srv.appendUploadChunk)
+						session.Post("/complete", srv.completeUploadSession)
+					})
+				})
 				user.Get("/industries", srv.getAllIndustriesForUser)
 				user.Post("/industries", srv.addIndustries)
 				user.Post("/ping", srv.ping)
 				user.Post("/online_status", srv.getOnlineStatusOfUsers)
 				user.Post("/user_rating", srv.addUserRating)
 				user.Post("/location", srv.addNewUserLocation)
-				user.Post("/verify_phone_otp", srv.verifyOTP(models.OTPReasonTypeVerifyPhone))
-				user.Post("/verify_email_otp", srv.verifyOTP(models.OTPReasonTypeVerifyEmail))
+				user.Post("/send_otp", srv.limitOTPSends(srv.sendOTPCode))
+				user.Post("/verify_phone_otp", srv.versionedRoute(authEndpointVerifyPhoneOTP))
+				user.Post("/verify_email_otp", srv.versionedRoute(authEndpointVerifyEmailOTP))
 				user.Get("/notifications", srv.getNotifications)
 				user.Put("/read_notification", srv.readNotification)
 				user.Get("/notifications_count", srv.getUnreadNotificationsCount)
@@ -98,13 +135,34 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 					session.Post("/", srv.createUserSession)
 					session.Get("/", srv.validateUserSession) // Currently, not in use
 					session.Put("/end", srv.endUserSession)
+					session.Post("/token", srv.issueSessionTokens)
 					session.Put("/fcm", srv.updateFCMToken)
 					session.Put("/voip_token", srv.updateVoipToken)
 				})
 
+				user.Route("/2fa", func(twoFactor chi.Router) {
+					twoFactor.Post("/enroll", srv.enrollTwoFactor)
+					twoFactor.Post("/activate", srv.activateTwoFactor)
+					twoFactor.Post("/recovery_codes", srv.regenerateRecoveryCodes)
+					twoFactor.Post("/disable", srv.disableTwoFactor)
+				})
+
+				user.Route("/passkeys", func(passkeys chi.Router) {
+					passkeys.Get("/", srv.getPasskeys)
+					passkeys.Post("/options", srv.passkeyRegistrationOptions)
+					passkeys.Post("/", srv.registerPasskey)
+					passkeys.Delete("/{passkeyID}", srv.deletePasskey)
+				})
+
+				user.Route("/sessions", func(sessions chi.Router) {
+					sessions.Get("/", srv.getUserSessions)
+					sessions.Post("/revoke_others", srv.revokeOtherUserSessions)
+					sessions.Delete("/{sessionID}", srv.revokeUserSession)
+				})
+
 				user.Route("/profile", func(profile chi.Router) {
-					profile.Get("/", srv.getSelfProfileDetails)
-					profile.Get("/{userID}", srv.getOtherUserProfileDetails)
+					profile.With(srv.withFreshUserUploadURLs("")).Get("/", srv.getSelfProfileDetails)
+					profile.With(srv.withFreshUserUploadURLs("userID")).Get("/{userID}", srv.getOtherUserProfileDetails)
 					profile.Put("/", srv.editProfile)
 					profile.Put("/image", srv.updateProfileImage)
 				})
@@ -134,6 +192,8 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 
 			public.Route("/chat", func(chat chi.Router) {
 				chat.Use(srv.Middlewares.AUTH()...)
+				chat.Use(srv.rejectExpiredAccessTokens)
+				chat.Use(srv.requireSecondFactor(false))
 				// chat.Use(srv.Middlewares.APITimeMiddleware()...)
 
 				chat.Route("/chat_group", func(chatGroups chi.Router) {
@@ -161,7 +221,7 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 						chatGroup.Route("/message", func(message chi.Router) {
 							message.Get("/", srv.getAllMessages)
 							message.Get("/after_time", srv.getAllMessagesAfterTimestamp)
-							message.Get("/{attachmentId}", srv.getMessageAttachment)
+							message.With(srv.withFreshUploadURL("attachmentId"), srv.withUploadDetails("attachmentId")).Get("/{attachmentId}", srv.getMessageAttachment)
 							message.Post("/", srv.deleteMessages)
 							message.Delete("/clear_all", srv.clearAllMessages)
 						})
@@ -173,7 +233,9 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 
 				admin.Route("/", func(admin chi.Router) {
 					admin.Use(srv.Middlewares.AUTH()...)
+					admin.Use(srv.rejectExpiredAccessTokens)
 					admin.Use(srv.Middlewares.UserAdminCheck(models.RoleAdmin)...)
+					admin.Use(srv.requireSecondFactor(true))
 					// admin.Use(srv.Middlewares.APITimeMiddleware()...)
 
 					admin.Delete("/", srv.deleteUser)
@@ -185,21 +247,31 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 					admin.Get("/broadcasts", srv.broadCastHistory)
 					admin.Get("/country", srv.getCountryWithCountryCode)
 					admin.Get("/broadcast/{broadcastID}", srv.getBroadcastMessageDetail)
+					admin.Get("/auth_usage", srv.getAuthAPIUsage)
+					admin.Route("/uploads", func(uploads chi.Router) {
+						uploads.Get("/quarantined", srv.getQuarantinedUploads)
+						uploads.Get("/orphaned", srv.getOrphanedUploadsReport)
+						uploads.Put("/{uploadID}/release", srv.releaseQuarantinedUpload)
+					})
 					admin.Route("/users", func(users chi.Router) {
 						users.Get("/", srv.getUsersList)
 						users.Get("/downloads", srv.downloadUsersList)
 						users.Get("/filters", srv.userFilters)
 
 						users.Route("/{userID}", func(users chi.Router) {
-							users.Get("/", srv.getUserProfileDetails)
+							users.With(srv.withUploadUsage("userID")).Get("/", srv.getUserProfileDetails)
 							users.Post("/suspend_user", srv.suspendUser)
 							users.Put("/", srv.updateUserDetails)
 							users.Delete("/", srv.deleteUserByAdmin)
+							users.Get("/deletion", srv.getAccountDeletionByAdmin)
+							users.Post("/restore", srv.restoreUserByAdmin)
 						})
 					})
 
 					admin.Route("/dashboard", func(dashboard chi.Router) {
 						dashboard.Get("/details", srv.dashboardDetails)
+						dashboard.Get("/notifications", srv.getAdminNotifications)
+						dashboard.Put("/notifications/{notificationID}/read", srv.readAdminNotification)
 						dashboard.Route("/charts", func(charts chi.Router) {
 							charts.Get("/", srv.getUserChartData)
 							charts.Get("/industry_user_count", srv.getTopIndustries)
@@ -303,6 +375,8 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 			})
 			public.Route("/groups", func(groups chi.Router) {
 				groups.Use(srv.Middlewares.AUTH()...)
+				groups.Use(srv.rejectExpiredAccessTokens)
+				groups.Use(srv.requireSecondFactor(false))
 				// groups.Use(srv.Middlewares.APITimeMiddleware()...)
 
 				groups.Get("/list", srv.getAllUserGroups)
@@ -319,6 +393,8 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 			})
 			public.Route("/group", func(group chi.Router) {
 				group.Use(srv.Middlewares.AUTH()...)
+				group.Use(srv.rejectExpiredAccessTokens)
+				group.Use(srv.requireSecondFactor(false))
 				// group.Use(srv.Middlewares.APITimeMiddleware()...)
 
 				group.Get("/feeds", srv.getAllFeeds)
@@ -395,6 +471,8 @@ func (srv *Server) InjectRoutes() *chi.Mux {
 			})
 			public.Route("/showcase", func(showcase chi.Router) {
 				showcase.Use(srv.Middlewares.AUTH()...)
+				showcase.Use(srv.rejectExpiredAccessTokens)
+				showcase.Use(srv.requireSecondFactor(false))
 				// showcase.Use(srv.Middlewares.APITimeMiddleware()...)
 
 				showcase.Post("/create_profile", srv.createProfile)
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// accessTokenTTLMinutesConfig and refreshTokenTTLDaysConfig bound the lifetime of the tokens
+	// issued by the token endpoints.
+	accessTokenTTLMinutesConfig = "ACCESS_TOKEN_TTL_MINUTES"
+	refreshTokenTTLDaysConfig   = "REFRESH_TOKEN_TTL_DAYS"
+
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	// accessTokenPrefix marks session tokens issued by rotateSessionToken, the expiry follows it.
+	// Sessions started before the token endpoints existed keep their long-lived token.
+	accessTokenPrefix = "at."
+)
+
+// sessionTokens is returned every time a session gets a new access token.
+type sessionTokens struct {
+	AccessToken           string    `json:"accessToken"`
+	AccessTokenExpiresAt  time.Time `json:"accessTokenExpiresAt"`
+	RefreshToken          string    `json:"refreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+}
+
+// refreshToken belongs to a family started when a session first asks for tokens. Each refresh uses
+// the presented token and adds a new one to the family, a used token presented again means it was
+// stolen and the whole family is revoked.
+type refreshToken struct {
+	ID           int          `db:"id"`
+	FamilyID     int          `db:"family_id"`
+	UserID       int          `db:"user_id"`
+	AuthID       string       `db:"auth_id"`
+	SessionToken string       `db:"session_token"`
+	UsedAt       sql.NullTime `db:"used_at"`
+	RevokedAt    sql.NullTime `db:"revoked_at"`
+	ExpiresAt    time.Time    `db:"expires_at"`
+}
+
+var errRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+
+func (srv *Server) accessTokenTTL() time.Duration {
+	if minutes := srv.DynamicConfig.GetInt(accessTokenTTLMinutesConfig); minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultAccessTokenTTL
+}
+
+func (srv *Server) refreshTokenTTL() time.Duration {
+	if days := srv.DynamicConfig.GetInt(refreshTokenTTLDaysConfig); days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return defaultRefreshTokenTTL
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// newAccessToken embeds the expiry in the token so it can be checked without a lookup. The token
+// is still matched against the session by AUTH, changing the expiry gives a token that matches nothing.
+func newAccessToken(expiresAt time.Time) (string, error) {
+	random, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return accessTokenPrefix + strconv.FormatInt(expiresAt.Unix(), 10) + "." + random, nil
+}
+
+// accessTokenExpiry returns the expiry of a token issued by newAccessToken, and false for the
+// long-lived tokens of older sessions.
+func accessTokenExpiry(token string) (time.Time, bool) {
+	rest, found := strings.CutPrefix(token, accessTokenPrefix)
+	if !found {
+		return time.Time{}, false
+	}
+
+	expiry, _, found := strings.Cut(rest, ".")
+	if !found {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// userContextCacheTTL is the lifetime of the user context cached for token, at most ttl and never
+// past the expiry of an access token.
+func userContextCacheTTL(token string, ttl time.Duration) time.Duration {
+	expiresAt, ok := accessTokenExpiry(token)
+	if !ok {
+		return ttl
+	}
+
+	remaining := time.Until(expiresAt)
+	if remaining < 0 {
+		return 0
+	}
+	if remaining < ttl {
+		return remaining
+	}
+	return ttl
+}
+
+// rejectExpiredAccessTokens runs after AUTH. The cached user context of an access token is never
+// used past the token's expiry. It stays until AUTH, outside this package, caches user contexts
+// for userContextCacheTTL.
+func (srv *Server) rejectExpiredAccessTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		uc := srv.getUserContext(req)
+		if uc != nil && uc.Session != nil {
+			if expiresAt, ok := accessTokenExpiry(uc.Session.Token); ok && time.Now().After(expiresAt) {
+				connectuperror.RespondClientErr(resp, req, errors.New("access token expired"), http.StatusUnauthorized, "access token expired")
+				return
+			}
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// rotateSessionToken replaces the token of the session with a new access token and returns it. The
+// user context cached for the previous token is dropped once the transaction commits.
+func (srv *Server) rotateSessionToken(db sqlExecer, sessionToken string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(srv.accessTokenTTL())
+	accessToken, err := newAccessToken(expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	SQL := `UPDATE sessions
+			SET token = $2
+			WHERE token = $1
+			  AND end_time IS NULL`
+
+	result, err := db.Exec(SQL, sessionToken, accessToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return "", time.Time{}, errRefreshTokenInvalid
+	}
+
+	for _, SQL := range []string{
+		`UPDATE session_activity SET session_token = $2 WHERE session_token = $1`,
+		`UPDATE session_token_families SET session_token = $2 WHERE session_token = $1`,
+		`UPDATE session_second_factors SET session_token = $2 WHERE session_token = $1`,
+	} {
+		if _, err := db.Exec(SQL, sessionToken, accessToken); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return accessToken, expiresAt, nil
+}
+
+// addRefreshToken stores the hash of a new refresh token of the family and returns the token.
+func (srv *Server) addRefreshToken(db sqlExecer, familyID int) (string, time.Time, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(srv.refreshTokenTTL())
+
+	SQL := `INSERT INTO session_refresh_tokens (family_id, token_hash, expires_at)
+			VALUES ($1, $2, $3)`
+
+	if _, err := db.Exec(SQL, familyID, hashRefreshToken(token), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// revokeSessionTokenFamilies revokes the refresh tokens of the session, it is called whenever a
+// session ends so its refresh tokens cannot bring it back.
+func (srv *Server) revokeSessionTokenFamilies(sessionToken string) error {
+	SQL := `UPDATE session_token_families
+			SET revoked_at = now()
+			WHERE session_token = $1
+			  AND revoked_at IS NULL`
+
+	_, err := srv.PSQL.DB().Exec(SQL, sessionToken)
+	return err
+}
+
+/*
+  - issueSessionTokens
+  - @Description This method is used to switch the current session to
+    short-lived access tokens. The session token of the request stops
+    working and a new access token and refresh token are returned.
+*/
+func (srv *Server) issueSessionTokens(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	if uc.Session == nil {
+		connectuperror.RespondClientErr(resp, req, errors.New("session not found"), http.StatusBadRequest, "session not found")
+		return
+	}
+
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to issue tokens")
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("issueSessionTokens: unable to rollback %v", err)
+		}
+	}()
+
+	var tokens sessionTokens
+	tokens.AccessToken, tokens.AccessTokenExpiresAt, err = srv.rotateSessionToken(tx, uc.Session.Token)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to issue tokens")
+		return
+	}
+
+	SQL := `INSERT INTO session_token_families (user_id, auth_id, session_token)
+			VALUES ($1, $2, $3)
+			RETURNING id`
+
+	var familyID int
+	if err := tx.Get(&familyID, SQL, uc.ID, uc.AuthID, tokens.AccessToken); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to issue tokens")
+		return
+	}
+
+	tokens.RefreshToken, tokens.RefreshTokenExpiresAt, err = srv.addRefreshToken(tx, familyID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to issue tokens")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to issue tokens")
+		return
+	}
+
+	srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, uc.AuthID, uc.Session.Token))
+
+	utils.EncodeJSON200Body(resp, tokens)
+}
+
+/*
+  - refreshSessionTokens
+  - @Description This method is used to exchange a refresh token for a
+    new access token and refresh token. A refresh token can be used
+    once, using it again signs the session out.
+*/
+func (srv *Server) refreshSessionTokens(resp http.ResponseWriter, req *http.Request) {
+	var refreshRequest struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&refreshRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	if refreshRequest.RefreshToken == "" {
+		connectuperror.RespondClientErr(resp, req, errors.New("empty refresh token"), http.StatusBadRequest, "empty refresh token")
+		return
+	}
+
+	tokens, err := srv.refreshSession(refreshRequest.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errRefreshTokenInvalid) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusUnauthorized, err.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to refresh tokens")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, tokens)
+}
+
+func (srv *Server) refreshSession(presented string) (sessionTokens, error) {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("refreshSession: unable to rollback %v", err)
+		}
+	}()
+
+	// the family row is locked so concurrent refreshes of the same session run one after the other
+	SQL := `SELECT t.id, t.family_id, f.user_id, f.auth_id, f.session_token, t.used_at,
+			       coalesce(t.revoked_at, f.revoked_at) AS revoked_at, t.expires_at
+			FROM session_refresh_tokens t
+			         JOIN session_token_families f ON f.id = t.family_id
+			WHERE t.token_hash = $1
+			FOR UPDATE OF f`
+
+	var token refreshToken
+	if err := tx.Get(&token, SQL, hashRefreshToken(presented)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sessionTokens{}, errRefreshTokenInvalid
+		}
+		return sessionTokens{}, err
+	}
+
+	if token.RevokedAt.Valid || time.Now().After(token.ExpiresAt) {
+		return sessionTokens{}, errRefreshTokenInvalid
+	}
+
+	if token.UsedAt.Valid {
+		logrus.Warnf("refreshSession: refresh token of family %d reused, revoking the session of user %d", token.FamilyID, token.UserID)
+		if err := srv.revokeTokenFamily(tx, token); err != nil {
+			return sessionTokens{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return sessionTokens{}, err
+		}
+		srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, token.AuthID, token.SessionToken))
+		return sessionTokens{}, errRefreshTokenInvalid
+	}
+
+	var tokens sessionTokens
+	tokens.AccessToken, tokens.AccessTokenExpiresAt, err = srv.rotateSessionToken(tx, token.SessionToken)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	SQL = `UPDATE session_refresh_tokens SET used_at = now() WHERE id = $1`
+	if _, err := tx.Exec(SQL, token.ID); err != nil {
+		return sessionTokens{}, err
+	}
+
+	tokens.RefreshToken, tokens.RefreshTokenExpiresAt, err = srv.addRefreshToken(tx, token.FamilyID)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return sessionTokens{}, err
+	}
+
+	srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, token.AuthID, token.SessionToken))
+	return tokens, nil
+}
+
+// revokeTokenFamily revokes every refresh token of the family and ends its session in the same
+// transaction, so a revoked family never leaves its session running.
+func (srv *Server) revokeTokenFamily(tx sqlExecer, token refreshToken) error {
+	SQL := `UPDATE session_token_families SET revoked_at = now() WHERE id = $1`
+	if _, err := tx.Exec(SQL, token.FamilyID); err != nil {
+		return err
+	}
+
+	SQL = `UPDATE session_refresh_tokens
+			SET revoked_at = now()
+			WHERE family_id = $1
+			  AND revoked_at IS NULL`
+	if _, err := tx.Exec(SQL, token.FamilyID); err != nil {
+		return err
+	}
+
+	SQL = `UPDATE sessions
+			SET end_time = now()
+			WHERE token = $1
+			  AND end_time IS NULL`
+	_, err := tx.Exec(SQL, token.SessionToken)
+	return err
+}
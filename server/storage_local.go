@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// localStorageProvider selects the filesystem storage when STORAGE_PROVIDER is set to it.
+	localStorageProvider = "local"
+
+	localFilesRoute = "/files/"
+)
+
+var errInvalidObjectPath = errors.New("invalid object path")
+
+// LocalStorageProvider keeps objects on the local filesystem and hands out HMAC signed, expiring
+// urls served by the /files/* route. It is meant for docker-compose and integration tests, where
+// no cloud credentials are available.
+type LocalStorageProvider struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+// NewLocalStorageProvider stores objects below root, one directory per bucket, and signs urls
+// pointing to baseURL with secret.
+func NewLocalStorageProvider(root, baseURL string, secret []byte) *LocalStorageProvider {
+	return &LocalStorageProvider{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}
+}
+
+// ConfigureLocalStorage replaces the storage provider with a LocalStorageProvider when
+// STORAGE_PROVIDER is "local". LOCAL_STORAGE_DIR, LOCAL_STORAGE_BASE_URL and
+// LOCAL_STORAGE_SECRET configure it.
+func (srv *Server) ConfigureLocalStorage() {
+	if os.Getenv("STORAGE_PROVIDER") != localStorageProvider {
+		return
+	}
+
+	root := os.Getenv("LOCAL_STORAGE_DIR")
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "connectup-storage")
+	}
+
+	baseURL := os.Getenv("LOCAL_STORAGE_BASE_URL")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://localhost:%v", os.Getenv("PORT"))
+	}
+
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		// urls signed with a random secret stop working once the server restarts
+		logrus.Warn("ConfigureLocalStorage: LOCAL_STORAGE_SECRET is not set, using a random secret")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logrus.Fatalf("ConfigureLocalStorage: unable to generate secret %v", err)
+		}
+	}
+
+	srv.StorageProvider = NewLocalStorageProvider(root, baseURL, secret)
+	logrus.Infof("ConfigureLocalStorage: storing uploads in %s", root)
+}
+
+// objectPath returns the file of an object, rejecting paths that would leave the bucket directory.
+func (storage *LocalStorageProvider) objectPath(bucket, objectPath string) (string, error) {
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return "", errInvalidObjectPath
+	}
+
+	cleaned := path.Clean("/" + objectPath)
+	if cleaned == "/" {
+		return "", errInvalidObjectPath
+	}
+	return filepath.Join(storage.root, bucket, filepath.FromSlash(cleaned)), nil
+}
+
+// Upload writes the object to a temp file first so that readers never see it half written.
+func (storage *LocalStorageProvider) Upload(ctx context.Context, bucket string, file io.Reader, objectPath, contentType string, public bool) error {
+	filePath, err := storage.objectPath(bucket, objectPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Upload: unable to remove temp file %v", err)
+		}
+	}()
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, r: file}); err != nil {
+		if closeErr := tmp.Close(); closeErr != nil {
+			logrus.Errorf("Upload: unable to close temp file %v", closeErr)
+		}
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// GetSharableURL returns a url to the object that the /files/* route accepts until expiry has passed.
+func (storage *LocalStorageProvider) GetSharableURL(bucket, objectPath string, expiry time.Duration) (string, error) {
+	if _, err := storage.objectPath(bucket, objectPath); err != nil {
+		return "", err
+	}
+
+	key := bucket + "/" + strings.TrimPrefix(path.Clean("/"+objectPath), "/")
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", storage.sign(key, expires))
+
+	fileURL := url.URL{Path: localFilesRoute + key, RawQuery: query.Encode()}
+	return storage.baseURL + fileURL.String(), nil
+}
+
+func (storage *LocalStorageProvider) Delete(ctx context.Context, bucket, objectPath string) error {
+	filePath, err := storage.objectPath(bucket, objectPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (storage *LocalStorageProvider) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, storage.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// open returns the object behind a signed url once its signature and expiry are verified.
+func (storage *LocalStorageProvider) open(key, expires, signature string) (*os.File, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, errors.New("url expired")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(storage.sign(key, expires))) {
+		return nil, errors.New("invalid signature")
+	}
+
+	bucket, objectPath, found := strings.Cut(key, "/")
+	if !found {
+		return nil, errInvalidObjectPath
+	}
+
+	filePath, err := storage.objectPath(bucket, objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+/*
+  - serveLocalFile
+  - @Description This method serves the objects of the local storage provider
+    through the signed urls it hands out. It is not found with any other provider.
+*/
+func (srv *Server) serveLocalFile(resp http.ResponseWriter, req *http.Request) {
+	storage, ok := srv.StorageProvider.(*LocalStorageProvider)
+	if !ok {
+		http.NotFound(resp, req)
+		return
+	}
+
+	query := req.URL.Query()
+	// the decoded path is signed, chi's wildcard param may still be escaped
+	key := strings.TrimPrefix(req.URL.Path, localFilesRoute)
+	file, err := storage.open(key, query.Get("expires"), query.Get("signature"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(resp, req)
+			return
+		}
+		connectuperror.RespondClientErr(resp, req, err, http.StatusForbidden, "link is invalid or expired")
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("serveLocalFile: unable to close file %v", err)
+		}
+	}()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(resp, req)
+		return
+	}
+
+	// ServeContent handles range requests, which video and audio players rely on
+	http.ServeContent(resp, req, info.Name(), info.ModTime(), file)
+}
+
+// contextReader stops reading once ctx is done, so an aborted request does not keep writing to disk.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBucket = "uploads"
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	storage := NewLocalStorageProvider(t.TempDir(), "http://localhost:8080/", []byte("secret"))
+
+	if err := storage.Upload(context.Background(), testBucket, strings.NewReader("content"), "images/a b.png", "image/png", false); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	signed, err := storage.GetSharableURL(testBucket, "images/a b.png", time.Hour)
+	if err != nil {
+		t.Fatalf("GetSharableURL() error = %v", err)
+	}
+	if !strings.HasPrefix(signed, "http://localhost:8080"+localFilesRoute) {
+		t.Fatalf("url = %q, want it below the files route of the base url", signed)
+	}
+
+	key, expires, signature := parseSignedURL(t, signed)
+	if key != testBucket+"/images/a b.png" {
+		t.Errorf("signed key = %q, want the bucket and the object path", key)
+	}
+
+	file, err := storage.open(key, expires, signature)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("content = %q, want the uploaded content", content)
+	}
+}
+
+func TestLocalStorageRejectsInvalidURLs(t *testing.T) {
+	storage := NewLocalStorageProvider(t.TempDir(), "http://localhost:8080", []byte("secret"))
+	if err := storage.Upload(context.Background(), testBucket, strings.NewReader("content"), "images/a.png", "image/png", false); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	signed, err := storage.GetSharableURL(testBucket, "images/a.png", time.Hour)
+	if err != nil {
+		t.Fatalf("GetSharableURL() error = %v", err)
+	}
+	key, expires, signature := parseSignedURL(t, signed)
+
+	expired, err := storage.GetSharableURL(testBucket, "images/a.png", -time.Minute)
+	if err != nil {
+		t.Fatalf("GetSharableURL() error = %v", err)
+	}
+	expiredKey, expiredAt, expiredSignature := parseSignedURL(t, expired)
+
+	otherSecret := NewLocalStorageProvider(storage.root, "http://localhost:8080", []byte("other"))
+	forged, err := otherSecret.GetSharableURL(testBucket, "images/a.png", time.Hour)
+	if err != nil {
+		t.Fatalf("GetSharableURL() error = %v", err)
+	}
+	_, forgedExpires, forgedSignature := parseSignedURL(t, forged)
+
+	tests := []struct {
+		name      string
+		key       string
+		expires   string
+		signature string
+	}{
+		{name: "expired", key: expiredKey, expires: expiredAt, signature: expiredSignature},
+		{name: "expiry extended", key: key, expires: "99999999999", signature: signature},
+		{name: "other object", key: testBucket + "/images/b.png", expires: expires, signature: signature},
+		{name: "other secret", key: key, expires: forgedExpires, signature: forgedSignature},
+		{name: "missing signature", key: key, expires: expires},
+		{name: "malformed expiry", key: key, expires: "tomorrow", signature: signature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := storage.open(tt.key, tt.expires, tt.signature)
+			if err == nil {
+				file.Close()
+				t.Fatal("open() error = nil, want the url rejected")
+			}
+			if os.IsNotExist(err) {
+				t.Errorf("open() error = %v, want a signature or expiry error", err)
+			}
+		})
+	}
+}
+
+func TestLocalStorageObjectPathTraversal(t *testing.T) {
+	root := t.TempDir()
+	storage := NewLocalStorageProvider(root, "http://localhost:8080", []byte("secret"))
+	bucketDir := filepath.Join(root, testBucket)
+
+	tests := []struct {
+		name       string
+		bucket     string
+		objectPath string
+		want       string
+		wantErr    bool
+	}{
+		{name: "nested object", bucket: testBucket, objectPath: "images/a.png", want: filepath.Join(bucketDir, "images", "a.png")},
+		{name: "parent segments stay in the bucket", bucket: testBucket, objectPath: "../../etc/passwd", want: filepath.Join(bucketDir, "etc", "passwd")},
+		{name: "absolute path stays in the bucket", bucket: testBucket, objectPath: "/etc/passwd", want: filepath.Join(bucketDir, "etc", "passwd")},
+		{name: "inner parent segments", bucket: testBucket, objectPath: "images/../../other/a.png", want: filepath.Join(bucketDir, "other", "a.png")},
+		{name: "bucket root", bucket: testBucket, objectPath: "..", wantErr: true},
+		{name: "empty object", bucket: testBucket, objectPath: "", wantErr: true},
+		{name: "parent bucket", bucket: "..", objectPath: "a.png", wantErr: true},
+		{name: "nested bucket", bucket: "uploads/../other", objectPath: "a.png", wantErr: true},
+		{name: "backslash bucket", bucket: `..\other`, objectPath: "a.png", wantErr: true},
+		{name: "empty bucket", bucket: "", objectPath: "a.png", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := storage.objectPath(tt.bucket, tt.objectPath)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidObjectPath) {
+					t.Fatalf("objectPath() = %q, %v, want errInvalidObjectPath", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("objectPath() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("objectPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalStorageSignedKeyCannotLeaveRoot(t *testing.T) {
+	root := t.TempDir()
+	storage := NewLocalStorageProvider(filepath.Join(root, "storage"), "http://localhost:8080", []byte("secret"))
+
+	secret := filepath.Join(root, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a correctly signed key with parent segments still resolves inside the bucket
+	expires := "99999999999"
+	key := testBucket + "/../../secret.txt"
+	file, err := storage.open(key, expires, storage.sign(key, expires))
+	if err == nil {
+		file.Close()
+		t.Fatal("open() error = nil, want the file outside the storage root to be unreachable")
+	}
+	if !os.IsNotExist(err) {
+		t.Errorf("open() error = %v, want a missing file inside the bucket", err)
+	}
+}
+
+func TestLocalStorageUploadAndDelete(t *testing.T) {
+	storage := NewLocalStorageProvider(t.TempDir(), "http://localhost:8080", []byte("secret"))
+	ctx := context.Background()
+
+	if err := storage.Upload(ctx, testBucket, strings.NewReader("first"), "documents/a.pdf", "application/pdf", false); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if err := storage.Upload(ctx, testBucket, strings.NewReader("second"), "documents/a.pdf", "application/pdf", false); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	filePath, err := storage.objectPath(testBucket, "documents/a.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "second" {
+		t.Errorf("content = %q, want the object overwritten", content)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("object directory holds %d entries, want no temp files left", len(entries))
+	}
+
+	if err := storage.Delete(ctx, testBucket, "documents/a.pdf"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("object still exists after Delete, stat error = %v", err)
+	}
+	if err := storage.Delete(ctx, testBucket, "documents/a.pdf"); err != nil {
+		t.Errorf("Delete() of a missing object error = %v, want nil", err)
+	}
+}
+
+func TestLocalStorageUploadStopsOnCancel(t *testing.T) {
+	storage := NewLocalStorageProvider(t.TempDir(), "http://localhost:8080", []byte("secret"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := storage.Upload(ctx, testBucket, strings.NewReader("content"), "images/a.png", "image/png", false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Upload() error = %v, want context.Canceled", err)
+	}
+
+	filePath, err := storage.objectPath(testBucket, "images/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("object exists after a cancelled upload, stat error = %v", err)
+	}
+}
+
+// parseSignedURL returns the key, expiry and signature the files route reads from a signed url.
+func parseSignedURL(t *testing.T, signed string) (key, expires, signature string) {
+	t.Helper()
+
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("unable to parse url %q: %v", signed, err)
+	}
+
+	query := parsed.Query()
+	return strings.TrimPrefix(parsed.Path, localFilesRoute), query.Get("expires"), query.Get("signature")
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/RemoteState/connect-up/config"
+	"github.com/RemoteState/connect-up/env"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// thumbnailBackendConfig selects the Thumbnailer, either "ffmpeg" or "http".
+	// When it is empty ffmpeg is used if it is installed, the thumbnail service otherwise.
+	thumbnailBackendConfig = "THUMBNAIL_BACKEND"
+
+	thumbnailBackendFFmpeg = "ffmpeg"
+	thumbnailBackendHTTP   = "http"
+
+	maxThumbnailSize = 5 << 20
+)
+
+// thumbnailSource is the video a thumbnail is generated for. File is positioned at its start.
+type thumbnailSource struct {
+	URL      string
+	FileName string
+	File     io.ReadSeeker
+}
+
+// Thumbnailer writes a PNG preview frame of a video to w.
+type Thumbnailer interface {
+	Thumbnail(ctx context.Context, src thumbnailSource, w io.Writer) error
+}
+
+func (srv *Server) thumbnailer() Thumbnailer {
+	switch srv.DynamicConfig.GetString(thumbnailBackendConfig) {
+	case thumbnailBackendHTTP:
+		return srv.httpThumbnailer()
+	case thumbnailBackendFFmpeg:
+		return ffmpegThumbnailer{binary: "ffmpeg"}
+	}
+
+	if binary, err := exec.LookPath("ffmpeg"); err == nil {
+		return ffmpegThumbnailer{binary: binary}
+	}
+	return srv.httpThumbnailer()
+}
+
+func (srv *Server) httpThumbnailer() httpThumbnailer {
+	if env.InKubeCluster() {
+		return httpThumbnailer{endpoint: fmt.Sprintf("http://%s/thumbnail", srv.DynamicConfig.GetString(config.ThumbnailGeneratorHost))}
+	}
+	return httpThumbnailer{endpoint: "http://127.0.0.1:5000/thumbnail"}
+}
+
+// httpThumbnailer asks the thumbnail generator service to fetch the video from its url.
+type httpThumbnailer struct {
+	endpoint string
+}
+
+func (t httpThumbnailer) Thumbnail(ctx context.Context, src thumbnailSource, w io.Writer) error {
+	type body struct {
+		URL      string `json:"url"`
+		Filename string `json:"filename"`
+	}
+
+	data, err := json.Marshal(body{URL: src.URL, Filename: src.FileName})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json;content=UTF-8")
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			logrus.Errorf("httpThumbnailer: unable to close response %v", err)
+		}
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("thumbnail service responded with status %d", response.StatusCode)
+	}
+
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// ffmpegThumbnailer extracts a representative frame with a local ffmpeg binary.
+type ffmpegThumbnailer struct {
+	binary string
+}
+
+func (t ffmpegThumbnailer) Thumbnail(ctx context.Context, src thumbnailSource, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("ffmpegThumbnailer: unable to remove temp dir %v", err)
+		}
+	}()
+
+	input := filepath.Join(dir, "input"+filepath.Ext(src.FileName))
+	output := filepath.Join(dir, "thumbnail.png")
+
+	if err := writeTempFile(input, src.File); err != nil {
+		return err
+	}
+
+	// nolint:gosec // arguments are paths created above
+	cmd := exec.CommandContext(ctx, t.binary, "-v", "error", "-y", "-i", input, "-vf", "thumbnail", "-frames:v", "1", output)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, stderr.String())
+	}
+
+	thumbnail, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := thumbnail.Close(); err != nil {
+			logrus.Errorf("ffmpegThumbnailer: unable to close thumbnail %v", err)
+		}
+	}()
+
+	_, err = io.Copy(w, thumbnail)
+	return err
+}
+
+func writeTempFile(path string, src io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, src); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
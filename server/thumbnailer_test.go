@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPThumbnailerPostsVideoURL(t *testing.T) {
+	var received struct {
+		URL      string `json:"url"`
+		Filename string `json:"filename"`
+	}
+
+	service := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			t.Errorf("method = %s, want POST", req.Method)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+			t.Errorf("unable to decode request: %v", err)
+		}
+		_, _ = resp.Write([]byte("png bytes"))
+	}))
+	defer service.Close()
+
+	var out bytes.Buffer
+	src := thumbnailSource{URL: "https://bucket/videos/clip.mp4", FileName: "clip.mp4"}
+	if err := (httpThumbnailer{endpoint: service.URL}).Thumbnail(context.Background(), src, &out); err != nil {
+		t.Fatalf("Thumbnail() error = %v", err)
+	}
+
+	if received.URL != src.URL || received.Filename != src.FileName {
+		t.Errorf("service received %+v, want url %q and filename %q", received, src.URL, src.FileName)
+	}
+	if out.String() != "png bytes" {
+		t.Errorf("thumbnail = %q, want the service response", out.String())
+	}
+}
+
+func TestHTTPThumbnailerFailsOnErrorStatus(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.WriteHeader(http.StatusBadGateway)
+	}))
+	defer service.Close()
+
+	var out bytes.Buffer
+	err := (httpThumbnailer{endpoint: service.URL}).Thumbnail(context.Background(), thumbnailSource{}, &out)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("Thumbnail() error = %v, want the status in the error", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("thumbnail = %q, want nothing written", out.String())
+	}
+}
+
+func TestFFmpegThumbnailerExtractsPNGFrame(t *testing.T) {
+	binary, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	video := filepath.Join(t.TempDir(), "clip.mp4")
+	// nolint:gosec // arguments are constants and a temp path
+	generate := exec.Command(binary, "-v", "error", "-f", "lavfi", "-i", "testsrc=size=64x48:rate=5", "-t", "1", "-pix_fmt", "yuv420p", video)
+	if out, err := generate.CombinedOutput(); err != nil {
+		t.Fatalf("unable to generate test video: %v: %s", err, out)
+	}
+
+	file, err := os.Open(video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var out bytes.Buffer
+	src := thumbnailSource{FileName: "clip.mp4", File: file}
+	if err := (ffmpegThumbnailer{binary: binary}).Thumbnail(context.Background(), src, &out); err != nil {
+		t.Fatalf("Thumbnail() error = %v", err)
+	}
+
+	thumbnail, err := png.Decode(&out)
+	if err != nil {
+		t.Fatalf("thumbnail is not a PNG: %v", err)
+	}
+	if bounds := thumbnail.Bounds(); bounds != image.Rect(0, 0, 64, 48) {
+		t.Errorf("thumbnail bounds = %v, want the video frame size", bounds)
+	}
+}
+
+func TestFFmpegThumbnailerReportsFailures(t *testing.T) {
+	binary, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	var out bytes.Buffer
+	src := thumbnailSource{FileName: "clip.mp4", File: strings.NewReader("not a video")}
+	err = (ffmpegThumbnailer{binary: binary}).Thumbnail(context.Background(), src, &out)
+	if err == nil || !strings.HasPrefix(err.Error(), "ffmpeg: ") {
+		t.Fatalf("Thumbnail() error = %v, want an ffmpeg error", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("thumbnail = %q, want nothing written", out.String())
+	}
+}
+
+func TestFFmpegThumbnailerRemovesTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	var out bytes.Buffer
+	src := thumbnailSource{FileName: "clip.mp4", File: strings.NewReader("video")}
+	if err := (ffmpegThumbnailer{binary: filepath.Join(tmp, "missing-ffmpeg")}).Thumbnail(context.Background(), src, &out); err == nil {
+		t.Fatal("Thumbnail() error = nil, want an error for a missing binary")
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp dir holds %d entries after Thumbnail, want none", len(entries))
+	}
+}
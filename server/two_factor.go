@@ -0,0 +1,541 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	recoveryCodeCount = 10
+
+	twoFactorChallengeTTL         = 5 * time.Minute
+	maxTwoFactorChallengeAttempts = 5
+)
+
+var (
+	errTwoFactorRequired    = errors.New("two factor authentication required")
+	errInvalidTwoFactorCode = errors.New("invalid two factor authentication code")
+)
+
+type twoFactorChallenge struct {
+	ID        int          `db:"id"`
+	UserID    int          `db:"user_id"`
+	Attempts  int          `db:"attempts"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	Completed sql.NullTime `db:"completed_at"`
+}
+
+// requireSecondFactor runs after AUTH. Sessions of users with two factor authentication enabled are
+// refused until the second step of the login is completed, requests without a session cannot have
+// completed it and are refused too. When mandatory, users who have not enabled it are refused as well.
+func (srv *Server) requireSecondFactor(mandatory bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			uc := srv.getUserContext(req)
+			if uc == nil {
+				connectuperror.RespondClientErr(resp, req, errors.New("user context not found"), http.StatusUnauthorized, "unauthorized")
+				return
+			}
+
+			var sessionToken string
+			if uc.Session != nil {
+				sessionToken = uc.Session.Token
+			}
+
+			SQL := `SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL) AS enabled,
+			               EXISTS (SELECT 1 FROM session_second_factors WHERE session_token = $2) AS verified`
+
+			var status struct {
+				Enabled  bool `db:"enabled"`
+				Verified bool `db:"verified"`
+			}
+			if err := srv.PSQL.DB().Get(&status, SQL, uc.ID, sessionToken); err != nil {
+				connectuperror.RespondGenericServerErr(resp, req, err, "unable to check two factor authentication")
+				return
+			}
+
+			if !status.Enabled && mandatory {
+				connectuperror.RespondClientErr(resp, req, errors.New("two factor authentication not enabled"), http.StatusForbidden, "two factor authentication must be enabled")
+				return
+			}
+
+			if status.Enabled && (sessionToken == "" || !status.Verified) {
+				connectuperror.RespondClientErr(resp, req, errTwoFactorRequired, http.StatusUnauthorized, errTwoFactorRequired.Error())
+				return
+			}
+
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+// userTOTP is the secret of a user and the last step a code was accepted for.
+type userTOTP struct {
+	Secret       string `db:"secret"`
+	LastUsedStep int64  `db:"last_used_step"`
+}
+
+// checkTOTP validates the code against the secret of the user and records its step so it cannot be
+// used again. The secret is pending until enrollment is activated, enabled afterwards. db is the
+// transaction of the caller, the row is locked until it ends.
+func checkTOTP(db sqlGetExecer, userID int, code string, enabled bool) (bool, error) {
+	SQL := `SELECT secret, last_used_step
+			FROM user_totp
+			WHERE user_id = $1
+			  AND (enabled_at IS NOT NULL) = $2
+			FOR UPDATE`
+
+	var totp userTOTP
+	if err := db.Get(&totp, SQL, userID, enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	step, valid := validateTOTP(totp.Secret, strings.TrimSpace(code), time.Now(), totp.LastUsedStep)
+	if !valid {
+		return false, nil
+	}
+
+	SQL = `UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1`
+	_, err := db.Exec(SQL, userID, step)
+	return err == nil, err
+}
+
+// useRecoveryCode consumes one of the recovery codes of the user.
+func useRecoveryCode(tx *sqlx.Tx, userID int, code string) (bool, error) {
+	SQL := `UPDATE user_recovery_codes
+			SET used_at = now()
+			WHERE user_id = $1
+			  AND code_hash = $2
+			  AND used_at IS NULL`
+
+	result, err := tx.Exec(SQL, userID, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// hashSecret hashes the recovery codes, challenge tokens and reset tokens stored in place of the
+// secrets themselves.
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// replaceRecoveryCodes drops the previous recovery codes of the user and returns new ones, only their
+// hashes are stored.
+func replaceRecoveryCodes(tx *sqlx.Tx, userID int) ([]string, error) {
+	SQL := `DELETE FROM user_recovery_codes WHERE user_id = $1`
+	if _, err := tx.Exec(SQL, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random)[:10])
+		code = code[:5] + "-" + code[5:]
+
+		SQL = `INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := tx.Exec(SQL, userID, hashSecret(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func markSessionVerified(tx *sqlx.Tx, userID int, sessionToken string) error {
+	SQL := `INSERT INTO session_second_factors (session_token, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT (session_token) DO NOTHING`
+
+	_, err := tx.Exec(SQL, sessionToken, userID)
+	return err
+}
+
+func (srv *Server) inTx(fn func(tx *sqlx.Tx) error) error {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("inTx: unable to rollback %v", err)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+  - enrollTwoFactor
+  - @Description This method is used to start enrolling in two factor
+    authentication. It returns a new secret and its provisioning uri to
+    show as a QR code, the secret is used once enrollment is activated.
+*/
+func (srv *Server) enrollTwoFactor(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	userInfo, err := srv.DBHelper.GetUserInfo(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "error in getting user info")
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to enroll two factor authentication")
+		return
+	}
+
+	SQL := `INSERT INTO user_totp (user_id, secret)
+			VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE
+			    SET secret         = excluded.secret,
+			        last_used_step = 0,
+			        created_at     = now()
+			    WHERE user_totp.enabled_at IS NULL`
+
+	result, err := srv.PSQL.DB().Exec(SQL, uc.ID, secret)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to enroll two factor authentication")
+		return
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("two factor authentication already enabled"), http.StatusConflict, "two factor authentication already enabled")
+		return
+	}
+
+	account := userInfo.Email.String
+	if account == "" {
+		account = userInfo.Name
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(secret, account),
+	})
+}
+
+/*
+  - activateTwoFactor
+  - @Description This method is used to finish enrolling in two factor
+    authentication with a code from the authenticator app. It returns
+    the recovery codes, they are never shown again.
+*/
+func (srv *Server) activateTwoFactor(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var activateRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&activateRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	var codes []string
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		valid, err := checkTOTP(tx, uc.ID, activateRequest.Code, false)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return errInvalidTwoFactorCode
+		}
+
+		SQL := `UPDATE user_totp SET enabled_at = now() WHERE user_id = $1`
+		if _, err := tx.Exec(SQL, uc.ID); err != nil {
+			return err
+		}
+
+		if codes, err = replaceRecoveryCodes(tx, uc.ID); err != nil {
+			return err
+		}
+
+		// the session enrolling is trusted, the user does not have to log in again
+		return markSessionVerified(tx, uc.ID, uc.Session.Token)
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidTwoFactorCode) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, err.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to activate two factor authentication")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"recoveryCodes": codes,
+	})
+}
+
+/*
+  - regenerateRecoveryCodes
+  - @Description This method is used to replace the recovery codes of
+    the user after checking a code from the authenticator app.
+*/
+func (srv *Server) regenerateRecoveryCodes(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var regenerateRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&regenerateRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	var codes []string
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		valid, err := checkTOTP(tx, uc.ID, regenerateRequest.Code, true)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return errInvalidTwoFactorCode
+		}
+
+		codes, err = replaceRecoveryCodes(tx, uc.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidTwoFactorCode) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, err.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to regenerate recovery codes")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"recoveryCodes": codes,
+	})
+}
+
+/*
+  - disableTwoFactor
+  - @Description This method is used to turn off two factor
+    authentication with a code from the authenticator app. Admins
+    lose access to the admin panel until they enroll again.
+*/
+func (srv *Server) disableTwoFactor(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var disableRequest struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&disableRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		valid, err := checkTOTP(tx, uc.ID, disableRequest.Code, true)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return errInvalidTwoFactorCode
+		}
+
+		for _, SQL := range []string{
+			`DELETE FROM user_recovery_codes WHERE user_id = $1`,
+			`DELETE FROM session_second_factors WHERE user_id = $1`,
+			`DELETE FROM user_totp WHERE user_id = $1`,
+		} {
+			if _, err := tx.Exec(SQL, uc.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidTwoFactorCode) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, err.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to disable two factor authentication")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
+
+/*
+  - createTwoFactorChallenge
+  - @Description This method is the second step of the login of users
+    with two factor authentication enabled. It returns a short-lived
+    challenge token for the session, to send back with a code.
+*/
+func (srv *Server) createTwoFactorChallenge(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	if uc.Session == nil {
+		connectuperror.RespondClientErr(resp, req, errors.New("session not found"), http.StatusBadRequest, "session not found")
+		return
+	}
+
+	if err := twoFactorChallengeLimit.take(srv.PSQL.DB(), strconv.Itoa(uc.ID)); err != nil {
+		var retry retryError
+		if errors.As(err, &retry) {
+			respondRetryErr(resp, req, retry)
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create challenge")
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create challenge")
+		return
+	}
+
+	expiresAt := time.Now().Add(twoFactorChallengeTTL)
+
+	SQL := `INSERT INTO two_factor_challenges (user_id, session_token, token_hash, expires_at)
+			SELECT user_id, $2, $3, $4
+			FROM user_totp
+			WHERE user_id = $1
+			  AND enabled_at IS NOT NULL`
+
+	result, err := srv.PSQL.DB().Exec(SQL, uc.ID, uc.Session.Token, hashSecret(token), expiresAt)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create challenge")
+		return
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("two factor authentication not enabled"), http.StatusBadRequest, "two factor authentication not enabled")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"challengeToken": token,
+		"expiresAt":      expiresAt,
+	})
+}
+
+/*
+  - verifyTwoFactorChallenge
+  - @Description This method is used to complete the login with the
+    challenge token and either a code from the authenticator app or
+    one of the recovery codes.
+*/
+func (srv *Server) verifyTwoFactorChallenge(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var verifyRequest struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&verifyRequest); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
+	if uc.Session == nil {
+		connectuperror.RespondClientErr(resp, req, errors.New("session not found"), http.StatusBadRequest, "session not found")
+		return
+	}
+
+	errChallengeInvalid := errors.New("challenge is invalid or expired")
+
+	var valid bool
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		if err := twoFactorFailureLimit.check(tx, strconv.Itoa(uc.ID)); err != nil {
+			return err
+		}
+
+		SQL := `UPDATE two_factor_challenges
+				SET attempts = attempts + 1
+				WHERE token_hash = $1
+				  AND session_token = $2
+				RETURNING id, user_id, attempts, expires_at, completed_at`
+
+		var challenge twoFactorChallenge
+		if err := tx.Get(&challenge, SQL, hashSecret(verifyRequest.ChallengeToken), uc.Session.Token); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errChallengeInvalid
+			}
+			return err
+		}
+
+		if challenge.Completed.Valid || time.Now().After(challenge.ExpiresAt) || challenge.Attempts > maxTwoFactorChallengeAttempts {
+			return errChallengeInvalid
+		}
+
+		var err error
+		if verifyRequest.RecoveryCode != "" {
+			valid, err = useRecoveryCode(tx, challenge.UserID, verifyRequest.RecoveryCode)
+		} else {
+			valid, err = checkTOTP(tx, challenge.UserID, verifyRequest.Code, true)
+		}
+		if err != nil {
+			return err
+		}
+		if !valid {
+			// the attempt is kept even though the code is wrong
+			return twoFactorFailureLimit.hit(tx, strconv.Itoa(uc.ID))
+		}
+
+		SQL = `UPDATE two_factor_challenges SET completed_at = now() WHERE id = $1`
+		if _, err := tx.Exec(SQL, challenge.ID); err != nil {
+			return err
+		}
+		return markSessionVerified(tx, challenge.UserID, uc.Session.Token)
+	})
+	if err != nil {
+		var retry retryError
+		if errors.As(err, &retry) {
+			respondRetryErr(resp, req, retry)
+			return
+		}
+		if errors.Is(err, errChallengeInvalid) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusUnauthorized, err.Error())
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to verify challenge")
+		return
+	}
+
+	if !valid {
+		connectuperror.RespondClientErr(resp, req, errInvalidTwoFactorCode, http.StatusUnauthorized, errInvalidTwoFactorCode.Error())
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+const testUserID = 7
+
+// fakeTOTPStore answers the user_totp queries of checkTOTP from memory.
+type fakeTOTPStore struct {
+	totp    userTOTP
+	enabled bool
+	updates int
+}
+
+func (s *fakeTOTPStore) Get(dest interface{}, _ string, args ...interface{}) error {
+	if args[0] != testUserID || args[1] != s.enabled {
+		return sql.ErrNoRows
+	}
+	*dest.(*userTOTP) = s.totp
+	return nil
+}
+
+func (s *fakeTOTPStore) Exec(_ string, args ...interface{}) (sql.Result, error) {
+	s.totp.LastUsedStep = args[1].(int64)
+	s.updates++
+	return driver.RowsAffected(1), nil
+}
+
+func newFakeTOTPStore(t *testing.T, enabled bool) *fakeTOTPStore {
+	t.Helper()
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatalf("newTOTPSecret() error = %v", err)
+	}
+	return &fakeTOTPStore{totp: userTOTP{Secret: secret}, enabled: enabled}
+}
+
+func testTOTPCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	code, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatalf("totpCode() error = %v", err)
+	}
+	return code
+}
+
+func TestCheckTOTPAcceptsCurrentCode(t *testing.T) {
+	store := newFakeTOTPStore(t, true)
+	step := totpStep(time.Now())
+
+	valid, err := checkTOTP(store, testUserID, " "+testTOTPCode(t, store.totp.Secret, step)+" ", true)
+	if err != nil {
+		t.Fatalf("checkTOTP() error = %v", err)
+	}
+	if !valid {
+		t.Fatal("checkTOTP() = false, want the code of the current step accepted")
+	}
+	if store.totp.LastUsedStep < step {
+		t.Errorf("last_used_step = %d, want at least %d", store.totp.LastUsedStep, step)
+	}
+}
+
+func TestCheckTOTPRejectsCodesOutsideTheWindow(t *testing.T) {
+	store := newFakeTOTPStore(t, true)
+	step := totpStep(time.Now())
+
+	for _, offset := range []int64{-3, 3} {
+		valid, err := checkTOTP(store, testUserID, testTOTPCode(t, store.totp.Secret, step+offset), true)
+		if err != nil {
+			t.Fatalf("checkTOTP() error = %v", err)
+		}
+		if valid {
+			t.Errorf("checkTOTP() = true for a code %d steps away, want it refused", offset)
+		}
+	}
+	if store.updates != 0 {
+		t.Errorf("last_used_step updated %d times, want refused codes to leave it", store.updates)
+	}
+}
+
+func TestCheckTOTPRejectsReusedStep(t *testing.T) {
+	store := newFakeTOTPStore(t, true)
+	step := totpStep(time.Now())
+	code := testTOTPCode(t, store.totp.Secret, step)
+
+	if valid, err := checkTOTP(store, testUserID, code, true); err != nil || !valid {
+		t.Fatalf("checkTOTP() = %t, %v, want the first use accepted", valid, err)
+	}
+
+	valid, err := checkTOTP(store, testUserID, code, true)
+	if err != nil {
+		t.Fatalf("checkTOTP() error = %v", err)
+	}
+	if valid {
+		t.Error("checkTOTP() = true for a code used before, want it refused")
+	}
+
+	// a code of an earlier step within the window is refused once a later one was used
+	store.totp.LastUsedStep = step
+	valid, err = checkTOTP(store, testUserID, testTOTPCode(t, store.totp.Secret, step-1), true)
+	if err != nil {
+		t.Fatalf("checkTOTP() error = %v", err)
+	}
+	if valid {
+		t.Error("checkTOTP() = true for a step before last_used_step, want it refused")
+	}
+}
+
+func TestCheckTOTPPendingAndEnabledSecrets(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		store := newFakeTOTPStore(t, enabled)
+		code := testTOTPCode(t, store.totp.Secret, totpStep(time.Now()))
+
+		valid, err := checkTOTP(store, testUserID, code, !enabled)
+		if err != nil {
+			t.Fatalf("checkTOTP() error = %v", err)
+		}
+		if valid {
+			t.Errorf("checkTOTP(enabled=%t) = true for a secret with enabled=%t, want it refused", !enabled, enabled)
+		}
+
+		valid, err = checkTOTP(store, testUserID, code, enabled)
+		if err != nil {
+			t.Fatalf("checkTOTP() error = %v", err)
+		}
+		if !valid {
+			t.Errorf("checkTOTP(enabled=%t) = false, want the code accepted", enabled)
+		}
+	}
+}
@@ -0,0 +1,734 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxUploadSize = 51 << 20
+
+	// mimeSniffLength is the number of leading bytes used to detect the content type of an upload.
+	mimeSniffLength = 3072
+
+	uploadURLExpiry = time.Hour * 24 * 365
+)
+
+// uploadContext carries a single multipart upload through the stages of an uploadPipeline.
+type uploadContext struct {
+	srv    *Server
+	resp   http.ResponseWriter
+	req    *http.Request
+	uc     *models.UserContext
+	file   multipart.File
+	header *multipart.FileHeader
+
+	binaryType models.UploadBinaryType
+	uploadType models.UploadType
+	mimeType   string
+
+	// contentHash is the hex encoded SHA-256 of the file as it is stored, size its length in bytes.
+	contentHash string
+	size        int64
+
+	filePath     string
+	url          string
+	thumbnailURL string
+	upload       models.Upload
+	variants     []uploadVariant
+	audio        *audioMetadata
+	document     *documentMetadata
+
+	// renderedDocument is the document preview waiting to be stored by storeDocumentPreview.
+	renderedDocument *renderedDocument
+	// renderedThumbnail is the video thumbnail waiting to be stored by storeVideoThumbnail.
+	renderedThumbnail *renderedImage
+	// renderedPNG is the PNG rendering of an SVG upload waiting to be stored by storeSVGToPNG.
+	renderedPNG *renderedImage
+
+	// original holds the bytes as they were sent when a transform replaced file and they must be kept.
+	original []byte
+	cleanup  []func()
+
+	// tx is the transaction of the stage being run, stored the objects it and the prepare stages
+	// before it wrote so far. They are deleted again when the transaction does not commit.
+	tx     *sqlx.Tx
+	stored []string
+}
+
+// onCleanup registers fn to run once the upload has been processed, e.g. to remove temp files.
+func (uctx *uploadContext) onCleanup(fn func()) {
+	uctx.cleanup = append(uctx.cleanup, fn)
+}
+
+func (uctx *uploadContext) runCleanup() {
+	for i := len(uctx.cleanup) - 1; i >= 0; i-- {
+		uctx.cleanup[i]()
+	}
+	uctx.cleanup = nil
+}
+
+// storeObject writes src to the uploads bucket. The object is deleted again if the transaction
+// of the current stage does not commit.
+func (uctx *uploadContext) storeObject(src io.Reader, filePath string, public bool) error {
+	err := uctx.srv.StorageProvider.Upload(uctx.req.Context(), utils.GetUploadsBucketName(), src, filePath, "application/octet-stream", public)
+	if err != nil {
+		return err
+	}
+	uctx.stored = append(uctx.stored, filePath)
+	return nil
+}
+
+// storeSharedObject is storeObject for objects handed out to clients, it returns their sharable url.
+func (uctx *uploadContext) storeSharedObject(src io.Reader, filePath string, public bool) (string, error) {
+	if err := uctx.storeObject(src, filePath, public); err != nil {
+		return "", err
+	}
+	return uctx.srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), filePath, uploadURLExpiry)
+}
+
+// deleteStoredObjects removes every object written since the current transaction began.
+func (uctx *uploadContext) deleteStoredObjects() {
+	// the request may already be cancelled, the compensating deletes must still go through
+	ctx := context.Background()
+	for _, filePath := range uctx.stored {
+		if err := uctx.srv.StorageProvider.Delete(ctx, utils.GetUploadsBucketName(), filePath); err != nil {
+			logrus.Errorf("deleteStoredObjects: unable to delete %s: %v", filePath, err)
+		}
+	}
+	uctx.stored = nil
+}
+
+// inUploadTx runs fn in a transaction. When fn fails or the commit does, the transaction is rolled
+// back and the objects fn stored are deleted, so nothing of it is left behind. Objects stored by
+// prepare stages are deleted along with them.
+func (srv *Server) inUploadTx(uctx *uploadContext, fn func(uctx *uploadContext) error) error {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		uctx.deleteStoredObjects()
+		return err
+	}
+
+	uctx.tx = tx
+	defer func() {
+		uctx.tx = nil
+	}()
+
+	err = fn(uctx)
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			logrus.Errorf("inUploadTx: unable to rollback %v", rollbackErr)
+		}
+		uctx.deleteStoredObjects()
+		return err
+	}
+
+	uctx.stored = nil
+	return nil
+}
+
+// uploadError is returned by a stage to reject an upload with a message meant for the client.
+type uploadError struct {
+	err        error
+	statusCode int
+	message    string
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func rejectUpload(statusCode int, message string) error {
+	return &uploadError{
+		err:        errors.New(strings.ToLower(message)),
+		statusCode: statusCode,
+		message:    message,
+	}
+}
+
+// rejectUploadWithCode rejects the upload with a machine-readable code as the error, next to the message.
+func rejectUploadWithCode(statusCode int, code, message string) error {
+	return &uploadError{
+		err:        errors.New(code),
+		statusCode: statusCode,
+		message:    message,
+	}
+}
+
+// uploadStage is a single step of the upload pipeline.
+type uploadStage func(uctx *uploadContext) error
+
+// uploadPipeline describes how a multipart upload is validated, transformed, stored and registered.
+// Stages in validate and transform can reject the upload. prepare stages run once the upload is known
+// not to be a duplicate, for slow work such as rendering that must stay out of the transaction. derive
+// stages store files generated from the upload in the transaction that registers it, so a failure
+// leaves neither of them behind.
+// postProcess stages run once the upload is registered, each in its own transaction, and only
+// log their failures.
+type uploadPipeline struct {
+	name string
+
+	// binaryType and uploadType override the form values when set.
+	binaryType models.UploadBinaryType
+	uploadType models.UploadType
+
+	validate    []uploadStage
+	transform   []uploadStage
+	prepare     []uploadStage
+	derive      []uploadStage
+	postProcess []uploadStage
+}
+
+var (
+	// defaultUploadPipeline is used by upload and uploadV2 for every binary type.
+	defaultUploadPipeline = uploadPipeline{
+		name:        "upload",
+		validate:    []uploadStage{validateUploadPath, enforceUploadQuota, sniffMIMEType},
+		transform:   []uploadStage{normalizeImage, transcodeAudio},
+		prepare:     []uploadStage{renderVideoThumbnail, renderDocumentPreview, renderSVGToPNG},
+		derive:      []uploadStage{storeAudioMetadata, storeVideoThumbnail, storeDocumentPreview, storeSVGToPNG},
+		postProcess: []uploadStage{storeModerationOriginal, generateImageVariants},
+	}
+
+	// profileImageUploadPipeline is used by uploadImageV3 and only accepts images with a single clear face.
+	profileImageUploadPipeline = uploadPipeline{
+		name:        "uploadImageV3",
+		binaryType:  models.UploadBinaryTypeImage,
+		uploadType:  models.UploadTypeUserProfileImage,
+		validate:    []uploadStage{validateUploadPath, enforceUploadQuota, sniffMIMEType, requireMediaType(models.MIMEMediaTypeImage)},
+		transform:   []uploadStage{normalizeImage, checkSingleFace},
+		postProcess: []uploadStage{storeModerationOriginal, generateImageVariants},
+	}
+)
+
+/*
+  - handleUpload
+  - @Description This method runs the given pipeline for the multipart file
+    sent in the request and responds with the registered upload.
+*/
+func (srv *Server) handleUpload(resp http.ResponseWriter, req *http.Request, pipeline uploadPipeline) {
+	startTime := time.Now()
+
+	defer func(req *http.Request) {
+		if req.MultipartForm != nil { // prevent panic from nil pointer
+			if err := req.MultipartForm.RemoveAll(); err != nil {
+				logrus.Errorf("Unable to remove all multipart form. %+v", err)
+			}
+		}
+	}(req)
+
+	req.Body = http.MaxBytesReader(resp, req.Body, maxUploadSize)
+
+	if err := req.ParseMultipartForm(maxUploadSize); err != nil {
+		if err == io.EOF || err.Error() == string(models.MultipartUnexpectedEOF) {
+			logrus.Warn("EOF")
+		} else {
+			logrus.Errorf("[ParseMultipartForm] %s", err.Error())
+		}
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to parse file", "error parsing file")
+		return
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		if err == io.EOF {
+			logrus.Warn("EOF")
+		} else {
+			logrus.Error(err)
+		}
+
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to read file", "unable to read file")
+		return
+	}
+
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("Unable to close file multipart form. %+v", err)
+		}
+	}()
+
+	uctx := &uploadContext{
+		srv:        srv,
+		resp:       resp,
+		req:        req,
+		uc:         srv.getUserContext(req),
+		file:       file,
+		header:     header,
+		binaryType: models.UploadBinaryType(req.FormValue("upload_binary_type")),
+		uploadType: models.UploadType(req.FormValue("type")),
+	}
+
+	if err := srv.processUpload(uctx, pipeline); err != nil {
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	respondUpload(resp, uctx)
+	logrus.Infof("%s: request time upload data successfully: %d", pipeline.name, time.Since(startTime).Milliseconds())
+}
+
+// processUpload runs every stage of the pipeline for an upload whose file, header and types are already set.
+func (srv *Server) processUpload(uctx *uploadContext, pipeline uploadPipeline) error {
+	defer uctx.runCleanup()
+
+	if pipeline.binaryType != "" {
+		uctx.binaryType = pipeline.binaryType
+	}
+
+	if pipeline.uploadType != "" {
+		uctx.uploadType = pipeline.uploadType
+	}
+
+	if err := runUploadStages(uctx, pipeline.validate); err != nil {
+		return err
+	}
+
+	if err := runUploadStages(uctx, pipeline.transform); err != nil {
+		return err
+	}
+
+	if err := hashUpload(uctx); err != nil {
+		return err
+	}
+
+	reused, err := srv.reuseUpload(uctx)
+	if err != nil {
+		return err
+	}
+
+	if reused {
+		logrus.Infof("%s: reusing upload %d for content hash %s", pipeline.name, uctx.upload.FileID, uctx.contentHash)
+		return nil
+	}
+
+	if err := runUploadStages(uctx, pipeline.prepare); err != nil {
+		uctx.deleteStoredObjects()
+		return err
+	}
+
+	err = srv.inUploadTx(uctx, func(uctx *uploadContext) error {
+		if err := srv.storeUpload(uctx); err != nil {
+			return err
+		}
+
+		if err := reserveUploadQuota(uctx); err != nil {
+			return err
+		}
+
+		upload, err := srv.registerUpload(uctx.tx, uploadRecord{
+			Name:        uctx.header.Filename,
+			Path:        uctx.filePath,
+			Type:        uctx.uploadType,
+			BinaryType:  uctx.binaryType,
+			UploadedBy:  uctx.uc.ID,
+			URL:         uctx.url,
+			Size:        uctx.size,
+			ContentHash: uctx.contentHash,
+		})
+		if err != nil {
+			logrus.Errorf("%s: error inserting into upload: %v", pipeline.name, err)
+			return err
+		}
+		uctx.upload = upload
+
+		return runUploadStages(uctx, pipeline.derive)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, stage := range pipeline.postProcess {
+		// a stage that is rolled back must not leave its variants in the response
+		variants := uctx.variants
+		if err := srv.inUploadTx(uctx, stage); err != nil {
+			uctx.variants = variants
+			logrus.Errorf("%s: post processing failed for upload %d: %v", pipeline.name, uctx.upload.FileID, err)
+		}
+	}
+
+	if uctx.thumbnailURL == "" && uctx.binaryType != models.UploadBinaryTypeVideo {
+		uctx.thumbnailURL = uctx.url
+	}
+	return nil
+}
+
+func respondUpload(resp http.ResponseWriter, uctx *uploadContext) {
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"id":           uctx.upload.FileID,
+		"imageUID":     uctx.upload.FileUUID,
+		"url":          uctx.url,
+		"thumbnailUrl": uctx.thumbnailURL,
+		"variants":     uctx.variants,
+		"audio":        uctx.audio,
+		"document":     uctx.document,
+	})
+}
+
+func runUploadStages(uctx *uploadContext, stages []uploadStage) error {
+	for _, stage := range stages {
+		if err := stage(uctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func respondUploadErr(resp http.ResponseWriter, req *http.Request, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		connectuperror.RespondClientErr(resp, req, uploadErr.err, uploadErr.statusCode, uploadErr.message)
+		return
+	}
+	connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload file")
+}
+
+// storeUpload writes the upload to the bucket and fills its sharable url, unless a prepare stage
+// stored it already.
+func (srv *Server) storeUpload(uctx *uploadContext) error {
+	if uctx.url != "" {
+		return nil
+	}
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	url, err := uctx.storeSharedObject(uctx.file, uctx.filePath, false)
+	if err != nil {
+		return err
+	}
+	uctx.url = url
+	return nil
+}
+
+// uploadRecord is a stored object about to be registered in the uploads table.
+type uploadRecord struct {
+	Name       string
+	Path       string
+	Type       models.UploadType
+	BinaryType models.UploadBinaryType
+	UploadedBy int
+	URL        string
+	Size       int64
+
+	// ContentHash is left empty for derived files such as thumbnails, which are never deduplicated
+	// nor scanned since they are generated from an upload that is.
+	ContentHash string
+}
+
+// registerUpload inserts an already stored object into the uploads table.
+func (srv *Server) registerUpload(db sqlGetter, record uploadRecord) (models.Upload, error) {
+	SQL := `INSERT INTO uploads
+			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time, content_hash, scan_status, size)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11)
+			RETURNING id, u_id`
+
+	scanStatus := uploadScanStatusPending
+	if record.ContentHash == "" {
+		scanStatus = uploadScanStatusNotScanned
+	}
+
+	args := []interface{}{
+		record.Name,
+		utils.GetUploadsBucketName(),
+		record.Path,
+		record.Type,
+		record.UploadedBy,
+		record.BinaryType,
+		record.URL,
+		time.Now().Add(uploadURLExpiry),
+		record.ContentHash,
+		scanStatus,
+		record.Size,
+	}
+
+	var upload models.Upload
+	err := db.Get(&upload, SQL, args...)
+	return upload, err
+}
+
+// uploadPath returns the bucket path for a new object of the given binary and upload type.
+func uploadPath(binaryType models.UploadBinaryType, uploadType models.UploadType, fileName string) (string, error) {
+	var folder string
+	switch binaryType {
+	case models.UploadBinaryTypeImage:
+		folder = "images"
+	case models.UploadBinaryTypeVideo:
+		folder = "videos"
+	case models.UploadBinaryTypeAudio:
+		folder = "audios"
+	case models.UploadBinaryTypeDocument:
+		folder = "documents"
+	default:
+		return "", errors.New("file type not valid")
+	}
+	return fmt.Sprintf(`%s/%v/%v-%s`, folder, uploadType, time.Now().Unix(), fileName), nil
+}
+
+func validateUploadPath(uctx *uploadContext) error {
+	filePath, err := uploadPath(uctx.binaryType, uctx.uploadType, uctx.header.Filename)
+	if err != nil {
+		return &uploadError{err: err, statusCode: http.StatusBadRequest, message: "invalid file type"}
+	}
+	uctx.filePath = filePath
+	return nil
+}
+
+func sniffMIMEType(uctx *uploadContext) error {
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	head := make([]byte, mimeSniffLength)
+	n, err := io.ReadFull(uctx.file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	uctx.mimeType = mimetype.Detect(head[:n]).String()
+	_, err = uctx.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func requireMediaType(mediaType models.MIMEMediaType) uploadStage {
+	return func(uctx *uploadContext) error {
+		if strings.Split(uctx.mimeType, "/")[0] != string(mediaType) {
+			return rejectUpload(http.StatusBadRequest, fmt.Sprintf("file is not an %s", mediaType))
+		}
+		return nil
+	}
+}
+
+// storeVideoThumbnail stores the thumbnail rendered by renderVideoThumbnail.
+func storeVideoThumbnail(uctx *uploadContext) error {
+	rendered := uctx.renderedThumbnail
+	if rendered == nil {
+		return nil
+	}
+
+	if _, err := rendered.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	thumbURL, err := uctx.srv.storeThumbnail(uctx, rendered.file, rendered.size)
+	if err != nil {
+		return err
+	}
+	uctx.thumbnailURL = thumbURL
+	return nil
+}
+
+// renderSVGToPNG renders an SVG upload to PNG before the upload transaction, storeSVGToPNG stores
+// the PNG in it.
+func renderSVGToPNG(uctx *uploadContext) error {
+	if !strings.Contains(uctx.header.Filename, ".svg") {
+		return nil
+	}
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		logrus.Errorf("unable to seek the file %v", err)
+		return err
+	}
+
+	pngFileName, err := utils.ConvertToPNG(uctx.file)
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := os.Remove(pngFileName); err != nil {
+			logrus.Errorf("unable to remove file %v", err)
+		}
+	})
+
+	pngFile, err := os.Open(pngFileName)
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := pngFile.Close(); err != nil {
+			logrus.Errorf("renderSVGToPNG: unable to close png file %v", err)
+		}
+	})
+
+	var pngSize int64
+	if info, err := pngFile.Stat(); err == nil {
+		pngSize = info.Size()
+	}
+
+	uctx.renderedPNG = &renderedImage{file: pngFile, size: pngSize}
+	return nil
+}
+
+// storeSVGToPNG stores the PNG rendered by renderSVGToPNG and links it in the svg_to_png table.
+func storeSVGToPNG(uctx *uploadContext) error {
+	rendered := uctx.renderedPNG
+	if rendered == nil {
+		return nil
+	}
+
+	if _, err := rendered.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	pngFileName := rendered.file.Name()
+	url, err := uctx.storeSharedObject(rendered.file, pngFileName, true)
+	if err != nil {
+		return err
+	}
+
+	pngFiles, err := uctx.srv.registerUpload(uctx.tx, uploadRecord{
+		Name:       fmt.Sprintf("%v-%v.png", "industry", time.Now().Unix()),
+		Path:       pngFileName,
+		Type:       uctx.uploadType,
+		BinaryType: models.UploadBinaryTypeImage,
+		UploadedBy: uctx.uc.ID,
+		URL:        url,
+		Size:       rendered.size,
+	})
+	if err != nil {
+		logrus.Errorf("storeSVGToPNG: error inserting into upload: %v", err)
+		return err
+	}
+
+	SQL := `insert into svg_to_png (svg_id, png_id) values ($1,$2);`
+
+	_, err = uctx.tx.Exec(SQL, uctx.upload.FileID, pngFiles.FileID)
+	if err != nil {
+		logrus.Errorf("storeSVGToPNG: error inserting into svg_to_png: %v", err)
+		return err
+	}
+	return nil
+}
+
+// renderedImage is an image rendered ahead of the transaction that stores it.
+type renderedImage struct {
+	file *os.File
+	size int64
+}
+
+// renderVideoThumbnail generates the thumbnail of a video upload before the upload transaction,
+// storeVideoThumbnail stores it in the transaction. The thumbnail service fetches the video from
+// its url, so with that backend the video is stored here already. It is deleted again when the
+// upload transaction does not commit.
+func renderVideoThumbnail(uctx *uploadContext) error {
+	if uctx.binaryType != models.UploadBinaryTypeVideo {
+		return nil
+	}
+
+	thumbnailer := uctx.srv.thumbnailer()
+	if _, ok := thumbnailer.(httpThumbnailer); ok {
+		if err := uctx.srv.storeUpload(uctx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "thumbnail-*")
+	if err != nil {
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Errorf("renderVideoThumbnail: unable to remove temp dir %v", err)
+		}
+	})
+
+	file, err := os.Create(filepath.Join(dir, "thumbnail.png"))
+	if err != nil {
+		logrus.Errorf("renderVideoThumbnail: unable to create file %v", err)
+		return err
+	}
+	uctx.onCleanup(func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("renderVideoThumbnail: unable to close file %v", err)
+		}
+	})
+
+	src := thumbnailSource{
+		URL:      uctx.url,
+		FileName: uctx.header.Filename,
+		File:     uctx.file,
+	}
+
+	limited := &limitedWriter{w: file, remaining: maxThumbnailSize}
+	if err := thumbnailer.Thumbnail(uctx.req.Context(), src, limited); err != nil {
+		return err
+	}
+
+	uctx.renderedThumbnail = &renderedImage{file: file, size: maxThumbnailSize - limited.remaining}
+	return nil
+}
+
+// storeThumbnail stores a PNG preview of the upload and links it in the thumbnail table.
+func (srv *Server) storeThumbnail(uctx *uploadContext, png io.Reader, size int64) (string, error) {
+	FileName := fmt.Sprintf("%v%v.png", "thumbnail", time.Now().Unix())
+	FilePath := fmt.Sprintf(`images/%v/%v-%s`, models.UploadTypeThumbnail, time.Now().Unix(), FileName)
+
+	thumbURL, err := uctx.storeSharedObject(png, FilePath, true)
+	if err != nil {
+		return "", err
+	}
+
+	thumbnail, err := srv.registerUpload(uctx.tx, uploadRecord{
+		Name:       FileName,
+		Path:       FilePath,
+		Type:       models.UploadTypeThumbnail,
+		BinaryType: models.UploadBinaryTypeImage,
+		UploadedBy: uctx.uc.ID,
+		URL:        thumbURL,
+		Size:       size,
+	})
+	if err != nil {
+		logrus.Errorf("storeThumbnail: error inserting into upload: %v", err)
+		return "", err
+	}
+
+	SQL := `INSERT INTO thumbnail (upload_id, thumbnail_id) 
+			VALUES ($1, $2)`
+
+	_, err = uctx.tx.Exec(SQL, uctx.upload.FileID, thumbnail.FileID)
+	if err != nil {
+		logrus.Errorf("storeThumbnail: error inserting into thumbnail: %v", err)
+		return "", err
+	}
+
+	return thumbURL, nil
+}
+
+// limitedWriter fails once more than remaining bytes are written to it.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, errors.New("file size is more then 5 mb")
+	}
+	n, err := lw.w.Write(p)
+	lw.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// hashUpload streams the file through SHA-256 so identical uploads can share one object and row.
+func hashUpload(uctx *uploadContext) error {
+	if _, err := uctx.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, uctx.file)
+	if err != nil {
+		return err
+	}
+
+	uctx.size = size
+	uctx.contentHash = hex.EncodeToString(hash.Sum(nil))
+	_, err = uctx.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// reuseUpload looks for an upload of the same user with the same content hash and binary type. When
+// one exists its reference count is incremented and the upload context is filled from it instead of
+// storing a new object. Reuse is scoped to the uploader so the row stays attributed to whoever sent
+// it, for quotas, data exports and the garbage collector alike. Only uploads found clean, or never
+// scanned, are reused, so a copy never hands out an object before its verdict.
+func (srv *Server) reuseUpload(uctx *uploadContext) (bool, error) {
+	if uctx.contentHash == "" {
+		return false, nil
+	}
+
+	var existing struct {
+		ID   int    `db:"id"`
+		UID  string `db:"u_id"`
+		Path string `db:"path"`
+		URL  string `db:"url"`
+	}
+
+	err := srv.inTx(func(tx *sqlx.Tx) error {
+		// locked so it cannot be released or quarantined before the new reference is counted
+		SQL := `SELECT id, u_id, path, url
+				FROM uploads
+				WHERE uploaded_by = $1
+				  AND content_hash = $2
+				  AND binary_type = $3
+				  AND scan_status = ANY ($4)
+				ORDER BY id
+				LIMIT 1
+				FOR UPDATE`
+
+		reusable := pq.StringArray{string(uploadScanStatusClean), string(uploadScanStatusNotScanned)}
+		if err := tx.Get(&existing, SQL, uctx.uc.ID, uctx.contentHash, uctx.binaryType, reusable); err != nil {
+			return err
+		}
+
+		SQL = `UPDATE uploads
+			   SET ref_count = ref_count + 1,
+			       reused_at = now()
+			   WHERE id = $1`
+
+		_, err := tx.Exec(SQL, existing.ID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	uctx.upload.FileID = existing.ID
+	uctx.upload.FileUUID = existing.UID
+	uctx.filePath = existing.Path
+	uctx.url = existing.URL
+
+	if url, err := srv.freshUploadURL(existing.ID); err == nil {
+		uctx.url = url
+	} else {
+		logrus.Errorf("reuseUpload: unable to refresh url of upload %d: %v", existing.ID, err)
+	}
+
+	SQL = `SELECT u.url
+			FROM thumbnail t
+			    JOIN uploads u ON u.id = t.thumbnail_id
+			WHERE t.upload_id = $1
+			LIMIT 1`
+
+	err = srv.PSQL.DB().Get(&uctx.thumbnailURL, SQL, existing.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.Errorf("reuseUpload: unable to get thumbnail of upload %d: %v", existing.ID, err)
+	}
+
+	if uctx.thumbnailURL == "" {
+		uctx.thumbnailURL = uctx.url
+	}
+
+	variants, err := srv.getUploadVariants(existing.ID)
+	if err != nil {
+		logrus.Errorf("reuseUpload: unable to get variants of upload %d: %v", existing.ID, err)
+	}
+	uctx.variants = variants[existing.ID]
+
+	if uctx.binaryType == models.UploadBinaryTypeAudio {
+		audio, err := srv.getAudioMetadata(existing.ID)
+		if err != nil {
+			logrus.Errorf("reuseUpload: unable to get audio metadata of upload %d: %v", existing.ID, err)
+		}
+		if metadata, ok := audio[existing.ID]; ok {
+			uctx.audio = &metadata
+		}
+	}
+
+	if uctx.binaryType == models.UploadBinaryTypeDocument {
+		documents, err := srv.getDocumentMetadata(existing.ID)
+		if err != nil {
+			logrus.Errorf("reuseUpload: unable to get document metadata of upload %d: %v", existing.ID, err)
+		}
+		if metadata, ok := documents[existing.ID]; ok {
+			uctx.document = &metadata
+		}
+	}
+	return true, nil
+}
+
+// releaseUpload drops one reference of the user to an upload. The rows and objects are only removed
+// once no reference is left and nothing points to the upload anymore, so discarding a deduplicated
+// upload never breaks another copy. Objects are deleted after the commit, a failed delete only leaks
+// storage and never leaves a row without its object.
+func (srv *Server) releaseUpload(uploadID, userID int) error {
+	references, err := srv.uploadReferences()
+	if err != nil {
+		return err
+	}
+
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("releaseUpload: unable to rollback %v", err)
+		}
+	}()
+
+	SQL := `UPDATE uploads
+			SET ref_count = ref_count - 1
+			WHERE id = $1
+			  AND uploaded_by = $2
+			  AND ref_count > 0
+			RETURNING ref_count`
+
+	var refCount int
+	if err := tx.Get(&refCount, SQL, uploadID, userID); err != nil {
+		return err
+	}
+
+	if refCount > 0 {
+		return tx.Commit()
+	}
+
+	var referenced bool
+	if err := tx.Get(&referenced, uploadReferencedQuery(references), uploadID); err != nil {
+		return err
+	}
+
+	// a referenced upload is kept, the garbage collector removes it once the reference is gone
+	if referenced {
+		return tx.Commit()
+	}
+
+	objects, _, err := deleteUploadRows(tx, []int{uploadID})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// the request may already be cancelled, the deletes must still go through
+	ctx := context.Background()
+	for _, object := range objects {
+		if err := srv.StorageProvider.Delete(ctx, object.Bucket, object.Path); err != nil {
+			logrus.Errorf("releaseUpload: unable to delete %s/%s: %v", object.Bucket, object.Path, err)
+		}
+	}
+	return nil
+}
+
+// uploadReferencedQuery tells whether the upload $1 is referenced from one of references, or is a
+// file derived from another upload.
+func uploadReferencedQuery(references []uploadReference) string {
+	conditions := []string{
+		`EXISTS (SELECT 1 FROM thumbnail t WHERE t.thumbnail_id = $1)`,
+		`EXISTS (SELECT 1 FROM svg_to_png sp WHERE sp.png_id = $1)`,
+		`EXISTS (SELECT 1 FROM upload_variants uv WHERE uv.variant_id = $1)`,
+	}
+
+	for _, reference := range references {
+		conditions = append(conditions, fmt.Sprintf(`EXISTS (SELECT 1 FROM %s r WHERE r.%s = $1)`, reference.Table, reference.Column))
+	}
+	return `SELECT ` + strings.Join(conditions, "\n\t\t\t    OR ")
+}
+
+/*
+  - discardUpload
+  - @Description This method is used to drop an upload the client no longer
+    needs, e.g. an attachment removed before sending. Identical uploads of
+    the user share one object, which is only deleted once every copy has
+    been discarded and nothing references it.
+*/
+func (srv *Server) discardUpload(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+	uploadID, err := strconv.Atoi(chi.URLParam(req, "uploadID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing uploadId")
+		return
+	}
+
+	if err := srv.releaseUpload(uploadID, uc.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			connectuperror.RespondClientErr(resp, req, err, http.StatusNotFound, "upload not found")
+			return
+		}
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to discard upload")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadGCEnabledConfig turns on the deletion of orphaned uploads, the report endpoint works either way.
+	uploadGCEnabledConfig = "UPLOAD_GC_ENABLED"
+	// uploadGCGraceHoursConfig is how old an unreferenced upload must be before it is collected.
+	uploadGCGraceHoursConfig = "UPLOAD_GC_GRACE_HOURS"
+	// uploadGCExtraReferencesConfig lists "table.column" pairs that hold upload ids without a foreign key.
+	uploadGCExtraReferencesConfig = "UPLOAD_GC_EXTRA_REFERENCES"
+
+	defaultUploadGCGrace = 7 * 24 * time.Hour
+	uploadGCBatchSize    = 100
+)
+
+// uploadLinkTables link an upload to the files derived from it. They never keep an upload alive,
+// the derived files are deleted together with the upload they belong to.
+var uploadLinkTables = map[string]bool{
+	"thumbnail":        true,
+	"svg_to_png":       true,
+	"upload_variants":  true,
+	"upload_originals": true,
+	"upload_sessions":  true,
+	"upload_audio":     true,
+	"upload_documents": true,
+}
+
+type uploadReference struct {
+	Table  string `db:"table_name"`
+	Column string `db:"column_name"`
+}
+
+type orphanedUpload struct {
+	ID        int       `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Path      string    `json:"path" db:"path"`
+	Type      string    `json:"type" db:"type"`
+	Size      int64     `json:"size" db:"size"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+func (srv *Server) uploadGCGrace() time.Duration {
+	if hours := srv.DynamicConfig.GetInt(uploadGCGraceHoursConfig); hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultUploadGCGrace
+}
+
+// uploadReferences returns every column that points to uploads, from the foreign keys of the schema
+// plus the extra references configured for columns without one.
+func (srv *Server) uploadReferences() ([]uploadReference, error) {
+	SQL := `SELECT c.conrelid::regclass::TEXT AS table_name,
+			       a.attname                   AS column_name
+			FROM pg_constraint c
+			    JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+			WHERE c.contype = 'f'
+			  AND c.confrelid = 'uploads'::regclass`
+
+	foreignKeys := make([]uploadReference, 0)
+	if err := srv.PSQL.DB().Select(&foreignKeys, SQL); err != nil {
+		return nil, err
+	}
+
+	references := make([]uploadReference, 0, len(foreignKeys))
+	for _, reference := range foreignKeys {
+		if uploadLinkTables[reference.Table] {
+			continue
+		}
+		references = append(references, uploadReference{
+			Table:  reference.Table,
+			Column: pq.QuoteIdentifier(reference.Column),
+		})
+	}
+
+	for _, extra := range strings.Split(srv.DynamicConfig.GetString(uploadGCExtraReferencesConfig), ",") {
+		table, column, found := strings.Cut(strings.TrimSpace(extra), ".")
+		if !found {
+			continue
+		}
+		references = append(references, uploadReference{
+			Table:  pq.QuoteIdentifier(table),
+			Column: pq.QuoteIdentifier(column),
+		})
+	}
+	return references, nil
+}
+
+// orphanedUploadsQuery selects uploads that nothing references and that are not themselves derived
+// from another upload, leaving out the ids in $3. Uploads still held by a deduplicated reference must
+// have been created or last reused before the grace period, the ones every holder released are
+// selected right away.
+func orphanedUploadsQuery(references []uploadReference, forUpdate bool) string {
+	conditions := []string{
+		`NOT (u.id = ANY ($3))`,
+		`(u.ref_count <= 0 OR coalesce(u.reused_at, u.created_at) < $1)`,
+		`NOT EXISTS (SELECT 1 FROM thumbnail t WHERE t.thumbnail_id = u.id)`,
+		`NOT EXISTS (SELECT 1 FROM svg_to_png sp WHERE sp.png_id = u.id)`,
+		`NOT EXISTS (SELECT 1 FROM upload_variants uv WHERE uv.variant_id = u.id)`,
+		`NOT EXISTS (SELECT 1 FROM upload_sessions us WHERE us.upload_id = u.id AND us.completed_at > $1)`,
+	}
+
+	for _, reference := range references {
+		conditions = append(conditions, fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM %s r WHERE r.%s = u.id)`, reference.Table, reference.Column))
+	}
+
+	SQL := `SELECT u.id, u.name, u.path, u.type, u.size, u.created_at
+			FROM uploads u
+			WHERE ` + strings.Join(conditions, "\n\t\t\t  AND ") + `
+			ORDER BY u.id
+			LIMIT $2`
+	if forUpdate {
+		SQL += ` FOR UPDATE OF u SKIP LOCKED`
+	}
+	return SQL
+}
+
+// collectOrphanedUploads deletes unreferenced uploads together with their thumbnails, PNGs, variants
+// and moderation originals, then drops expired resumable upload sessions.
+func (srv *Server) collectOrphanedUploads(ctx context.Context) error {
+	if !srv.DynamicConfig.GetBool(uploadGCEnabledConfig) {
+		return nil
+	}
+
+	references, err := srv.uploadReferences()
+	if err != nil {
+		return err
+	}
+
+	// uploads that cannot be deleted are skipped for the rest of the run and retried on the next one
+	skip := make([]int, 0)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		collected, failed, err := srv.collectOrphanedUploadBatch(ctx, references, skip)
+		if err != nil {
+			return err
+		}
+		skip = append(skip, failed...)
+
+		if collected < uploadGCBatchSize {
+			break
+		}
+	}
+
+	return srv.collectExpiredUploadSessions()
+}
+
+type uploadObject struct {
+	Bucket string `db:"bucket"`
+	Path   string `db:"path"`
+}
+
+// collectOrphanedUploadBatch deletes a batch of orphaned uploads, leaving out the ids in skip. Each
+// upload is deleted under its own savepoint, so one that cannot be deleted, for instance because of a
+// reference the garbage collector does not know about, does not hold back the rest of the batch. It
+// returns how many uploads were selected and the ids of the ones that could not be deleted.
+func (srv *Server) collectOrphanedUploadBatch(ctx context.Context, references []uploadReference, skip []int) (int, []int, error) {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("collectOrphanedUploadBatch: unable to rollback %v", err)
+		}
+	}()
+
+	orphans := make([]orphanedUpload, 0)
+	err = tx.Select(&orphans, orphanedUploadsQuery(references, true), time.Now().Add(-srv.uploadGCGrace()), uploadGCBatchSize, pq.Array(skip))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(orphans) == 0 {
+		return 0, nil, nil
+	}
+
+	deleted := make([]uploadObject, 0)
+	failed := make([]int, 0)
+	derivedCount := 0
+	for _, orphan := range orphans {
+		objects, derived, err := deleteUploadRowsSavepoint(tx, orphan.ID)
+		if err != nil {
+			logrus.Errorf("collectOrphanedUploadBatch: unable to delete upload %d: %v", orphan.ID, err)
+			failed = append(failed, orphan.ID)
+			continue
+		}
+		deleted = append(deleted, objects...)
+		derivedCount += derived
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	// rows go first, a failed object delete only leaks storage and never leaves a row without its object
+	for _, object := range deleted {
+		if err := srv.StorageProvider.Delete(ctx, object.Bucket, object.Path); err != nil {
+			logrus.Errorf("collectOrphanedUploadBatch: unable to delete %s/%s: %v", object.Bucket, object.Path, err)
+		}
+	}
+
+	logrus.Infof("collectOrphanedUploadBatch: collected %d orphaned uploads and %d derived files, %d skipped",
+		len(orphans)-len(failed), derivedCount, len(failed))
+	return len(orphans), failed, nil
+}
+
+// deleteUploadRowsSavepoint is deleteUploadRows for a single upload, rolled back to a savepoint when
+// it fails so the transaction can go on.
+func deleteUploadRowsSavepoint(tx *sqlx.Tx, uploadID int) ([]uploadObject, int, error) {
+	if _, err := tx.Exec(`SAVEPOINT delete_upload`); err != nil {
+		return nil, 0, err
+	}
+
+	objects, derived, err := deleteUploadRows(tx, []int{uploadID})
+	if err != nil {
+		if _, rollbackErr := tx.Exec(`ROLLBACK TO SAVEPOINT delete_upload`); rollbackErr != nil {
+			logrus.Errorf("deleteUploadRowsSavepoint: unable to rollback to savepoint %v", rollbackErr)
+		}
+		return nil, 0, err
+	}
+
+	_, err = tx.Exec(`RELEASE SAVEPOINT delete_upload`)
+	return objects, derived, err
+}
+
+// deleteUploadRows deletes the uploads together with the files derived from them and their link rows.
+// It returns the objects to remove from storage once the transaction has committed, and the number
+// of derived files.
+func deleteUploadRows(tx *sqlx.Tx, uploadIDs []int) ([]uploadObject, int, error) {
+	SQL := `WITH derived AS (SELECT thumbnail_id AS id FROM thumbnail WHERE upload_id = ANY ($1)
+			                 UNION
+			                 SELECT png_id FROM svg_to_png WHERE svg_id = ANY ($1)
+			                 UNION
+			                 SELECT variant_id FROM upload_variants WHERE upload_id = ANY ($1))
+			SELECT id FROM derived`
+
+	derivedIDs := make([]int, 0)
+	if err := tx.Select(&derivedIDs, SQL, pq.Array(uploadIDs)); err != nil {
+		return nil, 0, err
+	}
+
+	SQL = `SELECT bucket, path FROM upload_originals WHERE upload_id = ANY ($1)`
+
+	objects := make([]uploadObject, 0)
+	if err := tx.Select(&objects, SQL, pq.Array(uploadIDs)); err != nil {
+		return nil, 0, err
+	}
+
+	allIDs := append(uploadIDs, derivedIDs...)
+	statements := []string{
+		`DELETE FROM thumbnail WHERE upload_id = ANY ($1) OR thumbnail_id = ANY ($1)`,
+		`DELETE FROM svg_to_png WHERE svg_id = ANY ($1) OR png_id = ANY ($1)`,
+		`DELETE FROM upload_variants WHERE upload_id = ANY ($1) OR variant_id = ANY ($1)`,
+		`DELETE FROM upload_originals WHERE upload_id = ANY ($1)`,
+		`DELETE FROM upload_audio WHERE upload_id = ANY ($1)`,
+		`DELETE FROM upload_documents WHERE upload_id = ANY ($1)`,
+		`UPDATE upload_sessions SET upload_id = NULL WHERE upload_id = ANY ($1)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, pq.Array(allIDs)); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	deleted := make([]uploadObject, 0)
+	if err := tx.Select(&deleted, `DELETE FROM uploads WHERE id = ANY ($1) RETURNING bucket, path`, pq.Array(allIDs)); err != nil {
+		return nil, 0, err
+	}
+	return append(deleted, objects...), len(derivedIDs), nil
+}
+
+func (srv *Server) collectExpiredUploadSessions() error {
+	SQL := `DELETE FROM upload_sessions
+			WHERE completed_at IS NULL
+			  AND created_at < $1
+			  AND (completing_at IS NULL OR completing_at < $2)
+			RETURNING id`
+
+	sessionIDs := make([]string, 0)
+	now := time.Now()
+	err := srv.PSQL.DB().Select(&sessionIDs, SQL, now.Add(-uploadSessionLifetime), now.Add(-uploadSessionCompletingTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		session := uploadSession{ID: sessionID}
+		if err := os.Remove(session.spoolPath()); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("collectExpiredUploadSessions: unable to remove spool file %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+  - getOrphanedUploadsReport
+  - @Description This method is used by admins to preview which uploads
+    the garbage collector would delete, without deleting anything.
+*/
+func (srv *Server) getOrphanedUploadsReport(resp http.ResponseWriter, req *http.Request) {
+	limit, _, err := utils.GetLimitPageFromRequest(req, uploadGCBatchSize)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to process request")
+		return
+	}
+
+	references, err := srv.uploadReferences()
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get upload references")
+		return
+	}
+
+	orphans := make([]orphanedUpload, 0)
+	err = srv.PSQL.DB().Select(&orphans, orphanedUploadsQuery(references, false), time.Now().Add(-srv.uploadGCGrace()), limit, pq.Array([]int{}))
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get orphaned uploads")
+		return
+	}
+
+	var totalSize int64
+	for _, orphan := range orphans {
+		totalSize += orphan.Size
+	}
+
+	checkedReferences := make([]string, 0, len(references))
+	for _, reference := range references {
+		checkedReferences = append(checkedReferences, reference.Table+"."+reference.Column)
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"enabled":    srv.DynamicConfig.GetBool(uploadGCEnabledConfig),
+		"graceHours": srv.uploadGCGrace().Hours(),
+		"references": checkedReferences,
+		"uploads":    orphans,
+		"totalSize":  totalSize,
+	})
+}
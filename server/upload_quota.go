@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/models"
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadQuotaConfig holds the daily upload limits as JSON, e.g.
+	// {"bytesPerDay": 524288000, "countPerDay": 500, "types": {"user_profile": {"countPerDay": 20}}}.
+	// A zero limit means unlimited.
+	uploadQuotaConfig = "UPLOAD_QUOTA"
+
+	uploadQuotaExceededCode = "upload_quota_exceeded"
+)
+
+type uploadLimit struct {
+	BytesPerDay int64 `json:"bytesPerDay"`
+	CountPerDay int   `json:"countPerDay"`
+}
+
+// uploadQuota limits what a single user uploads in a rolling day, in total and per upload type.
+type uploadQuota struct {
+	uploadLimit
+	Types map[models.UploadType]uploadLimit `json:"types"`
+}
+
+var defaultUploadQuota = uploadQuota{
+	uploadLimit: uploadLimit{BytesPerDay: 1 << 30, CountPerDay: 500},
+}
+
+type uploadUsage struct {
+	Bytes int64 `json:"bytes" db:"bytes"`
+	Count int   `json:"count" db:"count"`
+}
+
+func (srv *Server) uploadQuota() uploadQuota {
+	value := srv.DynamicConfig.GetString(uploadQuotaConfig)
+	if value == "" {
+		return defaultUploadQuota
+	}
+
+	var quota uploadQuota
+	if err := json.Unmarshal([]byte(value), &quota); err != nil {
+		logrus.Errorf("uploadQuota: invalid %s: %v", uploadQuotaConfig, err)
+		return defaultUploadQuota
+	}
+	return quota
+}
+
+// uploadUsageSince sums the uploads of a user since the given time, for one upload type when it is set.
+// Only original uploads count, derived files such as thumbnails and variants have no content hash.
+func uploadUsageSince(db sqlGetter, userID int, uploadType models.UploadType, since time.Time) (uploadUsage, error) {
+	SQL := `SELECT coalesce(sum(size), 0) AS bytes,
+			       count(*)                AS count
+			FROM uploads
+			WHERE uploaded_by = $1
+			  AND created_at > $2
+			  AND content_hash IS NOT NULL
+			  AND ($3 = '' OR type::TEXT = $3)`
+
+	var usage uploadUsage
+	err := db.Get(&usage, SQL, userID, since, string(uploadType))
+	return usage, err
+}
+
+// checkUploadQuota returns an uploadError when storing size more bytes of uploadType would exceed a daily limit.
+func (srv *Server) checkUploadQuota(db sqlGetter, userID int, uploadType models.UploadType, size int64) error {
+	quota := srv.uploadQuota()
+	since := time.Now().Add(-24 * time.Hour)
+
+	// the overall limit is checked against every upload type, the type limit against its own uploads
+	limits := map[models.UploadType]uploadLimit{"": quota.uploadLimit}
+	if typeLimit, ok := quota.Types[uploadType]; ok {
+		limits[uploadType] = typeLimit
+	}
+
+	for limitType, limit := range limits {
+		if limit.BytesPerDay == 0 && limit.CountPerDay == 0 {
+			continue
+		}
+
+		usage, err := uploadUsageSince(db, userID, limitType, since)
+		if err != nil {
+			return err
+		}
+
+		if limit.CountPerDay > 0 && usage.Count+1 > limit.CountPerDay {
+			return rejectUploadWithCode(http.StatusTooManyRequests, uploadQuotaExceededCode,
+				fmt.Sprintf("You can upload up to %d files a day", limit.CountPerDay))
+		}
+
+		if limit.BytesPerDay > 0 && usage.Bytes+size > limit.BytesPerDay {
+			return rejectUploadWithCode(http.StatusTooManyRequests, uploadQuotaExceededCode,
+				fmt.Sprintf("You can upload up to %d MB a day", limit.BytesPerDay>>20))
+		}
+	}
+	return nil
+}
+
+// enforceUploadQuota rejects an upload over quota before it is processed. It is only an early check,
+// reserveUploadQuota repeats it where the upload is registered.
+func enforceUploadQuota(uctx *uploadContext) error {
+	return uctx.srv.checkUploadQuota(uctx.srv.PSQL.DB(), uctx.uc.ID, uctx.uploadType, uctx.header.Size)
+}
+
+// reserveUploadQuota checks the quota in the transaction that registers the upload, holding a lock
+// per user until it commits, so concurrent uploads of a user cannot all pass the check.
+func reserveUploadQuota(uctx *uploadContext) error {
+	if _, err := uctx.tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('upload_quota'), $1)`, uctx.uc.ID); err != nil {
+		return err
+	}
+	return uctx.srv.checkUploadQuota(uctx.tx, uctx.uc.ID, uctx.uploadType, uctx.size)
+}
+
+// userUploadUsage returns how much a user uploaded in the last day, per upload type, next to the
+// configured quota.
+func (srv *Server) userUploadUsage(userID int) (map[string]interface{}, error) {
+	SQL := `SELECT type,
+			       coalesce(sum(size), 0) AS bytes,
+			       count(*)                AS count
+			FROM uploads
+			WHERE uploaded_by = $1
+			  AND created_at > $2
+			  AND content_hash IS NOT NULL
+			GROUP BY type`
+
+	rows := make([]struct {
+		Type models.UploadType `db:"type"`
+		uploadUsage
+	}, 0)
+
+	if err := srv.PSQL.DB().Select(&rows, SQL, userID, time.Now().Add(-24*time.Hour)); err != nil {
+		return nil, err
+	}
+
+	var total uploadUsage
+	usageByType := make(map[models.UploadType]uploadUsage, len(rows))
+	for _, row := range rows {
+		usageByType[row.Type] = row.uploadUsage
+		total.Bytes += row.Bytes
+		total.Count += row.Count
+	}
+
+	quota := srv.uploadQuota()
+	return map[string]interface{}{
+		"lastDay": total,
+		"types":   usageByType,
+		"quota": map[string]interface{}{
+			"bytesPerDay": quota.BytesPerDay,
+			"countPerDay": quota.CountPerDay,
+			"types":       quota.Types,
+		},
+	}, nil
+}
+
+// withUploadUsage adds the upload usage of the user named by the param route parameter to the JSON
+// object next responds with, as "uploadUsage". Admins see it with the rest of the user details.
+func (srv *Server) withUploadUsage(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			userID, err := strconv.Atoi(chi.URLParam(req, param))
+			if err != nil {
+				next.ServeHTTP(resp, req)
+				return
+			}
+
+			amendJSONResponse(resp, req, next, func(body []byte) []byte {
+				usage, err := srv.userUploadUsage(userID)
+				if err != nil {
+					logrus.Errorf("withUploadUsage: unable to get upload usage of user %d: %v", userID, err)
+					return body
+				}
+				return addJSONFields(body, map[string]interface{}{"uploadUsage": usage})
+			})
+		})
+	}
+}
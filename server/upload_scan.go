@@ -0,0 +1,504 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadScannerConfig selects the Scanner, "clamav" or "fake". Scanning is off when it is empty.
+	uploadScannerConfig = "UPLOAD_SCANNER"
+	// clamdAddressConfig is the clamd socket, e.g. "unix:/var/run/clamav/clamd.ctl" or "tcp:127.0.0.1:3310".
+	clamdAddressConfig = "CLAMD_ADDRESS"
+
+	uploadScannerClamAV = "clamav"
+	uploadScannerFake   = "fake"
+
+	defaultClamdAddress = "unix:/var/run/clamav/clamd.ctl"
+
+	uploadScanBatchSize = 20
+	// uploadScanTimeout is how long a claimed upload may stay in scanning before another replica retries it.
+	uploadScanTimeout = 15 * time.Minute
+
+	clamdChunkSize = 64 << 10
+
+	// uploadQuarantinePrefix is prepended to the object path of quarantined uploads.
+	uploadQuarantinePrefix = "quarantine/"
+	// uploadQuarantineURLExpiry is how long the url used to restore a quarantined object stays valid.
+	uploadQuarantineURLExpiry = 15 * time.Minute
+)
+
+type uploadScanStatus string
+
+const (
+	uploadScanStatusNotScanned uploadScanStatus = "not_scanned"
+	uploadScanStatusPending    uploadScanStatus = "pending"
+	uploadScanStatusScanning   uploadScanStatus = "scanning"
+	uploadScanStatusClean      uploadScanStatus = "clean"
+	uploadScanStatusInfected   uploadScanStatus = "infected"
+)
+
+type scanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner inspects the content of an upload for malware.
+type Scanner interface {
+	Scan(ctx context.Context, content io.Reader) (scanResult, error)
+}
+
+func (srv *Server) uploadScanner() Scanner {
+	switch srv.DynamicConfig.GetString(uploadScannerConfig) {
+	case uploadScannerClamAV:
+		address := srv.DynamicConfig.GetString(clamdAddressConfig)
+		if address == "" {
+			address = defaultClamdAddress
+		}
+		return newClamdScanner(address)
+	case uploadScannerFake:
+		return fakeScanner{}
+	}
+	return nil
+}
+
+// clamdScanner streams content to a clamd daemon with the INSTREAM command.
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func newClamdScanner(address string) clamdScanner {
+	network, addr, found := strings.Cut(address, ":")
+	if !found {
+		return clamdScanner{network: "unix", address: address}
+	}
+	return clamdScanner{network: network, address: addr}
+}
+
+func (s clamdScanner) Scan(ctx context.Context, content io.Reader) (scanResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logrus.Errorf("clamdScanner: unable to close connection %v", err)
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return scanResult{}, err
+		}
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return scanResult{}, err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := content.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return scanResult{}, err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return scanResult{}, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return scanResult{}, readErr
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return scanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return scanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads replies like "stream: OK" and "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (scanResult, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return scanResult{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return scanResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	}
+	return scanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// fakeScanner flags content carrying the EICAR test string, for local development and tests.
+type fakeScanner struct{}
+
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+func (fakeScanner) Scan(_ context.Context, content io.Reader) (scanResult, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return scanResult{}, err
+	}
+
+	if bytes.Contains(data, eicarSignature) {
+		return scanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return scanResult{}, nil
+}
+
+type pendingScan struct {
+	ID     int    `db:"id"`
+	Bucket string `db:"bucket"`
+	Path   string `db:"path"`
+	URL    string `db:"url"`
+}
+
+// scanPendingUploads scans uploads registered since the last run. Uploads are claimed with SKIP LOCKED,
+// so replicas split the work, and a claim that outlives uploadScanTimeout is picked up again.
+func (srv *Server) scanPendingUploads(ctx context.Context) error {
+	scanner := srv.uploadScanner()
+	if scanner == nil {
+		return nil
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		SQL := `UPDATE uploads
+				SET scan_status = $1,
+				    scan_started_at = now()
+				WHERE id IN (SELECT id
+				             FROM uploads
+				             WHERE scan_status = $2
+				                OR (scan_status = $1 AND scan_started_at < $3)
+				             ORDER BY id
+				             LIMIT $4
+				             FOR UPDATE SKIP LOCKED)
+				RETURNING id, bucket, path, url`
+
+		pending := make([]pendingScan, 0)
+		err := srv.PSQL.DB().Select(&pending, SQL, uploadScanStatusScanning, uploadScanStatusPending, time.Now().Add(-uploadScanTimeout), uploadScanBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, upload := range pending {
+			if err := srv.scanUpload(ctx, scanner, upload); err != nil {
+				logrus.Errorf("scanPendingUploads: unable to scan upload %d: %v", upload.ID, err)
+			}
+		}
+
+		if len(pending) < uploadScanBatchSize {
+			return nil
+		}
+	}
+}
+
+func (srv *Server) scanUpload(ctx context.Context, scanner Scanner, upload pendingScan) error {
+	content, err := openUploadURL(ctx, upload.URL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := content.Close(); err != nil {
+			logrus.Errorf("scanUpload: unable to close response %v", err)
+		}
+	}()
+
+	result, err := scanner.Scan(ctx, content)
+	if err != nil {
+		return err
+	}
+
+	if result.Infected {
+		logrus.Warnf("scanUpload: upload %d quarantined, signature %s", upload.ID, result.Signature)
+		return srv.quarantineUpload(ctx, upload, result.Signature)
+	}
+
+	SQL := `UPDATE uploads
+			SET scan_status = $2,
+			    scanned_at = now()
+			WHERE id = $1`
+
+	_, err = srv.PSQL.DB().Exec(SQL, upload.ID, uploadScanStatusClean)
+	return err
+}
+
+// quarantineUpload hides an infected upload. Its object is moved below uploadQuarantinePrefix so the
+// urls signed before the scan stop working, its url is cleared for the handlers that read uploads.url
+// directly, and the thumbnails, PNGs and variants derived from it are deleted. Admins are notified
+// on the dashboard.
+func (srv *Server) quarantineUpload(ctx context.Context, upload pendingScan, signature string) error {
+	path := upload.Path
+	quarantinePath := uploadQuarantinePrefix + upload.Path
+	if err := srv.copyUploadObject(ctx, upload.Bucket, upload.URL, quarantinePath); err != nil {
+		// the upload is still hidden, only its object stays in place
+		logrus.Errorf("quarantineUpload: unable to move upload %d to quarantine: %v", upload.ID, err)
+		quarantinePath = upload.Path
+	}
+
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("quarantineUpload: unable to rollback %v", err)
+		}
+	}()
+
+	SQL := `SELECT thumbnail_id FROM thumbnail WHERE upload_id = $1
+			UNION
+			SELECT png_id FROM svg_to_png WHERE svg_id = $1
+			UNION
+			SELECT variant_id FROM upload_variants WHERE upload_id = $1`
+
+	derivedIDs := make([]int, 0)
+	if err := tx.Select(&derivedIDs, SQL, upload.ID); err != nil {
+		return err
+	}
+
+	objects := make([]uploadObject, 0)
+	if len(derivedIDs) > 0 {
+		objects, _, err = deleteUploadRows(tx, derivedIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	SQL = `UPDATE uploads
+		   SET scan_status = $2,
+		       scan_signature = $3,
+		       scanned_at = now(),
+		       path = $4,
+		       url = '',
+		       url_expiration_time = now()
+		   WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, upload.ID, uploadScanStatusInfected, signature, quarantinePath); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Upload %d was quarantined by the malware scanner, signature %s", upload.ID, signature)
+	if err := insertAdminNotification(tx, adminNotificationUploadQuarantined, &upload.ID, message); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if quarantinePath != path {
+		objects = append(objects, uploadObject{Bucket: upload.Bucket, Path: path})
+	}
+	for _, object := range objects {
+		if err := srv.StorageProvider.Delete(ctx, object.Bucket, object.Path); err != nil {
+			logrus.Errorf("quarantineUpload: unable to delete %s/%s: %v", object.Bucket, object.Path, err)
+		}
+	}
+	return nil
+}
+
+// openUploadURL downloads the object behind a signed upload url.
+func openUploadURL(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		if err := response.Body.Close(); err != nil {
+			logrus.Errorf("openUploadURL: unable to close response %v", err)
+		}
+		return nil, fmt.Errorf("unable to download upload, status %d", response.StatusCode)
+	}
+	return response.Body, nil
+}
+
+// copyUploadObject stores the object behind url as a private object at objectPath.
+func (srv *Server) copyUploadObject(ctx context.Context, bucket, url, objectPath string) error {
+	content, err := openUploadURL(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := content.Close(); err != nil {
+			logrus.Errorf("copyUploadObject: unable to close response %v", err)
+		}
+	}()
+
+	return srv.StorageProvider.Upload(ctx, bucket, content, objectPath, "application/octet-stream", false)
+}
+
+type quarantinedUpload struct {
+	ID            int       `json:"id" db:"id"`
+	Name          string    `json:"name" db:"name"`
+	BinaryType    string    `json:"binaryType" db:"binary_type"`
+	UploadedBy    int       `json:"uploadedBy" db:"uploaded_by"`
+	ScanSignature string    `json:"scanSignature" db:"scan_signature"`
+	ScannedAt     time.Time `json:"scannedAt" db:"scanned_at"`
+}
+
+/*
+  - getQuarantinedUploads
+  - @Description This method is used by admins to list the uploads flagged
+    by the malware scanner. Those uploads are hidden from every user.
+*/
+func (srv *Server) getQuarantinedUploads(resp http.ResponseWriter, req *http.Request) {
+	limit, page, err := utils.GetLimitPageFromRequest(req, 50)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to process request")
+		return
+	}
+
+	SQL := `SELECT id, name, binary_type, uploaded_by, scan_signature, scanned_at, count(*) OVER () AS total_count
+			FROM uploads
+			WHERE scan_status = $1
+			ORDER BY scanned_at DESC
+			LIMIT $2 OFFSET $3`
+
+	rows := make([]struct {
+		quarantinedUpload
+		TotalCount int `db:"total_count"`
+	}, 0)
+
+	err = srv.PSQL.DB().Select(&rows, SQL, uploadScanStatusInfected, limit, limit*page)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get quarantined uploads")
+		return
+	}
+
+	uploads := make([]quarantinedUpload, 0, len(rows))
+	totalCount := 0
+	for _, row := range rows {
+		uploads = append(uploads, row.quarantinedUpload)
+		totalCount = row.TotalCount
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"uploads":    uploads,
+		"totalCount": totalCount,
+	})
+}
+
+/*
+  - releaseQuarantinedUpload
+  - @Description This method is used by admins to mark a quarantined upload
+    as clean after reviewing it. Its object is moved back out of quarantine
+    and re-signed, the files derived from it are not regenerated.
+*/
+func (srv *Server) releaseQuarantinedUpload(resp http.ResponseWriter, req *http.Request) {
+	uploadID, err := strconv.Atoi(chi.URLParam(req, "uploadID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing uploadId")
+		return
+	}
+
+	SQL := `SELECT id, bucket, path, url, url_expiration_time
+			FROM uploads
+			WHERE id = $1
+			  AND scan_status = $2`
+
+	var upload signedUpload
+	err = srv.PSQL.DB().Get(&upload, SQL, uploadID, uploadScanStatusInfected)
+	if err == sql.ErrNoRows {
+		connectuperror.RespondClientErr(resp, req, errors.New("upload not quarantined"), http.StatusNotFound, "upload is not quarantined")
+		return
+	}
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get upload")
+		return
+	}
+
+	path := strings.TrimPrefix(upload.Path, uploadQuarantinePrefix)
+	if path != upload.Path {
+		quarantineURL, err := srv.StorageProvider.GetSharableURL(upload.Bucket, upload.Path, uploadQuarantineURLExpiry)
+		if err != nil {
+			connectuperror.RespondGenericServerErr(resp, req, err, "unable to release upload")
+			return
+		}
+
+		if err := srv.copyUploadObject(req.Context(), upload.Bucket, quarantineURL, path); err != nil {
+			connectuperror.RespondGenericServerErr(resp, req, err, "unable to release upload")
+			return
+		}
+	}
+
+	url, err := srv.StorageProvider.GetSharableURL(upload.Bucket, path, uploadURLExpiry)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to release upload")
+		return
+	}
+
+	SQL = `UPDATE uploads
+		   SET scan_status = $2,
+		       path = $3,
+		       url = $4,
+		       url_expiration_time = $5
+		   WHERE id = $1
+		     AND scan_status = $6
+		     AND path = $7`
+
+	result, err := srv.PSQL.DB().Exec(SQL, uploadID, uploadScanStatusClean, path, url, time.Now().Add(uploadURLExpiry),
+		uploadScanStatusInfected, upload.Path)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to release upload")
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("upload not quarantined"), http.StatusNotFound, "upload is not quarantined")
+		return
+	}
+
+	if err := resolveUploadNotifications(srv.PSQL.DB(), uploadID); err != nil {
+		logrus.Errorf("releaseQuarantinedUpload: unable to resolve notifications of upload %d: %v", uploadID, err)
+	}
+
+	if path != upload.Path {
+		if err := srv.StorageProvider.Delete(req.Context(), upload.Bucket, upload.Path); err != nil {
+			logrus.Errorf("releaseQuarantinedUpload: unable to delete %s/%s: %v", upload.Bucket, upload.Path, err)
+		}
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
@@ -0,0 +1,460 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxResumableUploadSize = 2 << 30
+	maxUploadChunkSize     = 8 << 20
+	uploadSessionLifetime  = 24 * time.Hour
+
+	// a session still completing after uploadSessionCompletingTimeout was interrupted and can be completed again.
+	uploadSessionCompletingTimeout = 15 * time.Minute
+	// a chunk still being appended after uploadChunkClaimTimeout was interrupted and can be sent again.
+	uploadChunkClaimTimeout = 15 * time.Minute
+
+	uploadOffsetHeader = "Upload-Offset"
+)
+
+// uploadSession tracks a resumable upload whose bytes are spooled on local disk until it is completed.
+type uploadSession struct {
+	ID            string                  `json:"id" db:"id"`
+	UserID        int                     `json:"-" db:"user_id"`
+	FileName      string                  `json:"fileName" db:"file_name"`
+	BinaryType    models.UploadBinaryType `json:"uploadBinaryType" db:"binary_type"`
+	UploadType    models.UploadType       `json:"type" db:"upload_type"`
+	Size          int64                   `json:"size" db:"size"`
+	ReceivedBytes int64                   `json:"offset" db:"received_bytes"`
+	CreatedAt     time.Time               `json:"createdAt" db:"created_at"`
+	CompletedAt   sql.NullTime            `json:"-" db:"completed_at"`
+	CompletingAt  sql.NullTime            `json:"-" db:"completing_at"`
+	AppendingAt   sql.NullTime            `json:"-" db:"appending_at"`
+}
+
+const uploadSessionColumns = `id, user_id, file_name, binary_type, upload_type, size, received_bytes, created_at,
+			       completed_at, completing_at, appending_at`
+
+// uploadSessionIDPattern matches the UUIDs upload sessions are identified by.
+var uploadSessionIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type createUploadSessionRequest struct {
+	FileName   string                  `json:"fileName"`
+	BinaryType models.UploadBinaryType `json:"uploadBinaryType"`
+	UploadType models.UploadType       `json:"type"`
+	Size       int64                   `json:"size"`
+}
+
+// uploadSpoolDir returns the directory holding the bytes of unfinished resumable uploads.
+// UPLOAD_SPOOL_DIR should point to a volume shared by every replica serving /api/user/uploads.
+func uploadSpoolDir() string {
+	if dir := os.Getenv("UPLOAD_SPOOL_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "connectup-uploads")
+}
+
+func (session *uploadSession) spoolPath() string {
+	return filepath.Join(uploadSpoolDir(), session.ID)
+}
+
+/*
+  - createUploadSession
+  - @Description This method is used to start a resumable upload. The client
+    then sends the file in chunks and completes the session once every byte
+    has been received.
+*/
+func (srv *Server) createUploadSession(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	var body createUploadSessionRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to create upload", "error parsing request")
+		return
+	}
+
+	if body.FileName == "" {
+		connectuperror.RespondClientErr(resp, req, errors.New("empty file name"), http.StatusBadRequest, "file name cannot be empty")
+		return
+	}
+
+	if body.Size <= 0 || body.Size > maxResumableUploadSize {
+		connectuperror.RespondClientErr(resp, req, errors.New("invalid file size"), http.StatusBadRequest, "file size not valid")
+		return
+	}
+
+	if _, err := uploadPath(body.BinaryType, body.UploadType, body.FileName); err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "invalid file type")
+		return
+	}
+
+	if err := srv.checkUploadQuota(srv.PSQL.DB(), uc.ID, body.UploadType, body.Size); err != nil {
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	SQL := `INSERT INTO upload_sessions
+			(user_id, file_name, binary_type, upload_type, size)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING ` + uploadSessionColumns
+
+	var session uploadSession
+	err := srv.PSQL.DB().Get(&session, SQL, uc.ID, body.FileName, body.BinaryType, body.UploadType, body.Size)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create upload session")
+		return
+	}
+
+	if err := os.MkdirAll(uploadSpoolDir(), models.PermValue); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create upload session")
+		return
+	}
+
+	file, err := os.Create(session.spoolPath())
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create upload session")
+		return
+	}
+
+	if err := file.Close(); err != nil {
+		logrus.Errorf("createUploadSession: unable to close spool file %v", err)
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"session":   session,
+		"chunkSize": maxUploadChunkSize,
+	})
+}
+
+/*
+  - getUploadSession
+  - @Description This method is used to get the offset from which the client
+    should resume a resumable upload.
+*/
+func (srv *Server) getUploadSession(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	session, err := srv.getActiveUploadSession(srv.PSQL.DB(), chi.URLParam(req, "uploadSessionID"), uc.ID, false)
+	if err != nil {
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	resp.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.ReceivedBytes, 10))
+	utils.EncodeJSON200Body(resp, session)
+}
+
+/*
+  - appendUploadChunk
+  - @Description This method is used to append the request body to a resumable
+    upload. The Upload-Offset header must match the bytes already received,
+    otherwise the client has to fetch the session and resume from its offset.
+*/
+func (srv *Server) appendUploadChunk(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	offset, err := strconv.ParseInt(req.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "invalid upload offset")
+		return
+	}
+
+	session, err := srv.claimUploadChunk(chi.URLParam(req, "uploadSessionID"), uc.ID, offset)
+	if err != nil {
+		if session.ID != "" {
+			resp.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.ReceivedBytes, 10))
+		}
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	limit := session.Size - session.ReceivedBytes
+	if limit > maxUploadChunkSize {
+		limit = maxUploadChunkSize
+	}
+
+	// the body streams without a transaction open, the claim keeps other requests away meanwhile
+	written, err := writeUploadChunk(session, offset, http.MaxBytesReader(resp, req.Body, limit))
+	if err != nil {
+		srv.releaseUploadChunk(session.ID)
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to read chunk")
+		return
+	}
+
+	SQL := `UPDATE upload_sessions
+			SET received_bytes = received_bytes + $3,
+			    appending_at   = NULL
+			WHERE id = $1
+			  AND received_bytes = $2`
+
+	result, err := srv.PSQL.DB().Exec(SQL, session.ID, offset, written)
+	if err != nil {
+		srv.releaseUploadChunk(session.ID)
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to append chunk")
+		return
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		// the claim timed out and another chunk was appended meanwhile
+		respondUploadErr(resp, req, rejectUpload(http.StatusConflict, "upload offset does not match"))
+		return
+	}
+
+	session.ReceivedBytes += written
+	resp.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.ReceivedBytes, 10))
+	utils.EncodeJSON200Body(resp, session)
+}
+
+// claimUploadChunk marks the session as receiving the chunk starting at offset, with a single
+// conditional update so no row stays locked while the chunk is read. A session that cannot be
+// claimed is returned with the reason, its offset tells the client where to resume.
+func (srv *Server) claimUploadChunk(sessionID string, userID int, offset int64) (uploadSession, error) {
+	if !uploadSessionIDPattern.MatchString(sessionID) {
+		return uploadSession{}, rejectUpload(http.StatusNotFound, "Upload not found")
+	}
+
+	SQL := `UPDATE upload_sessions
+			SET appending_at = now()
+			WHERE id = $1
+			  AND user_id = $2
+			  AND received_bytes = $3
+			  AND completed_at IS NULL
+			  AND created_at > $4
+			  AND (completing_at IS NULL OR completing_at < $5)
+			  AND (appending_at IS NULL OR appending_at < $6)
+			RETURNING ` + uploadSessionColumns
+
+	now := time.Now()
+	var session uploadSession
+	err := srv.PSQL.DB().Get(&session, SQL, sessionID, userID, offset, now.Add(-uploadSessionLifetime),
+		now.Add(-uploadSessionCompletingTimeout), now.Add(-uploadChunkClaimTimeout))
+	if err == nil {
+		return session, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return uploadSession{}, err
+	}
+
+	session, err = srv.getActiveUploadSession(srv.PSQL.DB(), sessionID, userID, false)
+	if err != nil {
+		return session, err
+	}
+	if offset != session.ReceivedBytes {
+		return session, rejectUpload(http.StatusConflict, "upload offset does not match")
+	}
+	return session, rejectUpload(http.StatusConflict, "A chunk is being appended")
+}
+
+// releaseUploadChunk lets the client send the chunk again after it could not be appended.
+func (srv *Server) releaseUploadChunk(sessionID string) {
+	SQL := `UPDATE upload_sessions SET appending_at = NULL WHERE id = $1`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, sessionID); err != nil {
+		logrus.Errorf("releaseUploadChunk: unable to release session %s: %v", sessionID, err)
+	}
+}
+
+func writeUploadChunk(session uploadSession, offset int64, chunk io.Reader) (int64, error) {
+	file, err := os.OpenFile(session.spoolPath(), os.O_WRONLY, models.PermValue)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("writeUploadChunk: unable to close spool file %v", err)
+		}
+	}()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(file, chunk)
+	if err != nil {
+		// drop the partial chunk so the spool file always matches received_bytes
+		if truncErr := file.Truncate(offset); truncErr != nil {
+			logrus.Errorf("writeUploadChunk: unable to truncate spool file %v", truncErr)
+		}
+		return 0, err
+	}
+	return written, nil
+}
+
+/*
+  - completeUploadSession
+  - @Description This method is used to finish a resumable upload. The spooled
+    file goes through the same pipeline as a multipart upload, so it is stored,
+    registered in uploads and gets a thumbnail when it is a video.
+*/
+func (srv *Server) completeUploadSession(resp http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	uc := srv.getUserContext(req)
+
+	session, err := srv.claimUploadSession(chi.URLParam(req, "uploadSessionID"), uc.ID)
+	if err != nil {
+		if session.ID != "" {
+			resp.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.ReceivedBytes, 10))
+		}
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	file, err := os.Open(session.spoolPath())
+	if err != nil {
+		srv.releaseUploadSession(session.ID)
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to complete upload")
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logrus.Errorf("completeUploadSession: unable to close spool file %v", err)
+		}
+	}()
+
+	uctx := &uploadContext{
+		srv:        srv,
+		resp:       resp,
+		req:        req,
+		uc:         uc,
+		file:       file,
+		header:     &multipart.FileHeader{Filename: session.FileName, Size: session.Size},
+		binaryType: session.BinaryType,
+		uploadType: session.UploadType,
+	}
+
+	if err := srv.processUpload(uctx, defaultUploadPipeline); err != nil {
+		srv.releaseUploadSession(session.ID)
+		respondUploadErr(resp, req, err)
+		return
+	}
+
+	SQL := `UPDATE upload_sessions
+			SET completed_at  = now(),
+			    completing_at = NULL,
+			    upload_id     = $2
+			WHERE id = $1`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, session.ID, uctx.upload.FileID); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to complete upload")
+		return
+	}
+
+	if err := os.Remove(session.spoolPath()); err != nil {
+		logrus.Errorf("completeUploadSession: unable to remove spool file %v", err)
+	}
+
+	respondUpload(resp, uctx)
+	logrus.Infof("completeUploadSession: request time upload data successfully: %d", time.Since(startTime).Milliseconds())
+}
+
+// claimUploadSession marks a fully received upload session as completing. The row is only locked
+// while it is marked, so the upload pipeline runs without holding it and concurrent requests for
+// the session are turned away until the completion finishes or is released.
+func (srv *Server) claimUploadSession(sessionID string, userID int) (uploadSession, error) {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return uploadSession{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("claimUploadSession: unable to rollback %v", err)
+		}
+	}()
+
+	session, err := srv.getActiveUploadSession(tx, sessionID, userID, true)
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	if session.ReceivedBytes != session.Size {
+		return session, rejectUpload(http.StatusConflict, fmt.Sprintf("received %d of %d bytes", session.ReceivedBytes, session.Size))
+	}
+
+	if session.AppendingAt.Valid && time.Since(session.AppendingAt.Time) < uploadChunkClaimTimeout {
+		return session, rejectUpload(http.StatusConflict, "A chunk is being appended")
+	}
+
+	SQL := `UPDATE upload_sessions
+			SET completing_at = now()
+			WHERE id = $1`
+
+	if _, err := tx.Exec(SQL, session.ID); err != nil {
+		return uploadSession{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return uploadSession{}, err
+	}
+	return session, nil
+}
+
+// releaseUploadSession lets the client complete the session again after a failed completion.
+func (srv *Server) releaseUploadSession(sessionID string) {
+	SQL := `UPDATE upload_sessions
+			SET completing_at = NULL
+			WHERE id = $1
+			  AND completed_at IS NULL`
+
+	if _, err := srv.PSQL.DB().Exec(SQL, sessionID); err != nil {
+		logrus.Errorf("releaseUploadSession: unable to release session %s: %v", sessionID, err)
+	}
+}
+
+// getActiveUploadSession returns an unfinished, unexpired upload session owned by userID.
+// When forUpdate is set the row stays locked until the surrounding transaction ends.
+func (srv *Server) getActiveUploadSession(db sqlGetter, sessionID string, userID int, forUpdate bool) (uploadSession, error) {
+	if !uploadSessionIDPattern.MatchString(sessionID) {
+		return uploadSession{}, rejectUpload(http.StatusNotFound, "Upload not found")
+	}
+
+	SQL := `SELECT ` + uploadSessionColumns + `
+			FROM upload_sessions
+			WHERE id = $1
+			  AND user_id = $2`
+	if forUpdate {
+		SQL += ` FOR UPDATE`
+	}
+
+	var session uploadSession
+	err := db.Get(&session, SQL, sessionID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return session, rejectUpload(http.StatusNotFound, "Upload not found")
+		}
+		return session, err
+	}
+
+	if session.CompletedAt.Valid {
+		return session, rejectUpload(http.StatusGone, "Upload already completed")
+	}
+
+	if time.Since(session.CreatedAt) > uploadSessionLifetime {
+		return session, rejectUpload(http.StatusGone, "Upload expired")
+	}
+
+	if session.CompletingAt.Valid && time.Since(session.CompletingAt.Time) < uploadSessionCompletingTimeout {
+		return session, rejectUpload(http.StatusConflict, "Upload is being completed")
+	}
+	return session, nil
+}
+
+// sqlGetter is satisfied by both *sqlx.DB and *sqlx.Tx.
+type sqlGetter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/models"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// uploadURLRefreshWindow is how long before expiry a signed upload url gets re-signed.
+	uploadURLRefreshWindow = 30 * 24 * time.Hour
+
+	uploadURLRefreshBatchSize = 200
+
+	// userUploadURLRefreshLimit caps how many uploads of a profile are re-signed while it is read.
+	userUploadURLRefreshLimit = 50
+)
+
+type signedUpload struct {
+	ID                int       `db:"id"`
+	Bucket            string    `db:"bucket"`
+	Path              string    `db:"path"`
+	URL               string    `db:"url"`
+	URLExpirationTime time.Time `db:"url_expiration_time"`
+}
+
+func (upload signedUpload) needsRefresh() bool {
+	return time.Until(upload.URLExpirationTime) < uploadURLRefreshWindow
+}
+
+// freshUploadURLs returns a signed url per upload id, re-signing the ones that are about to expire.
+// Handlers that embed upload urls in their response should resolve them through this method.
+// Quarantined uploads are left out of the result.
+func (srv *Server) freshUploadURLs(uploadIDs ...int) (map[int]string, error) {
+	urls := make(map[int]string, len(uploadIDs))
+	if len(uploadIDs) == 0 {
+		return urls, nil
+	}
+
+	SQL := `SELECT id, bucket, path, url, url_expiration_time
+			FROM uploads
+			WHERE id = ANY($1)
+			  AND scan_status <> $2`
+
+	uploads := make([]signedUpload, 0)
+	if err := srv.PSQL.DB().Select(&uploads, SQL, pq.Array(uploadIDs), uploadScanStatusInfected); err != nil {
+		return nil, err
+	}
+
+	for _, upload := range uploads {
+		urls[upload.ID] = upload.URL
+		if !upload.needsRefresh() {
+			continue
+		}
+
+		url, err := srv.resignUpload(srv.PSQL.DB(), upload)
+		if err != nil {
+			// the old url is still returned, the sweeper retries before it expires
+			logrus.Errorf("freshUploadURLs: unable to re-sign upload %d: %v", upload.ID, err)
+			continue
+		}
+		urls[upload.ID] = url
+	}
+	return urls, nil
+}
+
+// freshUploadURL is freshUploadURLs for a single upload.
+func (srv *Server) freshUploadURL(uploadID int) (string, error) {
+	urls, err := srv.freshUploadURLs(uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	url, ok := urls[uploadID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return url, nil
+}
+
+// freshUserUploadURLs re-signs the image uploads of the user whose urls are about to expire, so
+// profile responses built from uploads.url never embed a dead link.
+func (srv *Server) freshUserUploadURLs(userID int) error {
+	SQL := `SELECT id
+			FROM uploads
+			WHERE uploaded_by = $1
+			  AND binary_type = $2
+			  AND url_expiration_time < $3
+			ORDER BY url_expiration_time
+			LIMIT $4`
+
+	uploadIDs := make([]int, 0)
+	err := srv.PSQL.DB().Select(&uploadIDs, SQL, userID, models.UploadBinaryTypeImage,
+		time.Now().Add(uploadURLRefreshWindow), userUploadURLRefreshLimit)
+	if err != nil {
+		return err
+	}
+
+	_, err = srv.freshUploadURLs(uploadIDs...)
+	return err
+}
+
+// withFreshUploadURL re-signs the upload named by the param route parameter before next reads its
+// url from uploads. Missing and quarantined uploads are answered with a 404 without calling next.
+func (srv *Server) withFreshUploadURL(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			uploadID, err := strconv.Atoi(chi.URLParam(req, param))
+			if err != nil {
+				// not an upload id, next validates it
+				next.ServeHTTP(resp, req)
+				return
+			}
+
+			if _, err := srv.freshUploadURL(uploadID); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					connectuperror.RespondClientErr(resp, req, err, http.StatusNotFound, "attachment not found")
+					return
+				}
+				connectuperror.RespondGenericServerErr(resp, req, err, "unable to get attachment")
+				return
+			}
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+// withFreshUserUploadURLs re-signs the expiring uploads of the user whose profile is read, the one in
+// the param route parameter or the requesting user when param is empty. Failures are only logged,
+// the sweeper retries them before the urls expire.
+func (srv *Server) withFreshUserUploadURLs(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			var userID int
+			if param == "" {
+				userID = srv.getUserContext(req).ID
+			} else if id, err := strconv.Atoi(chi.URLParam(req, param)); err == nil {
+				userID = id
+			}
+
+			if userID != 0 {
+				if err := srv.freshUserUploadURLs(userID); err != nil {
+					logrus.Errorf("withFreshUserUploadURLs: unable to refresh uploads of user %d: %v", userID, err)
+				}
+			}
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (srv *Server) resignUpload(db sqlExecer, upload signedUpload) (string, error) {
+	url, err := srv.StorageProvider.GetSharableURL(upload.Bucket, upload.Path, uploadURLExpiry)
+	if err != nil {
+		return "", err
+	}
+	return url, storeUploadURL(db, upload.ID, url)
+}
+
+func storeUploadURL(db sqlExecer, uploadID int, url string) error {
+	SQL := `UPDATE uploads
+			SET url = $2,
+			    url_expiration_time = $3
+			WHERE id = $1`
+
+	_, err := db.Exec(SQL, uploadID, url, time.Now().Add(uploadURLExpiry))
+	return err
+}
+
+// refreshExpiringUploadURLs re-signs every upload url that expires within uploadURLRefreshWindow.
+// Rows are locked with SKIP LOCKED so replicas running the sweeper at the same time split the work.
+// Uploads that cannot be signed are skipped for the rest of the run and retried on the next one.
+// Quarantined uploads are never re-signed.
+func (srv *Server) refreshExpiringUploadURLs(ctx context.Context) error {
+	failed := make([]int, 0)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		selected, batchFailed, err := srv.refreshUploadURLBatch(failed)
+		if err != nil {
+			return err
+		}
+		failed = append(failed, batchFailed...)
+
+		if selected < uploadURLRefreshBatchSize {
+			if len(failed) > 0 {
+				logrus.Warnf("refreshExpiringUploadURLs: unable to re-sign %d uploads", len(failed))
+			}
+			return nil
+		}
+	}
+}
+
+// refreshUploadURLBatch re-signs a batch of expiring uploads, leaving out the ids in skip. It returns
+// how many uploads were selected and the ids of the ones that could not be signed.
+func (srv *Server) refreshUploadURLBatch(skip []int) (int, []int, error) {
+	tx, err := srv.PSQL.DB().Beginx()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logrus.Errorf("refreshUploadURLBatch: unable to rollback %v", err)
+		}
+	}()
+
+	SQL := `SELECT id, bucket, path, url, url_expiration_time
+			FROM uploads
+			WHERE url_expiration_time < $1
+			  AND NOT (id = ANY ($3))
+			  AND scan_status <> $4
+			ORDER BY url_expiration_time
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED`
+
+	uploads := make([]signedUpload, 0)
+	err = tx.Select(&uploads, SQL, time.Now().Add(uploadURLRefreshWindow), uploadURLRefreshBatchSize, pq.Array(skip), uploadScanStatusInfected)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	failed := make([]int, 0)
+	for _, upload := range uploads {
+		url, err := srv.StorageProvider.GetSharableURL(upload.Bucket, upload.Path, uploadURLExpiry)
+		if err != nil {
+			logrus.Errorf("refreshUploadURLBatch: unable to re-sign upload %d: %v", upload.ID, err)
+			failed = append(failed, upload.ID)
+			continue
+		}
+
+		if err := storeUploadURL(tx, upload.ID, url); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(uploads), failed, tx.Commit()
+}
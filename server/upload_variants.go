@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the gif decoder for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/RemoteState/connect-up/models"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the webp decoder for image.Decode
+)
+
+const (
+	// imageVariantWidthsConfig is a comma separated list of widths, e.g. "64,256,1024".
+	imageVariantWidthsConfig = "IMAGE_VARIANT_WIDTHS"
+	// imageVariantFormatsConfig is a comma separated list of formats out of jpeg, png and webp.
+	imageVariantFormatsConfig = "IMAGE_VARIANT_FORMATS"
+
+	defaultImageVariantWidths  = "64,256,1024"
+	defaultImageVariantFormats = "jpeg,webp"
+
+	uploadTypeImageVariant models.UploadType = "image_variant"
+
+	// maxImagePixels bounds the size of the images that are decoded, a small file can declare
+	// dimensions whose pixels do not fit in memory.
+	maxImagePixels = 50_000_000
+)
+
+var errImageTooLarge = errors.New("image dimensions are too large")
+
+// uploadVariant is a resized copy of an image upload, linked to it through upload_variants.
+type uploadVariant struct {
+	UploadID int    `json:"-" db:"upload_id"`
+	ID       int    `json:"id" db:"variant_id"`
+	Width    int    `json:"width" db:"width"`
+	Height   int    `json:"height" db:"height"`
+	Format   string `json:"format" db:"format"`
+	URL      string `json:"url" db:"url"`
+}
+
+type imageEncoder func(w io.Writer, img image.Image) error
+
+var imageEncoders = map[string]imageEncoder{
+	"jpeg": func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 82})
+	},
+	"png":  png.Encode,
+	"webp": encodeWebP,
+}
+
+// encodeWebP pipes a PNG of the image through cwebp, there is no pure Go WebP encoder.
+func encodeWebP(w io.Writer, img image.Image) error {
+	binary, err := exec.LookPath("cwebp")
+	if err != nil {
+		return err
+	}
+
+	var input bytes.Buffer
+	if err := png.Encode(&input, img); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	// nolint:gosec // binary is resolved from PATH, input is piped
+	cmd := exec.Command(binary, "-quiet", "-q", "80", "-o", "-", "--", "-")
+	cmd.Stdin = &input
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cwebp: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (srv *Server) imageVariantWidths() []int {
+	value := srv.DynamicConfig.GetString(imageVariantWidthsConfig)
+	if value == "" {
+		value = defaultImageVariantWidths
+	}
+
+	widths := make([]int, 0)
+	for _, part := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || width <= 0 {
+			logrus.Errorf("imageVariantWidths: invalid width %q", part)
+			continue
+		}
+		widths = append(widths, width)
+	}
+	return widths
+}
+
+func (srv *Server) imageVariantFormats() []string {
+	value := srv.DynamicConfig.GetString(imageVariantFormatsConfig)
+	if value == "" {
+		value = defaultImageVariantFormats
+	}
+
+	formats := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		format := strings.TrimSpace(part)
+		if _, ok := imageEncoders[format]; !ok {
+			logrus.Errorf("imageVariantFormats: unsupported format %q", part)
+			continue
+		}
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// generateImageVariants stores a resized copy of the image per configured width and format.
+// Widths larger than the original are skipped, images are never upscaled.
+func generateImageVariants(uctx *uploadContext) error {
+	if uctx.binaryType != models.UploadBinaryTypeImage || strings.HasSuffix(uctx.mimeType, "svg+xml") {
+		return nil
+	}
+
+	original, _, err := decodeImage(uctx.file)
+	if err != nil {
+		return fmt.Errorf("unable to decode image: %w", err)
+	}
+
+	variants := make([]uploadVariant, 0)
+	for _, width := range uctx.srv.imageVariantWidths() {
+		if width >= original.Bounds().Dx() {
+			continue
+		}
+
+		resized := resizeImage(original, width)
+		for _, format := range uctx.srv.imageVariantFormats() {
+			var encoded bytes.Buffer
+			if err := imageEncoders[format](&encoded, resized); err != nil {
+				// a missing encoder only costs this format, the other variants are still stored
+				logrus.Errorf("generateImageVariants: unable to encode %d %s: %v", width, format, err)
+				continue
+			}
+
+			variant, err := uctx.srv.storeImageVariant(uctx, encoded.Bytes(), resized.Bounds(), format)
+			if err != nil {
+				return fmt.Errorf("%d %s: %w", width, format, err)
+			}
+			variants = append(variants, variant)
+		}
+	}
+
+	uctx.variants = variants
+	return nil
+}
+
+// decodeImage decodes the image from the start of r once its header shows that its dimensions stay
+// within maxImagePixels.
+func decodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+
+	imageConfig, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if imageConfig.Width <= 0 || imageConfig.Height <= 0 || int64(imageConfig.Width)*int64(imageConfig.Height) > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(r)
+}
+
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height == 0 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+func (srv *Server) storeImageVariant(uctx *uploadContext, encoded []byte, bounds image.Rectangle, format string) (uploadVariant, error) {
+	width, height := bounds.Dx(), bounds.Dy()
+	fileName := fmt.Sprintf("%d-%dw.%s", uctx.upload.FileID, width, format)
+	filePath := fmt.Sprintf(`images/%v/%s`, uploadTypeImageVariant, fileName)
+
+	url, err := uctx.storeSharedObject(bytes.NewReader(encoded), filePath, false)
+	if err != nil {
+		return uploadVariant{}, err
+	}
+
+	variantUpload, err := srv.registerUpload(uctx.tx, uploadRecord{
+		Name:       fileName,
+		Path:       filePath,
+		Type:       uploadTypeImageVariant,
+		BinaryType: models.UploadBinaryTypeImage,
+		UploadedBy: uctx.uc.ID,
+		URL:        url,
+		Size:       int64(len(encoded)),
+	})
+	if err != nil {
+		return uploadVariant{}, err
+	}
+
+	SQL := `INSERT INTO upload_variants (upload_id, variant_id, width, height, format)
+			VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = uctx.tx.Exec(SQL, uctx.upload.FileID, variantUpload.FileID, width, height, format)
+	if err != nil {
+		return uploadVariant{}, err
+	}
+
+	return uploadVariant{
+		UploadID: uctx.upload.FileID,
+		ID:       variantUpload.FileID,
+		Width:    width,
+		Height:   height,
+		Format:   format,
+		URL:      url,
+	}, nil
+}
+
+// getUploadVariants returns the variants of every given upload keyed by upload id, ordered by width.
+func (srv *Server) getUploadVariants(uploadIDs ...int) (map[int][]uploadVariant, error) {
+	variantsByUpload := make(map[int][]uploadVariant, len(uploadIDs))
+	if len(uploadIDs) == 0 {
+		return variantsByUpload, nil
+	}
+
+	SQL := `SELECT uv.upload_id, uv.variant_id, uv.width, uv.height, uv.format, u.url
+			FROM upload_variants uv
+			    JOIN uploads u ON u.id = uv.variant_id
+			    JOIN uploads original ON original.id = uv.upload_id
+			WHERE uv.upload_id = ANY($1)
+			  AND original.scan_status <> $2
+			ORDER BY uv.upload_id, uv.width, uv.format`
+
+	variants := make([]uploadVariant, 0)
+	if err := srv.PSQL.DB().Select(&variants, SQL, pq.Array(uploadIDs), uploadScanStatusInfected); err != nil {
+		return nil, err
+	}
+
+	for _, variant := range variants {
+		variantsByUpload[variant.UploadID] = append(variantsByUpload[variant.UploadID], variant)
+	}
+	return variantsByUpload, nil
+}
+
+// withUploadDetails adds the variants of the upload named by the param route parameter to the JSON
+// object next responds with, so clients can pick the size that fits their screen density, and the
+// duration and waveform of transcoded audio. Other responses are passed on as they are.
+func (srv *Server) withUploadDetails(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			uploadID, err := strconv.Atoi(chi.URLParam(req, param))
+			if err != nil {
+				next.ServeHTTP(resp, req)
+				return
+			}
+
+			amendJSONResponse(resp, req, next, func(body []byte) []byte {
+				return srv.addUploadDetails(body, uploadID)
+			})
+		})
+	}
+}
+
+// amendJSONResponse serves next and passes a successful JSON response through amend before it is
+// sent. Other responses are sent as they are.
+func amendJSONResponse(resp http.ResponseWriter, req *http.Request, next http.Handler, amend func(body []byte) []byte) {
+	recorder := &responseRecorder{header: resp.Header(), statusCode: http.StatusOK}
+	next.ServeHTTP(recorder, req)
+
+	body := recorder.body.Bytes()
+	if recorder.statusCode == http.StatusOK && strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json") {
+		body = amend(body)
+		if resp.Header().Get("Content-Length") != "" {
+			resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+
+	resp.WriteHeader(recorder.statusCode)
+	if _, err := resp.Write(body); err != nil {
+		logrus.Errorf("amendJSONResponse: unable to write response %v", err)
+	}
+}
+
+// addUploadDetails returns body with the details of the upload added, or body unchanged when it is
+// not a JSON object or the details cannot be loaded.
+func (srv *Server) addUploadDetails(body []byte, uploadID int) []byte {
+	variants, err := srv.getUploadVariants(uploadID)
+	if err != nil {
+		logrus.Errorf("addUploadDetails: unable to get variants of upload %d: %v", uploadID, err)
+		return body
+	}
+
+	details := map[string]interface{}{
+		"variants": variants[uploadID],
+	}
+	if variants[uploadID] == nil {
+		details["variants"] = []uploadVariant{}
+	}
+
+	audio, err := srv.getAudioMetadata(uploadID)
+	if err != nil {
+		logrus.Errorf("addUploadDetails: unable to get audio metadata of upload %d: %v", uploadID, err)
+		return body
+	}
+	if metadata, ok := audio[uploadID]; ok {
+		details["audio"] = metadata
+	}
+	return addJSONFields(body, details)
+}
+
+// addJSONFields returns the JSON object in body with fields set on it, or body unchanged when it is
+// not a JSON object or a field cannot be encoded.
+func addJSONFields(body []byte, fields map[string]interface{}) []byte {
+	object := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &object); err != nil {
+		return body
+	}
+
+	for key, value := range fields {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			logrus.Errorf("addJSONFields: unable to encode %s: %v", key, err)
+			return body
+		}
+		object[key] = encoded
+	}
+
+	extended, err := json.Marshal(object)
+	if err != nil {
+		return body
+	}
+	return extended
+}
+
+// responseRecorder buffers what a handler writes so it can be amended before it is sent.
+type responseRecorder struct {
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.statusCode = statusCode
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(p)
+}
@@ -1,15 +1,11 @@
 package server
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -21,8 +17,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const minDetectionConfidence = 0.5
-
 func (srv *Server) getUserContext(req *http.Request) *models.UserContext {
 	return srv.Middlewares.GetUserContext(req)
 }
@@ -272,6 +266,12 @@ func (srv *Server) ping(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if uc.Session != nil {
+		if err := srv.touchSession(uc.ID, uc.Session.Token); err != nil {
+			logrus.Errorf("ping: unable to record ping of session: %v", err)
+		}
+	}
+
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
 		"message": "pong",
 	})
@@ -308,131 +308,7 @@ func (srv *Server) getOnlineStatusOfUsers(resp http.ResponseWriter, req *http.Re
 * @Description This method is used to upload image in db and cloud storage.
  */
 func (srv *Server) upload(resp http.ResponseWriter, req *http.Request) {
-	startTime := time.Now()
-	uc := srv.getUserContext(req)
-
-	defer func(req *http.Request) {
-		if req.MultipartForm != nil { // prevent panic from nil pointer
-			if err := req.MultipartForm.RemoveAll(); err != nil {
-				logrus.Errorf("Unable to remove all multipart form. %+v", err)
-			}
-		}
-	}(req)
-
-	req.Body = http.MaxBytesReader(resp, req.Body, 51<<20)
-
-	if err := req.ParseMultipartForm(51 << 20); err != nil {
-		if err == io.EOF || err.Error() == string(models.MultipartUnexpectedEOF) {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Errorf("[ParseMultipartForm] %s", err.Error())
-		}
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to parse file", "error parsing file")
-		return
-	}
-
-	file, header, err := req.FormFile("file")
-
-	defer func() {
-		if err = file.Close(); err != nil {
-			logrus.Errorf("Unable to close file multipart form. %+v", err)
-		}
-	}()
-
-	if err != nil {
-		if err == io.EOF {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Error(err)
-		}
-
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to read file", "unable to read file")
-		return
-	}
-
-	typeOfUploadBinary := models.UploadBinaryType(req.FormValue("upload_binary_type"))
-	typeOfUpload := models.UploadType(req.FormValue("type"))
-
-	filePath := ""
-
-	switch typeOfUploadBinary {
-	case models.UploadBinaryTypeImage:
-		filePath = fmt.Sprintf(`images/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeVideo:
-		filePath = fmt.Sprintf(`videos/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeAudio:
-		filePath = fmt.Sprintf(`audios/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeDocument:
-		filePath = fmt.Sprintf(`documents/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	default:
-		connectuperror.RespondGenericServerErr(resp, req, errors.New("file type not valid"), "invalid file type")
-		return
-	}
-
-	logrus.Infof("current branch : %v", os.Getenv("BRANCH"))
-	err = srv.StorageProvider.Upload(req.Context(), utils.GetUploadsBucketName(), file, filePath, "application/octet-stream", false)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload file")
-		return
-	}
-
-	url, err := srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), filePath, time.Hour*24*365)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get url")
-		return
-	}
-
-	SQL := `INSERT INTO uploads 
-			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			RETURNING id,u_id
-			`
-
-	var files models.Upload
-
-	args := []interface{}{
-		header.Filename,
-		utils.GetUploadsBucketName(),
-		filePath,
-		typeOfUpload,
-		uc.ID,
-		typeOfUploadBinary,
-		url,
-		time.Now().AddDate(1, 0, 0),
-	}
-
-	err = srv.PSQL.DB().Get(&files, SQL, args...)
-	if err != nil {
-		logrus.Errorf("upload: error inserting into upload: %v", err)
-		connectuperror.RespondGenericServerErr(resp, req, err, "Error inserting file")
-		return
-	}
-
-	var thumbURL string
-	if typeOfUploadBinary == models.UploadBinaryTypeVideo {
-		if thumbURL, err = thumbnailUpload(req, srv, url, header, uc, files); err != nil {
-			logrus.Errorf("upload: unable to generate thumbnail %v", err)
-		}
-	}
-
-	if strings.Contains(header.Filename, ".svg") {
-		_, err := srv.ConvertSVGToPNG(resp, req, file, typeOfUpload, uc, files)
-		if err != nil {
-			logrus.Errorf("uploadV2: unable to generate png of svg thumbnail %v", err)
-		}
-	}
-
-	if typeOfUploadBinary != models.UploadBinaryTypeVideo {
-		thumbURL = url
-	}
-
-	utils.EncodeJSON200Body(resp, map[string]interface{}{
-		"id":           files.FileID,
-		"imageUID":     files.FileUUID,
-		"url":          url,
-		"thumbnailUrl": thumbURL,
-	})
-	logrus.Infof("upload: request time upload data successfully: %d", time.Since(startTime).Milliseconds())
+	srv.handleUpload(resp, req, defaultUploadPipeline)
 }
 
 func (srv *Server) createUserSession(resp http.ResponseWriter, req *http.Request) {
@@ -503,6 +379,10 @@ func (srv *Server) endUserSession(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := srv.revokeSessionTokenFamilies(uc.Session.Token); err != nil {
+		logrus.Errorf("endUserSession: unable to revoke refresh tokens of session: %v", err)
+	}
+
 	srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, uc.AuthID, uc.Session.Token))
 
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
@@ -513,56 +393,31 @@ func (srv *Server) endUserSession(resp http.ResponseWriter, req *http.Request) {
 /*
   - deleteUser
   - @Description This method is used to delete user profile
-    from the server and firebase.
+    from the server and firebase. The deletion runs as a background job
+    after the configured grace period, during which the user can cancel it.
 */
 func (srv *Server) deleteUser(resp http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
 	uc := srv.getUserContext(req)
 
-	err := srv.DBHelper.DeleteUser(uc.ID)
+	deletion, err := srv.requestAccountDeletion(uc.ID, uc.AuthID, uc.ID, srv.accountDeletionGrace())
 	if err != nil {
 		connectuperror.RespondGenericServerErr(resp, req, err, "unable to delete user")
 		return
 	}
-	logrus.Infof("deleteUser: request time after deleting user from db: %d", time.Since(startTime).Milliseconds())
-
-	// Delete authId from Firebase
-	err = srv.AuthProvider.DeleteAuthUser(req.Context(), uc.AuthID)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "Error while deleting auth user")
-		return
-	}
-
-	logrus.Infof("deleteUser: request time after deleting user from firbase: %d", time.Since(startTime).Milliseconds())
-
-	go func() {
-		// deleting user from the group
-		err = srv.DBHelper.DeleteGroupsForUser(uc.ID)
-		if err != nil {
-			logrus.Errorf("DeleteUser: unable to delete from user from groups %v", err)
-			connectuperror.RespondGenericServerErr(resp, req, err, "Error while deleting groups of user")
-			return
-		}
-	}()
-
-	go func() {
-		// making new admin for chatGroup
-		err := srv.DBHelper.CreateNewChatGroupAdmin(uc.ID)
-		if err != nil {
-			logrus.Errorf("Error updating new admin: %v", err)
-		}
-	}()
 
 	srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, uc.AuthID, uc.Session.Token))
 
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
-		"message": "success",
+		"message":  "success",
+		"deletion": deletion,
 	})
-	logrus.Infof("deleteUser: request time after success fully deleting: %d", time.Since(startTime).Milliseconds())
+	logrus.Infof("deleteUser: request time after requesting deletion: %d", time.Since(startTime).Milliseconds())
 }
 
 func (srv *Server) deleteUserByAdmin(resp http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
+	uc := srv.getUserContext(req)
 	userID, err := strconv.Atoi(chi.URLParam(req, "userID"))
 	if err != nil {
 		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing userId")
@@ -575,44 +430,24 @@ func (srv *Server) deleteUserByAdmin(resp http.ResponseWriter, req *http.Request
 		return
 	}
 
-	err = srv.DBHelper.DeleteUser(userID)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to delete user")
-		return
+	// users are soft deleted so they can be restored until the retention window is over,
+	// permanent=true purges the account right away
+	var deletion accountDeletion
+	if req.URL.Query().Get("permanent") == "true" {
+		deletion, err = srv.requestAccountDeletion(userID, authID, uc.ID, 0)
+	} else {
+		deletion, err = srv.softDeleteUser(userID, authID, uc.ID)
 	}
-
-	logrus.Infof("deleteUserByAdmin: request time after deleting user from db by admin: %d", time.Since(startTime).Milliseconds())
-
-	// Delete authId from Firebase
-	err = srv.AuthProvider.DeleteAuthUser(req.Context(), authID)
 	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "Error while deleting auth user")
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to delete user")
 		return
 	}
 
-	logrus.Infof("deleteUserByAdmin: request time after deleting user from firbase: %d", time.Since(startTime).Milliseconds())
-
-	go func() {
-		// deleting user from the group
-		err = srv.DBHelper.DeleteGroupsForUser(userID)
-		if err != nil {
-			logrus.Errorf("deleteUserByAdmin: unable to delete from user from groups: %v", err)
-			connectuperror.RespondGenericServerErr(resp, req, err, "Error while deleting groups of user")
-			return
-		}
-		err = srv.DBHelper.EndSessionOfUserByAdmin(userID, authID)
-		if err != nil {
-			connectuperror.RespondGenericServerErr(resp, req, err, "Error while deleting session of user")
-			return
-		}
-	}()
-
-	// srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, uc.AuthID, uc.Session.Token))
-
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
-		"message": "success",
+		"message":  "success",
+		"deletion": deletion,
 	})
-	logrus.Infof("deleteUserByAdmin: request time after success fully deleting user by admin: %d", time.Since(startTime).Milliseconds())
+	logrus.Infof("deleteUserByAdmin: request time after requesting deletion by admin: %d", time.Since(startTime).Milliseconds())
 }
 
 func (srv *Server) updateFCMToken(resp http.ResponseWriter, req *http.Request) {
@@ -910,29 +745,38 @@ func (srv *Server) changePassword(resp http.ResponseWriter, req *http.Request) {
 		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Unable to do this operation right now", "error parsing request")
 		return
 	}
-	// todo remove oldPassword check
-	if !crypto.IsGoodPassword(changePassword.OldPassword) {
-		connectuperror.RespondClientErr(resp, req, errors.New("old password must be at least 6 characters long"), http.StatusBadRequest, "old password must be at least 6 characters long")
+	isOldPasswordCorrect, err := srv.DBHelper.IsPasswordMatched(uc.ID, changePassword.OldPassword)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to check old password")
 		return
 	}
-
-	if !crypto.IsGoodPassword(changePassword.NewPassword) {
-		connectuperror.RespondClientErr(resp, req, errors.New("new password must be at least 6 characters long"), http.StatusBadRequest, "new password must be at least 6 characters long")
+	if !isOldPasswordCorrect {
+		connectuperror.RespondClientErr(resp, req, errors.New("old password is wrong"), http.StatusBadRequest, "old password is wrong")
 		return
 	}
 
-	isOldPasswordCorrect, err := srv.DBHelper.IsPasswordMatched(uc.ID, changePassword.OldPassword)
+	userInfo, err := srv.DBHelper.GetUserInfo(uc.ID)
 	if err != nil {
-		connectuperror.RespondClientErr(resp, req, errors.New("old password is wrong"), http.StatusBadRequest, "old password is wrong")
+		connectuperror.RespondGenericServerErr(resp, req, err, "error in getting user info")
 		return
 	}
 
-	if isOldPasswordCorrect {
-		err = srv.DBHelper.ChangeUserPassword(uc, changePassword)
-		if err != nil {
-			connectuperror.RespondGenericServerErr(resp, req, err, "unable to update password")
-			return
-		}
+	violations, strength := srv.passwordPolicy().check(changePassword.NewPassword, []string{userInfo.Email.String, userInfo.Name, userInfo.Phone.String})
+	if changePassword.NewPassword == changePassword.OldPassword {
+		violations = append(violations, passwordViolation{
+			Code:    passwordViolationSameAsOld,
+			Message: "new password must be different from the old password",
+		})
+	}
+	if len(violations) > 0 {
+		respondPasswordRejected(resp, req, violations, strength)
+		return
+	}
+
+	err = srv.DBHelper.ChangeUserPassword(uc, changePassword)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to update password")
+		return
 	}
 
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
@@ -942,8 +786,15 @@ func (srv *Server) changePassword(resp http.ResponseWriter, req *http.Request) {
 func (srv *Server) addNewUserLocation(resp http.ResponseWriter, req *http.Request) {
 	uc := srv.getUserContext(req)
 
+	var location json.RawMessage
+	err := json.NewDecoder(req.Body).Decode(&location)
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
+		return
+	}
+
 	var userLocation models.NewUserLocationRequest
-	err := json.NewDecoder(req.Body).Decode(&userLocation)
+	err = json.Unmarshal(location, &userLocation)
 	if err != nil {
 		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "error parsing request")
 		return
@@ -957,6 +808,10 @@ func (srv *Server) addNewUserLocation(resp http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	if err := srv.recordSessionLocation(uc.ID, uc.Session.Token, location); err != nil {
+		logrus.Errorf("addNewUserLocation: unable to record location of session: %v", err)
+	}
+
 	utils.EncodeJSON200Body(resp, map[string]interface{}{
 		"message": "success",
 	})
@@ -1176,459 +1031,12 @@ func (srv *Server) getBlockedContactsV2(resp http.ResponseWriter, req *http.Requ
 * 	@Description This method is used to upload image in db and cloud storage.
  */
 func (srv *Server) uploadV2(resp http.ResponseWriter, req *http.Request) {
-	uc := srv.getUserContext(req)
-
-	defer func(req *http.Request) {
-		if req.MultipartForm != nil { // prevent panic from nil pointer
-			if err := req.MultipartForm.RemoveAll(); err != nil {
-				logrus.Errorf("Unable to remove all multipart form. %+v", err)
-			}
-		}
-	}(req)
-
-	req.Body = http.MaxBytesReader(resp, req.Body, 51<<20)
-
-	if err := req.ParseMultipartForm(51 << 20); err != nil {
-		if err == io.EOF || err.Error() == string(models.MultipartUnexpectedEOF) {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Errorf("[ParseMultipartForm] %s", err.Error())
-		}
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to parse file", "error parsing file")
-		return
-	}
-
-	file, header, err := req.FormFile("file")
-
-	defer func() {
-		if err = file.Close(); err != nil {
-			logrus.Errorf("Unable to close file multipart form. %+v", err)
-		}
-	}()
-
-	if err != nil {
-		if err == io.EOF {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Error(err)
-		}
-
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to read file", "unable to read file")
-		return
-	}
-
-	typeOfUploadBinary := models.UploadBinaryType(req.FormValue("upload_binary_type"))
-	typeOfUpload := models.UploadType(req.FormValue("type"))
-
-	filePath := ""
-
-	switch typeOfUploadBinary {
-	case models.UploadBinaryTypeImage:
-		filePath = fmt.Sprintf(`images/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeVideo:
-		filePath = fmt.Sprintf(`videos/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeAudio:
-		filePath = fmt.Sprintf(`audios/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	case models.UploadBinaryTypeDocument:
-		filePath = fmt.Sprintf(`documents/%v/%v-%s`, typeOfUpload, time.Now().Unix(), header.Filename)
-	default:
-		connectuperror.RespondGenericServerErr(resp, req, errors.New("file type not valid"), "invalid file type")
-		return
-	}
-
-	err = srv.StorageProvider.Upload(req.Context(), utils.GetUploadsBucketName(), file, filePath, "application/octet-stream", false)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload file")
-		return
-	}
-
-	url, err := srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), filePath, time.Hour*24*365)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get url")
-		return
-	}
-
-	SQL := `INSERT INTO uploads 
-			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			RETURNING id,u_id`
-
-	var files models.Upload
-
-	args := []interface{}{
-		header.Filename,
-		utils.GetUploadsBucketName(),
-		filePath,
-		typeOfUpload,
-		uc.ID,
-		typeOfUploadBinary,
-		url,
-		time.Now().AddDate(1, 0, 0),
-	}
-
-	err = srv.PSQL.DB().Get(&files, SQL, args...)
-	if err != nil {
-		logrus.Errorf("uploadV2: error inserting into upload: %v", err)
-		connectuperror.RespondGenericServerErr(resp, req, err, "Error inserting file")
-		return
-	}
-
-	var thumbURL string
-	if typeOfUploadBinary == models.UploadBinaryTypeVideo {
-		if thumbURL, err = thumbnailUpload(req, srv, url, header, uc, files); err != nil {
-			logrus.Errorf("uploadV2: unable to generate thumbnail %v", err)
-		}
-	}
-
-	if strings.Contains(header.Filename, ".svg") {
-		_, err := srv.ConvertSVGToPNG(resp, req, file, typeOfUpload, uc, files)
-		if err != nil {
-			logrus.Errorf("uploadV2: unable to generate png of svg thumbnail %v", err)
-		}
-	}
-
-	if typeOfUploadBinary != models.UploadBinaryTypeVideo {
-		thumbURL = url
-	}
-
-	utils.EncodeJSON200Body(resp, map[string]interface{}{
-		"id":           files.FileID,
-		"imageUID":     files.FileUUID,
-		"url":          url,
-		"thumbnailUrl": thumbURL,
-	})
-}
-
-func (srv *Server) ConvertSVGToPNG(resp http.ResponseWriter, req *http.Request, file multipart.File, typeOfUpload models.UploadType, uc *models.UserContext, files models.Upload) (bool, error) {
-	_, err := file.Seek(0, 0)
-	if err != nil {
-		logrus.Errorf("unable to seek the file %v", err)
-		return true, err
-	}
-
-	pngFileName, err := utils.ConvertToPNG(file)
-	if err != nil {
-		// connectuperror.RespondGenericServerErr(resp, req, err, "unable to convert to png")
-		return true, err
-	}
-
-	defer func(name string) {
-		err := os.Remove(name)
-		if err != nil {
-			logrus.Errorf("unable to remove file %v", err)
-		}
-	}(pngFileName)
-
-	err = srv.StorageProvider.Upload(req.Context(), utils.GetUploadsBucketName(), file, pngFileName, "application/octet-stream", true)
-	if err != nil {
-		// connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload file")
-		return true, err
-	}
-
-	url, err := srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), pngFileName, time.Hour*24*365)
-	if err != nil {
-		// connectuperror.RespondGenericServerErr(resp, req, err, "unable to get url")
-		return true, err
-	}
-
-	SQL := `INSERT INTO uploads 
-			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			RETURNING id,u_id`
-
-	var pngFiles models.Upload
-
-	args := []interface{}{
-		fmt.Sprintf("%v-%v.png", "industry", time.Now().Unix()),
-		utils.GetUploadsBucketName(),
-		pngFileName,
-		typeOfUpload,
-		uc.ID,
-		models.UploadBinaryTypeImage,
-		url,
-		time.Now().AddDate(1, 0, 0),
-	}
-
-	err = srv.PSQL.DB().Get(&pngFiles, SQL, args...)
-	if err != nil {
-		logrus.Errorf("uploadV2: error inserting into upload: %v", err)
-		// connectuperror.RespondGenericServerErr(resp, req, err, "Error inserting file")
-		return true, err
-	}
-
-	SQL = `insert into svg_to_png (svg_id, png_id) values ($1,$2);`
-
-	_, err = srv.PSQL.DB().Exec(SQL, files.FileID, pngFiles.FileID)
-	if err != nil {
-		logrus.Errorf("uploadV2: error inserting into upload: %v", err)
-		return true, err
-	}
-	return false, nil
-}
-
-func thumbnailUpload(req *http.Request, srv *Server, url string, header *multipart.FileHeader, uc *models.UserContext, files models.Upload) (string, error) {
-	var thumbnailURL string
-	if env.InKubeCluster() {
-		thumbnailHost := srv.DynamicConfig.GetString(config.ThumbnailGeneratorHost)
-		thumbnailURL = fmt.Sprintf("http://%s/thumbnail", thumbnailHost)
-	} else {
-		thumbnailURL = "http://127.0.0.1:5000/thumbnail"
-	}
-	logrus.Infof("thumbnailUpload: thumbnailURL is %s", thumbnailURL)
-	type body struct {
-		URL      string `json:"url"`
-		Filename string `json:"filename"`
-	}
-
-	data, err := json.Marshal(body{URL: url, Filename: header.Filename})
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: marshal err %v", err)
-		return "", err
-	}
-	reader := bytes.NewReader(data)
-
-	// nolint:gosec // no problem
-	response, err := http.Post(thumbnailURL, "application/json;content=UTF-8", reader)
-	logrus.Infof("thumbnailUpload: response status is %v and error is %v", response, err)
-	if response == nil {
-		logrus.Infof("thumbnailUpload: response is nil")
-		return "", errors.New("not able to get thumbnail")
-	}
-	if response.StatusCode == http.StatusBadRequest || response.StatusCode == http.StatusInternalServerError || err != nil {
-		return "", err
-	}
-
-	err = os.MkdirAll("images/thumbnail", models.PermValue)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to create directory %v", err)
-		return "", err
-	}
-
-	FileName := fmt.Sprintf("%v%v.png", "thumbnail", time.Now().Unix())
-	FilePath := fmt.Sprintf(`images/%v/%v-%s`, models.UploadTypeThumbnail, time.Now().Unix(), FileName)
-
-	file, err := os.Create(FilePath)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to create file %v", err)
-		return "", err
-	}
-
-	size, err := io.Copy(file, response.Body)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to copy into file %v", err)
-		return "", err
-	}
-
-	if size/(1024*1024) > 5 {
-		return "", errors.New("file size is more then 5 mb")
-	}
-
-	err = file.Close()
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to close file %v", err)
-	}
-
-	err = srv.StorageProvider.Upload(req.Context(), utils.GetUploadsBucketName(), file, FilePath, "application/octet-stream", true)
-	if err != nil {
-		return "", err
-	}
-
-	thumbURL, err := srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), FilePath, time.Hour*24*365)
-	if err != nil {
-		return "", err
-	}
-
-	err = os.Remove(FilePath)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to remove file %v", err)
-	}
-
-	err = response.Body.Close()
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: unable to close response %v", err)
-	}
-
-	SQL := `INSERT INTO uploads 
-			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
-
-	args := []interface{}{
-		FileName,
-		utils.GetUploadsBucketName(),
-		FilePath,
-		models.UploadTypeThumbnail,
-		uc.ID,
-		models.UploadBinaryTypeImage,
-		thumbURL,
-		time.Now().AddDate(1, 0, 0),
-	}
-
-	var thumbnail models.Upload
-	err = srv.PSQL.DB().Get(&thumbnail, SQL, args...)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: error inserting into upload: %v", err)
-		return "", err
-	}
-
-	SQL = `INSERT INTO thumbnail (upload_id, thumbnail_id) 
-			VALUES ($1, $2)`
-
-	_, err = srv.PSQL.DB().Exec(SQL, files.FileID, thumbnail.FileID)
-	if err != nil {
-		logrus.Errorf("thumbnailUpload: error inserting into upload: %v", err)
-		return "", err
-	}
-
-	return thumbURL, nil
+	srv.handleUpload(resp, req, defaultUploadPipeline)
 }
 
 /*     	* uploadImageV3
 * 	@Description This method is used to upload image in db and cloud storage.
  */
 func (srv *Server) uploadImageV3(resp http.ResponseWriter, req *http.Request) {
-	startTime := time.Now()
-	uc := srv.getUserContext(req)
-	defer func(req *http.Request) {
-		if req.MultipartForm != nil { // prevent panic from nil pointer
-			if err := req.MultipartForm.RemoveAll(); err != nil {
-				logrus.Errorf("Unable to remove all multipart form. %+v", err)
-			}
-		}
-	}(req)
-
-	req.Body = http.MaxBytesReader(resp, req.Body, 51<<20)
-
-	if err := req.ParseMultipartForm(51 << 20); err != nil {
-		if err == io.EOF || err.Error() == string(models.MultipartUnexpectedEOF) {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Errorf("[ParseMultipartForm] %s", err.Error())
-		}
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to parse file", "error parsing file")
-		return
-	}
-
-	file, header, err := req.FormFile("file")
-
-	defer func() {
-		if err = file.Close(); err != nil {
-			logrus.Errorf("Unable to close file multipart form. %+v", err)
-		}
-	}()
-
-	if err != nil {
-		if err == io.EOF {
-			logrus.Warn("EOF")
-		} else {
-			logrus.Error(err)
-		}
-
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "unable to read file", "unable to read file")
-		return
-	}
-
-	imageBytes, err := io.ReadAll(file)
-	if err != nil {
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "file is not an image")
-		return
-	}
-
-	mediaType := strings.Split(mimetype.Detect(imageBytes).String(), "/")
-	if mediaType[0] != string(models.MIMEMediaTypeImage) {
-		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "file is not an image")
-		return
-	}
-
-	filePath := fmt.Sprintf(`images/user_profile/%v-%s`, time.Now().Unix(), header.Filename)
-
-	localFilePath, err := utils.CreateImageFile(file, header.Filename)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to create image file")
-		return
-	}
-	defer func() {
-		err = os.Remove(localFilePath)
-		if err != nil {
-			logrus.Errorf("uploadImageV3: error in removing file: %v", err)
-		}
-	}()
-	annotations, err := utils.DetectFaces(resp, localFilePath)
-
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to detect face")
-		return
-	}
-
-	switch {
-	case len(annotations) == 0:
-		connectuperror.RespondClientErr(resp, req, errors.New("add a image that has your face"), http.StatusBadRequest, "Add a image that has your face")
-		return
-	case len(annotations) > 1:
-		connectuperror.RespondClientErr(resp, req, errors.New("image should contain only 1 face"), http.StatusBadRequest, "Image should contain only 1 face")
-		return
-	case annotations[0].DetectionConfidence <= minDetectionConfidence:
-		connectuperror.RespondClientErr(resp, req, errors.New("detection confidence is lesser or equal to 0.5"), http.StatusBadRequest, "Upload a proper image")
-		return
-	case annotations[0].BlurredLikelihood == vision.Likelihood_VERY_LIKELY:
-		connectuperror.RespondClientErr(resp, req, errors.New("image is too blurry to process"), http.StatusBadRequest, "Add a image that has a clear face")
-		return
-	}
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload image")
-		return
-	}
-
-	err = srv.StorageProvider.Upload(req.Context(), utils.GetUploadsBucketName(), file, filePath, "application/octet-stream", false)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to upload file")
-		return
-	}
-
-	url, err := srv.StorageProvider.GetSharableURL(utils.GetUploadsBucketName(), filePath, time.Hour*24*365)
-	if err != nil {
-		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get url")
-		return
-	}
-
-	SQL := `INSERT INTO uploads 
-			(name, bucket, path, type, uploaded_by, binary_type, url, url_expiration_time) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			RETURNING id,u_id
-			`
-
-	var files models.Upload
-
-	args := []interface{}{
-		header.Filename,
-		utils.GetUploadsBucketName(),
-		filePath,
-		models.UploadTypeUserProfileImage,
-		uc.ID,
-		models.UploadBinaryTypeImage,
-		url,
-		time.Now().AddDate(1, 0, 0),
-	}
-
-	err = srv.PSQL.DB().Get(&files, SQL, args...)
-	if err != nil {
-		logrus.Errorf("upload: error inserting into upload: %v", err)
-		connectuperror.RespondGenericServerErr(resp, req, err, "Error inserting file")
-		return
-	}
-
-	defer func() {
-		err = os.Remove(localFilePath)
-		if err != nil {
-			logrus.Errorf("uploadImageV3: error in removing file: %v", err)
-		}
-	}()
-
-	utils.EncodeJSON200Body(resp, map[string]interface{}{
-		"id":           files.FileID,
-		"imageUID":     files.FileUUID,
-		"url":          url,
-		"thumbnailUrl": url,
-	})
-	logrus.Infof("upload: request time upload data successfully: %d", time.Since(startTime).Milliseconds())
+	srv.handleUpload(resp, req, profileImageUploadPipeline)
 }
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RemoteState/connect-up/connectuperror"
+	"github.com/RemoteState/connect-up/utils"
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+)
+
+// userSession is an active session of the user on one of their devices. Token is never returned,
+// sessions are revoked by id.
+type userSession struct {
+	ID             int              `json:"id" db:"id"`
+	Token          string           `json:"-" db:"token"`
+	Platform       string           `json:"platform" db:"platform"`
+	DeviceID       *string          `json:"deviceId" db:"device_id"`
+	CreatedAt      time.Time        `json:"createdAt" db:"created_at"`
+	LastPingAt     *time.Time       `json:"lastPingAt" db:"last_ping_at"`
+	LastLocation   *json.RawMessage `json:"lastLocation" db:"last_location"`
+	LastLocationAt *time.Time       `json:"lastLocationAt" db:"last_location_at"`
+	Current        bool             `json:"current" db:"-"`
+}
+
+const userSessionColumns = `s.id, s.token, s.platform, s.device_id, s.created_at,
+			       a.last_ping_at, a.last_location, a.last_location_at`
+
+func (srv *Server) getActiveSessions(userID int) ([]userSession, error) {
+	SQL := `SELECT ` + userSessionColumns + `
+			FROM sessions s
+			         LEFT JOIN session_activity a ON a.session_token = s.token
+			WHERE s.user_id = $1
+			  AND s.end_time IS NULL
+			ORDER BY coalesce(a.last_ping_at, s.created_at) DESC`
+
+	sessions := make([]userSession, 0)
+	err := srv.PSQL.DB().Select(&sessions, SQL, userID)
+	return sessions, err
+}
+
+// touchSession records the last ping of the session, it is called on every ping of the user.
+func (srv *Server) touchSession(userID int, token string) error {
+	SQL := `INSERT INTO session_activity (session_token, user_id, last_ping_at)
+			VALUES ($1, $2, now())
+			ON CONFLICT (session_token) DO UPDATE
+			    SET last_ping_at = excluded.last_ping_at`
+
+	_, err := srv.PSQL.DB().Exec(SQL, token, userID)
+	return err
+}
+
+// recordSessionLocation keeps the last location sent from the session as it was received.
+func (srv *Server) recordSessionLocation(userID int, token string, location json.RawMessage) error {
+	SQL := `INSERT INTO session_activity (session_token, user_id, last_location, last_location_at)
+			VALUES ($1, $2, $3, now())
+			ON CONFLICT (session_token) DO UPDATE
+			    SET last_location    = excluded.last_location,
+			        last_location_at = excluded.last_location_at`
+
+	_, err := srv.PSQL.DB().Exec(SQL, token, userID, []byte(location))
+	return err
+}
+
+// revokeSessions ends the sessions and drops their cached user context so the tokens stop
+// working right away instead of when the cache expires.
+func (srv *Server) revokeSessions(authID string, sessions []userSession) error {
+	for _, session := range sessions {
+		if err := srv.DBHelper.EndSession(session.Token); err != nil {
+			return err
+		}
+		srv.CacheProvider.ClearCache(srv.CacheProvider.GenerateKey(userContextCacheKey, authID, session.Token))
+
+		if err := srv.revokeSessionTokenFamilies(session.Token); err != nil {
+			logrus.Errorf("revokeSessions: unable to revoke refresh tokens of session %d: %v", session.ID, err)
+		}
+
+		SQL := `DELETE FROM session_activity WHERE session_token = $1`
+		if _, err := srv.PSQL.DB().Exec(SQL, session.Token); err != nil {
+			logrus.Errorf("revokeSessions: unable to delete activity of session %d: %v", session.ID, err)
+		}
+	}
+	return nil
+}
+
+/*
+  - getUserSessions
+  - @Description This method is used to list the active sessions of the
+    user with their platform, device, last location and last ping.
+*/
+func (srv *Server) getUserSessions(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	sessions, err := srv.getActiveSessions(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get sessions")
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = uc.Session != nil && sessions[i].Token == uc.Session.Token
+	}
+
+	utils.EncodeJSON200Body(resp, sessions)
+}
+
+/*
+  - revokeUserSession
+  - @Description This method is used to sign the user out of one of
+    their sessions.
+*/
+func (srv *Server) revokeUserSession(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	sessionID, err := strconv.Atoi(chi.URLParam(req, "sessionID"))
+	if err != nil {
+		connectuperror.RespondClientErr(resp, req, err, http.StatusBadRequest, "Error parsing sessionId")
+		return
+	}
+
+	sessions, err := srv.getActiveSessions(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get sessions")
+		return
+	}
+
+	revoked := make([]userSession, 0, 1)
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			revoked = append(revoked, session)
+		}
+	}
+
+	if len(revoked) == 0 {
+		connectuperror.RespondClientErr(resp, req, errors.New("session not found"), http.StatusNotFound, "session not found")
+		return
+	}
+
+	if err := srv.revokeSessions(uc.AuthID, revoked); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to revoke session")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+	})
+}
+
+/*
+  - revokeOtherUserSessions
+  - @Description This method is used to sign the user out of every
+    session except the one making the request.
+*/
+func (srv *Server) revokeOtherUserSessions(resp http.ResponseWriter, req *http.Request) {
+	uc := srv.getUserContext(req)
+
+	if uc.Session == nil {
+		connectuperror.RespondClientErr(resp, req, errors.New("session not found"), http.StatusBadRequest, "session not found")
+		return
+	}
+
+	sessions, err := srv.getActiveSessions(uc.ID)
+	if err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to get sessions")
+		return
+	}
+
+	revoked := make([]userSession, 0, len(sessions))
+	for _, session := range sessions {
+		if session.Token != uc.Session.Token {
+			revoked = append(revoked, session)
+		}
+	}
+
+	if err := srv.revokeSessions(uc.AuthID, revoked); err != nil {
+		connectuperror.RespondGenericServerErr(resp, req, err, "unable to revoke sessions")
+		return
+	}
+
+	utils.EncodeJSON200Body(resp, map[string]interface{}{
+		"message": "success",
+		"revoked": len(revoked),
+	})
+}
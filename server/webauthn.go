@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// webauthnRPIDConfig is the domain passkeys are bound to, webauthnOriginsConfig the comma separated
+	// origins allowed to use them: the web dashboard and the android:apk-key-hash origins of the app.
+	webauthnRPIDConfig    = "WEBAUTHN_RP_ID"
+	webauthnRPNameConfig  = "WEBAUTHN_RP_NAME"
+	webauthnOriginsConfig = "WEBAUTHN_ORIGINS"
+
+	defaultWebauthnRPID   = "connectup.com"
+	defaultWebauthnRPName = "ConnectUp"
+
+	webauthnChallengeTTL = 5 * time.Minute
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	authenticatorFlagUserPresent       = 0x01
+	authenticatorFlagUserVerified      = 0x04
+	authenticatorFlagAttestedCredData  = 0x40
+	authenticatorFlagExtensionDataIncl = 0x80
+)
+
+type webauthnChallengePurpose string
+
+const (
+	webauthnChallengeRegistration webauthnChallengePurpose = "registration"
+	webauthnChallengeLogin        webauthnChallengePurpose = "login"
+)
+
+var errWebauthnInvalid = errors.New("passkey could not be verified")
+
+// base64URLBytes holds the binary fields of WebAuthn JSON, encoded as unpadded base64url like the
+// toJSON methods of browsers. Padded values are accepted too.
+type base64URLBytes []byte
+
+func (b base64URLBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URLBytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type webauthnRelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+func (srv *Server) webauthnRelyingParty() webauthnRelyingParty {
+	rp := webauthnRelyingParty{
+		ID:   srv.DynamicConfig.GetString(webauthnRPIDConfig),
+		Name: srv.DynamicConfig.GetString(webauthnRPNameConfig),
+	}
+	if rp.ID == "" {
+		rp.ID = defaultWebauthnRPID
+	}
+	if rp.Name == "" {
+		rp.Name = defaultWebauthnRPName
+	}
+
+	for _, origin := range strings.Split(srv.DynamicConfig.GetString(webauthnOriginsConfig), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			rp.Origins = append(rp.Origins, origin)
+		}
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{"https://" + rp.ID}
+	}
+	return rp
+}
+
+// collectedClientData is the clientDataJSON signed by the authenticator.
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks the ceremony type and origin of the client data and returns it.
+func (rp webauthnRelyingParty) verifyClientData(raw []byte, ceremony string) (collectedClientData, error) {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return clientData, fmt.Errorf("%w: client data: %v", errWebauthnInvalid, err)
+	}
+
+	if clientData.Type != ceremony {
+		return clientData, fmt.Errorf("%w: unexpected ceremony %q", errWebauthnInvalid, clientData.Type)
+	}
+
+	for _, origin := range rp.Origins {
+		if clientData.Origin == origin {
+			return clientData, nil
+		}
+	}
+	return clientData, fmt.Errorf("%w: origin %q is not allowed", errWebauthnInvalid, clientData.Origin)
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseAuthenticatorData parses the authenticator data, and the attested credential it carries
+// during registration.
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data too short", errWebauthnInvalid)
+	}
+
+	parsed := authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if parsed.Flags&authenticatorFlagAttestedCredData == 0 {
+		return parsed, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, fmt.Errorf("%w: attested credential data too short", errWebauthnInvalid)
+	}
+	parsed.AAGUID = rest[:16]
+
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return authenticatorData{}, fmt.Errorf("%w: credential id too short", errWebauthnInvalid)
+	}
+	parsed.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, remaining, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("%w: credential public key: %v", errWebauthnInvalid, err)
+	}
+	parsed.PublicKey = rest[:len(rest)-len(remaining)]
+
+	if len(remaining) > 0 && parsed.Flags&authenticatorFlagExtensionDataIncl == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: trailing authenticator data", errWebauthnInvalid)
+	}
+	return parsed, nil
+}
+
+// verifyRelyingParty checks the authenticator data was produced for this relying party with the
+// user present and verified. Passkeys replace the password, so the authenticator must have checked
+// the biometrics or PIN of the user, presence alone is not enough.
+func (rp webauthnRelyingParty) verifyRelyingParty(data authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: relying party id mismatch", errWebauthnInvalid)
+	}
+	if data.Flags&authenticatorFlagUserPresent == 0 {
+		return fmt.Errorf("%w: user not present", errWebauthnInvalid)
+	}
+	if data.Flags&authenticatorFlagUserVerified == 0 {
+		return fmt.Errorf("%w: user not verified", errWebauthnInvalid)
+	}
+	return nil
+}
+
+// parseCOSEKey returns the algorithm and public key of a COSE_Key, only ES256 on P-256 and RS256
+// are accepted.
+func parseCOSEKey(data []byte) (int64, crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: public key is not a map", errWebauthnInvalid)
+	}
+
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, fmt.Errorf("%w: invalid P-256 key", errWebauthnInvalid)
+		}
+
+		// ecdh refuses points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return 0, nil, fmt.Errorf("%w: %v", errWebauthnInvalid, err)
+		}
+		return alg, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, fmt.Errorf("%w: invalid RSA key", errWebauthnInvalid)
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return 0, nil, fmt.Errorf("%w: unsupported algorithm %d", errWebauthnInvalid, alg)
+}
+
+// verifyAssertionSignature checks the signature of the authenticator data and client data hash.
+func verifyAssertionSignature(publicKey []byte, authData, clientDataJSON, signature []byte) error {
+	alg, key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature) {
+			return fmt.Errorf("%w: bad signature", errWebauthnInvalid)
+		}
+	case coseAlgRS256:
+		if err := rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: bad signature", errWebauthnInvalid)
+		}
+	}
+	return nil
+}
+
+// newWebauthnChallenge stores a random challenge for the ceremony. Registration challenges belong
+// to the user registering, login challenges to nobody until a passkey answers them.
+func (srv *Server) newWebauthnChallenge(purpose webauthnChallengePurpose, userID *int) (base64URLBytes, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	SQL := `INSERT INTO webauthn_challenges (challenge, purpose, user_id, expires_at)
+			VALUES ($1, $2, $3, $4)`
+
+	_, err := srv.PSQL.DB().Exec(SQL, base64.RawURLEncoding.EncodeToString(challenge), purpose, userID, time.Now().Add(webauthnChallengeTTL))
+	return challenge, err
+}
+
+// consumeWebauthnChallenge uses the challenge echoed in the client data, each one is accepted once.
+func consumeWebauthnChallenge(db sqlGetter, challenge string, purpose webauthnChallengePurpose) (sql.NullInt64, error) {
+	SQL := `UPDATE webauthn_challenges
+			SET used_at = now()
+			WHERE challenge = $1
+			  AND purpose = $2
+			  AND used_at IS NULL
+			  AND expires_at > now()
+			RETURNING user_id`
+
+	var userID sql.NullInt64
+	err := db.Get(&userID, SQL, challenge, purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return userID, fmt.Errorf("%w: unknown or expired challenge", errWebauthnInvalid)
+	}
+	return userID, err
+}
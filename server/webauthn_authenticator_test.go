@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// softwareAuthenticator is a passkey authenticator held in memory. It answers the options returned
+// by the passkey endpoints the way a platform authenticator does, so registration and login can be
+// tested without hardware.
+type softwareAuthenticator struct {
+	mu          sync.Mutex
+	credentials map[string]*softwareCredential
+	// skipUserVerification answers like an authenticator that only checks the user is present.
+	skipUserVerification bool
+}
+
+type softwareCredential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+func newSoftwareAuthenticator() *softwareAuthenticator {
+	return &softwareAuthenticator{credentials: make(map[string]*softwareCredential)}
+}
+
+func softwareClientData(ceremony string, challenge []byte, origin string) ([]byte, error) {
+	return json.Marshal(collectedClientData{
+		Type:      ceremony,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+}
+
+func softwareAuthenticatorData(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, signCount)
+}
+
+func (authenticator *softwareAuthenticator) flags() byte {
+	if authenticator.skipUserVerification {
+		return authenticatorFlagUserPresent
+	}
+	return authenticatorFlagUserPresent | authenticatorFlagUserVerified
+}
+
+// create makes a new ES256 credential for the creation options, with attestation "none".
+func (authenticator *softwareAuthenticator) create(options passkeyCreationOptions, origin string) (registrationCredential, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return registrationCredential{}, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return registrationCredential{}, err
+	}
+
+	publicKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		return registrationCredential{}, err
+	}
+	point := publicKey.Bytes()
+
+	coseKey, err := encodeCBOR(map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(3):  int64(coseAlgES256),
+		int64(-1): int64(1),
+		int64(-2): point[1:33],
+		int64(-3): point[33:],
+	})
+	if err != nil {
+		return registrationCredential{}, err
+	}
+
+	authData := softwareAuthenticatorData(options.RP.ID, authenticator.flags()|authenticatorFlagAttestedCredData, 0)
+	authData = append(authData, make([]byte, 16)...) // AAGUID, zero for attestation "none"
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, coseKey...)
+
+	attestationObject, err := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return registrationCredential{}, err
+	}
+
+	clientData, err := softwareClientData("webauthn.create", options.Challenge, origin)
+	if err != nil {
+		return registrationCredential{}, err
+	}
+
+	authenticator.mu.Lock()
+	authenticator.credentials[string(id)] = &softwareCredential{
+		id:         id,
+		rpID:       options.RP.ID,
+		userHandle: options.User.ID,
+		key:        key,
+	}
+	authenticator.mu.Unlock()
+
+	var credential registrationCredential
+	credential.ID = base64.RawURLEncoding.EncodeToString(id)
+	credential.RawID = id
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = clientData
+	credential.Response.AttestationObject = attestationObject
+	credential.Response.Transports = []string{"internal"}
+	return credential, nil
+}
+
+// get signs the request options with the most recent credential of the relying party, or with the
+// given credential.
+func (authenticator *softwareAuthenticator) get(options passkeyRequestOptions, origin string, credentialID []byte) (assertionCredential, error) {
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	var selected *softwareCredential
+	if credentialID != nil {
+		selected = authenticator.credentials[string(credentialID)]
+	} else {
+		for _, credential := range authenticator.credentials {
+			if credential.rpID == options.RPID {
+				selected = credential
+			}
+		}
+	}
+	if selected == nil || selected.rpID != options.RPID {
+		return assertionCredential{}, errors.New("no credential for relying party " + options.RPID)
+	}
+
+	selected.signCount++
+	authData := softwareAuthenticatorData(options.RPID, authenticator.flags(), selected.signCount)
+
+	clientData, err := softwareClientData("webauthn.get", options.Challenge, origin)
+	if err != nil {
+		return assertionCredential{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, selected.key, digest[:])
+	if err != nil {
+		return assertionCredential{}, err
+	}
+
+	var credential assertionCredential
+	credential.ID = base64.RawURLEncoding.EncodeToString(selected.id)
+	credential.RawID = selected.id
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = clientData
+	credential.Response.AuthenticatorData = authData
+	credential.Response.Signature = signature
+	credential.Response.UserHandle = selected.userHandle
+	return credential, nil
+}
+
+const testOrigin = "https://connectup.com"
+
+func testRelyingParty() webauthnRelyingParty {
+	return webauthnRelyingParty{ID: "connectup.com", Name: "ConnectUp", Origins: []string{testOrigin}}
+}
+
+func testCreationOptions(t *testing.T, rpID string) passkeyCreationOptions {
+	t.Helper()
+
+	var options passkeyCreationOptions
+	options.Challenge = testChallenge(t)
+	options.RP.ID = rpID
+	options.User.ID = []byte("user handle")
+	return options
+}
+
+func testRequestOptions(t *testing.T, rpID string) passkeyRequestOptions {
+	t.Helper()
+	return passkeyRequestOptions{Challenge: testChallenge(t), RPID: rpID}
+}
+
+func testChallenge(t *testing.T) base64URLBytes {
+	t.Helper()
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// registerTestPasskey creates a passkey with the authenticator and returns its verified
+// authenticator data, the public key and counter stored for it.
+func registerTestPasskey(t *testing.T, rp webauthnRelyingParty, authenticator *softwareAuthenticator) authenticatorData {
+	t.Helper()
+
+	credential, err := authenticator.create(testCreationOptions(t, rp.ID), testOrigin)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	_, authData, _, err := rp.verifyRegistration(credential)
+	if err != nil {
+		t.Fatalf("verifyRegistration() error = %v", err)
+	}
+	return authData
+}
+
+func TestPasskeyRegistrationAndAssertion(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := newSoftwareAuthenticator()
+
+	creationOptions := testCreationOptions(t, rp.ID)
+	credential, err := authenticator.create(creationOptions, testOrigin)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+
+	clientData, registered, alg, err := rp.verifyRegistration(credential)
+	if err != nil {
+		t.Fatalf("verifyRegistration() error = %v", err)
+	}
+	if clientData.Challenge != base64.RawURLEncoding.EncodeToString(creationOptions.Challenge) {
+		t.Errorf("challenge = %q, want the challenge of the options", clientData.Challenge)
+	}
+	if alg != coseAlgES256 {
+		t.Errorf("algorithm = %d, want ES256", alg)
+	}
+	if !bytes.Equal(registered.CredentialID, credential.RawID) {
+		t.Errorf("credential id = %x, want %x", registered.CredentialID, []byte(credential.RawID))
+	}
+
+	requestOptions := testRequestOptions(t, rp.ID)
+	assertion, err := authenticator.get(requestOptions, testOrigin, nil)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if !bytes.Equal(assertion.RawID, credential.RawID) {
+		t.Errorf("assertion credential = %x, want the registered one", []byte(assertion.RawID))
+	}
+	if !bytes.Equal(assertion.Response.UserHandle, creationOptions.User.ID) {
+		t.Errorf("user handle = %q, want the handle of the options", assertion.Response.UserHandle)
+	}
+
+	clientData, err = rp.verifyClientData(assertion.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		t.Fatalf("verifyClientData() error = %v", err)
+	}
+	if clientData.Challenge != base64.RawURLEncoding.EncodeToString(requestOptions.Challenge) {
+		t.Errorf("challenge = %q, want the challenge of the options", clientData.Challenge)
+	}
+
+	asserted, err := rp.verifyAssertion(assertion, registered.PublicKey, int64(registered.SignCount))
+	if err != nil {
+		t.Fatalf("verifyAssertion() error = %v", err)
+	}
+	if asserted.SignCount != 1 {
+		t.Errorf("sign count = %d, want 1", asserted.SignCount)
+	}
+
+	// the same assertion presented again does not increase the counter
+	if _, err := rp.verifyAssertion(assertion, registered.PublicKey, int64(asserted.SignCount)); !errors.Is(err, errWebauthnInvalid) {
+		t.Errorf("verifyAssertion() of a replayed assertion error = %v, want errWebauthnInvalid", err)
+	}
+}
+
+func TestPasskeyRegistrationRejected(t *testing.T) {
+	rp := testRelyingParty()
+
+	tests := []struct {
+		name          string
+		authenticator *softwareAuthenticator
+		rpID          string
+		origin        string
+		tamper        func(credential *registrationCredential)
+	}{
+		{name: "user not verified", authenticator: &softwareAuthenticator{credentials: make(map[string]*softwareCredential), skipUserVerification: true}},
+		{name: "other relying party", rpID: "evil.com"},
+		{name: "other origin", origin: "https://evil.com"},
+		{name: "credential id mismatch", tamper: func(credential *registrationCredential) {
+			credential.RawID = []byte("other credential")
+		}},
+		{name: "assertion client data", tamper: func(credential *registrationCredential) {
+			clientData, _ := softwareClientData("webauthn.get", []byte("challenge"), testOrigin)
+			credential.Response.ClientDataJSON = clientData
+		}},
+		{name: "malformed attestation", tamper: func(credential *registrationCredential) {
+			credential.Response.AttestationObject = []byte{0xff}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := tt.authenticator
+			if authenticator == nil {
+				authenticator = newSoftwareAuthenticator()
+			}
+			rpID := tt.rpID
+			if rpID == "" {
+				rpID = rp.ID
+			}
+			origin := tt.origin
+			if origin == "" {
+				origin = testOrigin
+			}
+
+			credential, err := authenticator.create(testCreationOptions(t, rpID), origin)
+			if err != nil {
+				t.Fatalf("create() error = %v", err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(&credential)
+			}
+
+			if _, _, _, err := rp.verifyRegistration(credential); !errors.Is(err, errWebauthnInvalid) {
+				t.Errorf("verifyRegistration() error = %v, want errWebauthnInvalid", err)
+			}
+		})
+	}
+}
+
+func TestPasskeyAssertionRejected(t *testing.T) {
+	rp := testRelyingParty()
+
+	tests := []struct {
+		name   string
+		setup  func(authenticator *softwareAuthenticator)
+		rpID   string
+		tamper func(credential *assertionCredential)
+	}{
+		{name: "user not verified", setup: func(authenticator *softwareAuthenticator) {
+			authenticator.skipUserVerification = true
+		}},
+		{name: "other relying party", rpID: "evil.com"},
+		{name: "tampered signature", tamper: func(credential *assertionCredential) {
+			credential.Response.Signature[len(credential.Response.Signature)-1] ^= 0xff
+		}},
+		{name: "tampered client data", tamper: func(credential *assertionCredential) {
+			clientData, _ := softwareClientData("webauthn.get", []byte("other challenge"), testOrigin)
+			credential.Response.ClientDataJSON = clientData
+		}},
+		{name: "truncated authenticator data", tamper: func(credential *assertionCredential) {
+			credential.Response.AuthenticatorData = credential.Response.AuthenticatorData[:36]
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftwareAuthenticator()
+			registered := registerTestPasskey(t, rp, authenticator)
+
+			if tt.setup != nil {
+				tt.setup(authenticator)
+			}
+			rpID := tt.rpID
+			if rpID == "" {
+				rpID = rp.ID
+			}
+			if rpID != rp.ID {
+				// the authenticator only answers for the relying party the credential was made for
+				for _, credential := range authenticator.credentials {
+					credential.rpID = rpID
+				}
+			}
+
+			assertion, err := authenticator.get(testRequestOptions(t, rpID), testOrigin, nil)
+			if err != nil {
+				t.Fatalf("get() error = %v", err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(&assertion)
+			}
+
+			if _, err := rp.verifyAssertion(assertion, registered.PublicKey, int64(registered.SignCount)); !errors.Is(err, errWebauthnInvalid) {
+				t.Errorf("verifyAssertion() error = %v, want errWebauthnInvalid", err)
+			}
+		})
+	}
+}
+
+func TestPasskeyAssertionWithOtherKeyRejected(t *testing.T) {
+	rp := testRelyingParty()
+
+	authenticator := newSoftwareAuthenticator()
+	registerTestPasskey(t, rp, authenticator)
+
+	other := registerTestPasskey(t, rp, newSoftwareAuthenticator())
+
+	assertion, err := authenticator.get(testRequestOptions(t, rp.ID), testOrigin, nil)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if _, err := rp.verifyAssertion(assertion, other.PublicKey, int64(other.SignCount)); !errors.Is(err, errWebauthnInvalid) {
+		t.Errorf("verifyAssertion() error = %v, want errWebauthnInvalid", err)
+	}
+}